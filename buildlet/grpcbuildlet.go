@@ -58,6 +58,35 @@ func (c *GRPCCoordinatorClient) CreateBuildletWithStatus(ctx context.Context, bu
 	}
 }
 
+// ListBuildlets returns the names of the buildlets that were created by
+// the user that c is authenticated as and that haven't been destroyed.
+func (c *GRPCCoordinatorClient) ListBuildlets(ctx context.Context) ([]string, error) {
+	resp, err := c.Client.ListInstances(ctx, &protos.ListInstancesRequest{})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, inst := range resp.GetInstances() {
+		names = append(names, inst.GetGomoteId())
+	}
+	return names, nil
+}
+
+// DestroyBuildlet destroys the named buildlet, such as one returned by
+// ListBuildlets, without needing a client for it.
+func (c *GRPCCoordinatorClient) DestroyBuildlet(ctx context.Context, name string) error {
+	_, err := c.Client.DestroyInstance(ctx, &protos.DestroyInstanceRequest{GomoteId: name})
+	return err
+}
+
+// UploadFile uploads the contents of r to the coordinator's object store
+// and returns a URL for it. The URL may be passed to the PutTarFromURL method
+// of any buildlet created by c, so that content shared by several buildlets
+// only needs to be uploaded once.
+func (c *GRPCCoordinatorClient) UploadFile(ctx context.Context, r io.Reader) (string, error) {
+	return upload(ctx, c.Client, r)
+}
+
 type grpcBuildlet struct {
 	client  protos.GomoteServiceClient
 	id      string
@@ -185,7 +214,11 @@ func (b *grpcBuildlet) PutTarFromURL(ctx context.Context, url string, dir string
 }
 
 func (b *grpcBuildlet) upload(ctx context.Context, r io.Reader) (string, error) {
-	resp, err := b.client.UploadFile(ctx, &protos.UploadFileRequest{})
+	return upload(ctx, b.client, r)
+}
+
+func upload(ctx context.Context, client protos.GomoteServiceClient, r io.Reader) (string, error) {
+	resp, err := client.UploadFile(ctx, &protos.UploadFileRequest{})
 	if err != nil {
 		return "", err
 	}
@@ -164,25 +164,9 @@ func create(args []string) error {
 	for i := 0; i < count; i++ {
 		i := i
 		eg.Go(func() error {
-			start := time.Now()
-			stream, err := client.CreateInstance(ctx, &protos.CreateInstanceRequest{BuilderType: builderType})
+			inst, err := doCreate(ctx, client, builderType, i, status)
 			if err != nil {
-				return fmt.Errorf("failed to create buildlet: %w", err)
-			}
-			var inst string
-		updateLoop:
-			for {
-				update, err := stream.Recv()
-				switch {
-				case err == io.EOF:
-					break updateLoop
-				case err != nil:
-					return fmt.Errorf("failed to create buildlet (%d): %w", i+1, err)
-				case update.GetStatus() != protos.CreateInstanceResponse_COMPLETE && status:
-					fmt.Fprintf(os.Stderr, "# still creating %s (%d) after %v; %d requests ahead of you\n", builderType, i+1, time.Since(start).Round(time.Second), update.GetWaitersAhead())
-				case update.GetStatus() == protos.CreateInstanceResponse_COMPLETE:
-					inst = update.GetInstance().GetGomoteId()
-				}
+				return err
 			}
 			fmt.Println(inst)
 			if group != nil {
@@ -248,7 +232,32 @@ func create(args []string) error {
 		return err
 	}
 	if group != nil {
-		return storeGroup(group)
+		return storeModifiedGroup(group)
 	}
 	return nil
 }
+
+// doCreate creates a single instance of builderType and returns its name.
+// The index i identifies the instance in status updates, which are printed
+// if status is true.
+func doCreate(ctx context.Context, client protos.GomoteServiceClient, builderType string, i int, status bool) (string, error) {
+	start := time.Now()
+	stream, err := client.CreateInstance(ctx, &protos.CreateInstanceRequest{BuilderType: builderType})
+	if err != nil {
+		return "", fmt.Errorf("failed to create buildlet: %w", err)
+	}
+	var inst string
+	for {
+		update, err := stream.Recv()
+		switch {
+		case err == io.EOF:
+			return inst, nil
+		case err != nil:
+			return "", fmt.Errorf("failed to create buildlet (%d): %w", i+1, err)
+		case update.GetStatus() != protos.CreateInstanceResponse_COMPLETE && status:
+			fmt.Fprintf(os.Stderr, "# still creating %s (%d) after %v; %d requests ahead of you\n", builderType, i+1, time.Since(start).Round(time.Second), update.GetWaitersAhead())
+		case update.GetStatus() == protos.CreateInstanceResponse_COMPLETE:
+			inst = update.GetInstance().GetGomoteId()
+		}
+	}
+}
@@ -40,6 +40,7 @@ func destroy(args []string) error {
 	}
 	var destroyGroup bool
 	fs.BoolVar(&destroyGroup, "destroy-group", false, "if a group is used, destroy the group too")
+	dryRun := addDryRunFlag(fs)
 
 	fs.Parse(args)
 
@@ -54,6 +55,10 @@ func destroy(args []string) error {
 		fs.Usage()
 	}
 	for _, name := range destroySet {
+		if *dryRun {
+			fmt.Fprintf(os.Stderr, "# Would destroy %s\n", name)
+			continue
+		}
 		fmt.Fprintf(os.Stderr, "# Destroying %s\n", name)
 		ctx := context.Background()
 		client := gomoteServerClient(ctx)
@@ -63,14 +68,16 @@ func destroy(args []string) error {
 			return fmt.Errorf("unable to destroy instance: %w", err)
 		}
 	}
-	if activeGroup != nil {
+	if activeGroup != nil && !activeGroup.transient {
 		if destroyGroup {
-			if err := deleteGroup(activeGroup.Name); err != nil {
+			if err := doDeleteGroup(activeGroup.Name, *dryRun); err != nil {
 				return err
 			}
+		} else if *dryRun {
+			fmt.Fprintf(os.Stderr, "# Would remove all instances from group %q\n", activeGroup.Name)
 		} else {
 			activeGroup.Instances = nil
-			if err := storeGroup(activeGroup); err != nil {
+			if err := storeModifiedGroup(activeGroup); err != nil {
 				return err
 			}
 		}
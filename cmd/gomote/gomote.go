@@ -91,6 +91,15 @@ GOMOTE_GROUP environment variable. The -group flag must always specify a
 valid group, whereas GOMOTE_GROUP may contain an invalid group.
 Instances may be part of more than one group.
 
+A group may also be read from stdin by specifying "-" as the group name,
+for example to use a group exported by "gomote group export" without
+importing it:
+
+	$ cat debug.json | gomote -group=- run go/src/make.bash
+
+A group read from stdin is never stored, so changes made to it, such as
+by the create command, don't outlive the command.
+
 Groups may be explicitly managed with the "group" subcommand, but there
 are several short-cuts that make this unnecessary in most cases:
 
@@ -113,6 +122,15 @@ As this example demonstrates, groups are useful even if the group
 contains only a single instance: it can dramatically shorten most gomote
 commands.
 
+To be notified when groups change, set the GOMOTE_GROUP_HOOK environment
+variable to a command or to an http or https URL. The hook is run when a
+group is created, modified, or destroyed. A command is passed the action
+("create", "modify", or "destroy") and the group name as arguments, and the
+group's instances, separated by spaces, in GOMOTE_GROUP_INSTANCES. A URL
+is sent a POST request with a JSON body holding the action, group, and
+instances. A failing hook is reported as a warning, and doesn't cause the
+gomote command to fail.
+
 # Tips and tricks
 
   - The create command accepts the -setup flag which also pushes a GOROOT
@@ -154,6 +172,7 @@ import (
 	"os"
 	"sort"
 	"strconv"
+	"time"
 
 	"golang.org/x/build/buildenv"
 	"golang.org/x/build/buildlet"
@@ -233,7 +252,8 @@ var (
 
 func main() {
 	// Set up and parse global flags.
-	groupName := flag.String("group", os.Getenv("GOMOTE_GROUP"), "name of the gomote group to apply commands to (default is $GOMOTE_GROUP)")
+	groupName := flag.String("group", os.Getenv("GOMOTE_GROUP"), "name of the gomote group to apply commands to, or - to read the group from stdin (default is $GOMOTE_GROUP)")
+	autoGC := flag.Bool("auto-gc", false, "delete expired groups before running the command")
 	buildlet.RegisterFlags()
 	registerCommands()
 	flag.Usage = usage
@@ -247,10 +267,19 @@ func main() {
 	}
 	// Set up globals.
 	buildEnv = buildenv.FromFlags()
+	if *autoGC {
+		if err := doGCGroups(false, false); err != nil {
+			logAndExitf("Error deleting expired groups: %v\n", err)
+		}
+	}
 	if *groupName != "" {
 		var err error
-		activeGroup, err = loadGroup(*groupName)
-		if os.Getenv("GOMOTE_GROUP") != *groupName {
+		if *groupName == "-" {
+			activeGroup, err = loadTransientGroup(os.Stdin)
+		} else {
+			activeGroup, err = loadGroupRaw(*groupName)
+		}
+		if *groupName == "-" || os.Getenv("GOMOTE_GROUP") != *groupName {
 			// Only fail hard since it was specified by the flag.
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Failure: %v\n", err)
@@ -266,6 +295,9 @@ func main() {
 			}
 			// Note that an invalid group in GOMOTE_GROUP is OK.
 		}
+		if activeGroup != nil && activeGroup.expired(time.Now()) {
+			fmt.Fprintf(os.Stderr, "# Warning: group %q expired at %s; \"gomote group gc\" deletes expired groups\n", activeGroup.Name, activeGroup.ExpiresAt.Format(time.DateTime))
+		}
 	}
 
 	cmdName := args[0]
@@ -274,11 +306,43 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Unknown command %q\n", cmdName)
 		usage()
 	}
+	if activeGroup != nil && usesGroupInstances(args) {
+		if err := pruneGroup(activeGroup); err != nil {
+			logAndExitf("Error running %s: %v\n", cmdName, err)
+		}
+	}
 	if err := cmd.run(args[1:]); err != nil {
 		logAndExitf("Error running %s: %v\n", cmdName, err)
 	}
 }
 
+// groupInstanceCommands are the commands that act on the instances of the
+// active group. Before running them, main pings the group's instances and
+// prunes those that no longer exist; other commands, like create or group
+// list, use the group as stored, so they don't wait on the pings.
+var groupInstanceCommands = map[string]bool{
+	"destroy":      true,
+	"gettar":       true,
+	"ls":           true,
+	"ping":         true,
+	"push":         true,
+	"put":          true,
+	"putbootstrap": true,
+	"puttar":       true,
+	"rm":           true,
+	"run":          true,
+	"ssh":          true,
+}
+
+// usesGroupInstances reports whether the command given by args, starting
+// with its name, acts on the instances of the active group.
+func usesGroupInstances(args []string) bool {
+	if args[0] == "group" {
+		return len(args) > 1 && args[1] == "run"
+	}
+	return groupInstanceCommands[args[0]]
+}
+
 // gomoteServerClient returns a gomote server client which can be used to interact with the gomote GRPC server.
 // It will either retrieve a previously created authentication token or attempt to create a new one.
 func gomoteServerClient(ctx context.Context) protos.GomoteServiceClient {
@@ -305,6 +369,18 @@ func instanceDoesNotExist(err error) bool {
 	return false
 }
 
+// instanceNotAccessible reports whether err indicates that the instance
+// exists but belongs to another user.
+func instanceNotAccessible(err error) bool {
+	for err != nil {
+		if status.Code(err) == codes.PermissionDenied {
+			return true
+		}
+		err = errors.Unwrap(err)
+	}
+	return false
+}
+
 func luciDisabled() bool {
 	on, _ := strconv.ParseBool(os.Getenv("GOMOTEDISABLELUCI"))
 	return on
@@ -5,25 +5,242 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/build/internal/gomote/protos"
 )
 
+// groupCommand is a subcommand of "gomote group".
+type groupCommand struct {
+	run     func([]string) error
+	desc    string   // one-line description
+	help    string   // detailed usage, printed by "gomote group help <cmd>"
+	aliases []string // alternative names
+}
+
 func group(args []string) error {
-	cm := map[string]struct {
-		run  func([]string) error
-		desc string
-	}{
-		"create":  {createGroup, "create a new group"},
-		"destroy": {destroyGroup, "destroy an existing group (does not destroy gomotes)"},
-		"add":     {addToGroup, "add an existing instance to a group"},
-		"remove":  {removeFromGroup, "remove an existing instance from a group"},
-		"list":    {listGroups, "list existing groups and their details"},
+	cm := map[string]groupCommand{
+		"create": {createGroup, "create a new group", `usage: gomote group create <name>
+
+Creates a new, empty group. Use "gomote group add" or
+"gomote group create-instances" to add instances to it.
+
+Example:
+
+	gomote group create mygroup
+`, nil},
+		"create-instances": {createGroupInstances, "create new instances and add them to the active group", `usage: gomote group create-instances <type> <count>
+
+Creates count instances of the builder type concurrently and adds them
+to the active group. Instances that were created are added even if
+others fail.
+
+Example:
+
+	gomote -group=mygroup group create-instances gotip-linux-amd64 4
+`, nil},
+		"destroy": {destroyGroup, "destroy an existing group (does not destroy gomotes)", `usage: gomote group destroy [-dry-run] <name>
+
+Deletes the group. The instances in it are not destroyed; use
+"gomote destroy" with the group active for that.
+
+Flags:
+
+	-dry-run
+		print the group file that would be deleted, without deleting it
+`, nil},
+		"rename": {renameGroup, "rename an existing group", `usage: gomote group rename <old> <new>
+
+Renames a group, keeping its instances and other details. There must
+not already be a group with the new name.
+
+Example:
+
+	gomote group rename mygroup debug
+`, []string{"mv"}},
+		"copy": {copyGroup, "create a new group with the instances of an existing group", `usage: gomote group copy <src> <dst>
+
+Creates the group dst with the same instances as the group src, which is
+left unchanged. There must not already be a group named dst. Instances
+of src that no longer exist are not copied.
+
+Example:
+
+	gomote group copy mygroup experiment
+`, []string{"cp"}},
+		"merge": {mergeGroups, "create a group with the instances of two groups", `usage: gomote group merge [-delete] [-dry-run] <a> <b> <dest>
+
+Stores the union of the instances of groups a and b in the group dest.
+The dest group must either not exist yet or be a or b. Instances that
+no longer exist are not included.
+
+Flags:
+
+	-delete
+		delete groups a and b, other than dest, after merging them
+	-dry-run
+		print the group that would be stored and the group files that
+		would be deleted, without doing it
+
+Example:
+
+	gomote group merge -delete linux windows all
+`, nil},
+		"add": {addToGroup, "add an existing instance to a group", `usage: gomote group add [-force] <instance> [instances...]
+
+Adds the named instances, which must be alive, to the active group.
+Instances that are already in the group are skipped.
+Unless -force is given, it warns about instances that are already in
+another group, since managing an instance from two groups is confusing.
+
+Example:
+
+	gomote -group=mygroup group add user-linux-amd64-0
+`, []string{"a"}},
+		"remove": {removeFromGroup, "remove an existing instance from a group", `usage: gomote group remove <instance> [instances...]
+
+Removes the named instances from the active group. The instances are
+not destroyed. An instance may also be given by its 1-based position
+among the group's instances sorted by name, which is the order that
+"gomote group list" shows them in: 1 is the first instance listed for
+the group, 2 the second, and so on.
+
+Examples:
+
+	gomote -group=mygroup group rm user-linux-amd64-0
+	gomote -group=mygroup group rm 2 3
+`, []string{"rm"}},
+		"clear": {clearGroup, "remove all instances from a group without destroying it", `usage: gomote group clear [name]
+
+Removes every instance from the named group, or from the active group if
+no name is given, keeping the group itself for reuse. The instances are
+not destroyed.
+
+Example:
+
+	gomote group clear mygroup
+`, nil},
+		"list": {listGroups, "list existing groups and their details", `usage: gomote group list [-sort name|size|created] [-filter substr] [-status]
+
+Lists each group with its instances, marking expired groups, and when
+the group was last used to run a command on all of its instances, which
+are listed in sorted order. Groups are listed as stored, without
+checking whether their instances still exist; use -status to find the
+ones that don't. Instances that no longer exist are removed from a group
+by commands that use or modify it.
+
+Flags:
+
+	-filter substr
+		only list groups with an instance whose name contains substr
+	-status
+		also list the builder type of each instance and when it
+		expires, which requires asking the gomote server
+	-sort order
+		order groups by name, size (largest first), or created
+		(newest first) (default "name")
+
+Example, to find which groups an instance is in:
+
+	gomote group list -filter user-linux-amd64-0
+`, []string{"ls"}},
+		"import": {importGroup, "create a group from a group definition read from stdin", `usage: gomote group import [-name name] < group.json
+
+Creates a group from a group definition, such as one written by "gomote
+group export" or one of the files in another user's gomote groups
+directory. Instances that don't exist or aren't accessible to the
+current user are dropped, with a warning.
+
+Flags:
+
+	-name name
+		store the group as name instead of the name in the definition
+`, nil},
+		"export": {exportGroup, "write a group definition to stdout", `usage: gomote group export [name]
+
+Writes the definition of the named group, in the format read by "gomote
+group import", to stdout. The name is optional if a group is active.
+
+Example, to share a group with another user:
+
+	gomote group export mygroup > mygroup.json
+`, nil},
+		"show": {showGroup, "print a group's details as JSON", `usage: gomote group show <name>
+
+Writes the named group, with its instances, to stdout as JSON. Unlike
+"gomote group export", instances that no longer exist are first pruned
+from the group.
+
+Example:
+
+	gomote group show mygroup | jq -r '.instances[]'
+`, nil},
+		"set-ttl": {setGroupTTL, "set how long until the active group expires", `usage: gomote group set-ttl <duration>
+
+Sets the active group to expire after duration (like 36h). A duration
+of 0 removes the expiry. Expired groups are only deleted by
+"gomote group gc" or the -auto-gc flag.
+
+Example:
+
+	gomote -group=mygroup group set-ttl 72h
+`, nil},
+		"gc": {gcGroups, "delete expired groups", `usage: gomote group gc [-destroy-instances] [-dry-run]
+
+Deletes groups that have expired.
+
+Flags:
+
+	-destroy-instances
+		also destroy the instances in expired groups
+	-dry-run
+		print the group files that would be deleted and the instances
+		that would be destroyed, without doing it
+`, nil},
+		"status": {groupStatus, "summarize the builder types of a group's instances", `usage: gomote group status [name]
+
+Prints the number of instances in the group, a summary of their builder
+types, and when the group was last used. The name is optional if a
+group is active.
+`, nil},
+		"run": {groupRun, "run a command on every instance of the active group", `usage: gomote group run [-dir dir] [-e KEY=value] [-system] <cmd> [args...]
+
+Runs the command on every instance of the active group at once,
+prefixing each line of output with the instance it came from. A failure
+on one instance doesn't stop the command on the others; once it has
+finished everywhere, a summary lists the instances it failed on.
+
+Example:
+
+	gomote -group=mygroup group run go/bin/go version
+`, nil},
+	}
+	aliases := make(map[string]string)
+	for name, c := range cm {
+		for _, a := range c.aliases {
+			aliases[a] = name
+		}
+	}
+	lookup := func(name string) (groupCommand, bool) {
+		if full, ok := aliases[name]; ok {
+			name = full
+		}
+		c, ok := cm[name]
+		return c, ok
 	}
 	if len(args) == 0 {
 		var cmds []string
@@ -34,19 +251,51 @@ func group(args []string) error {
 		fmt.Fprintf(os.Stderr, "Usage of gomote group: gomote [global-flags] group <cmd> [cmd-flags]\n\n")
 		fmt.Fprintf(os.Stderr, "Commands:\n\n")
 		for _, name := range cmds {
-			fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, cm[name].desc)
+			desc := cm[name].desc
+			if a := cm[name].aliases; len(a) > 0 {
+				desc += fmt.Sprintf(" (alias: %s)", strings.Join(a, ", "))
+			}
+			fmt.Fprintf(os.Stderr, "  %-16s %s\n", name, desc)
 		}
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", "help", "print detailed usage of a command")
 		fmt.Fprintln(os.Stderr)
 		os.Exit(1)
 	}
 	subCmd := args[0]
-	sc, ok := cm[subCmd]
+	if subCmd == "help" {
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "group help usage: gomote group help <cmd>")
+			os.Exit(1)
+		}
+		sc, ok := lookup(args[1])
+		if !ok {
+			return fmt.Errorf("unknown sub-command %q", args[1])
+		}
+		fmt.Print(sc.help)
+		return nil
+	}
+	sc, ok := lookup(subCmd)
 	if !ok {
 		return fmt.Errorf("unknown sub-command %q\n", subCmd)
 	}
 	return sc.run(args[1:])
 }
 
+// exitNoActiveGroup is the exit code used when a command that requires an
+// active group is run without one, to distinguish it from a usage error.
+const exitNoActiveGroup = 2
+
+// requireActiveGroup exits with an explanation if there is no active group.
+func requireActiveGroup(subCmd string) {
+	if activeGroup != nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "group %s: no active group.\n", subCmd)
+	fmt.Fprintln(os.Stderr, "Specify a group with -group or by setting GOMOTE_GROUP.")
+	fmt.Fprintln(os.Stderr, "Use \"gomote group list\" to see existing groups.")
+	os.Exit(exitNoActiveGroup)
+}
+
 func createGroup(args []string) error {
 	usage := func() {
 		fmt.Fprintln(os.Stderr, "group create usage: gomote group create <name>")
@@ -60,70 +309,446 @@ func createGroup(args []string) error {
 }
 
 func doCreateGroup(name string) (*groupData, error) {
-	if _, err := loadGroup(name); err == nil {
+	if err := checkGroupName(name); err != nil {
+		return nil, err
+	}
+	if _, err := loadGroupRaw(name); err == nil {
 		return nil, fmt.Errorf("group %q already exists", name)
 	}
-	g := &groupData{Name: name}
-	return g, storeGroup(g)
+	g := &groupData{Name: name, Created: time.Now()}
+	if err := storeGroup(g); err != nil {
+		return nil, err
+	}
+	runGroupHook(groupCreated, g)
+	return g, nil
 }
 
-func destroyGroup(args []string) error {
+func createGroupInstances(args []string) error {
 	usage := func() {
-		fmt.Fprintln(os.Stderr, "group destroy usage: gomote group destroy <name>")
+		fmt.Fprintln(os.Stderr, "group create-instances usage: gomote group create-instances <type> <count>")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Creates count instances of the builder type and adds them to the active group.")
+		fmt.Fprintln(os.Stderr, "Instances that were created are added even if others fail.")
 		os.Exit(1)
 	}
-	if len(args) != 1 {
+	requireActiveGroup("create-instances")
+	if len(args) != 2 {
 		usage()
 	}
-	name := args[0]
-	_, err := loadGroup(name)
+	builderType := args[0]
+	count, err := strconv.Atoi(args[1])
+	if err != nil || count < 1 {
+		return fmt.Errorf("invalid count %q", args[1])
+	}
+	ctx := context.Background()
+	client := gomoteServerClient(ctx)
+	var (
+		mu      sync.Mutex
+		created []string
+		errs    []error
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < count; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			inst, err := doCreate(ctx, client, builderType, i, true)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			fmt.Println(inst)
+			created = append(created, inst)
+		}()
+	}
+	wg.Wait()
+	activeGroup.Instances = append(activeGroup.Instances, created...)
+	if err := storeModifiedGroup(activeGroup); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "# Created %d of %d instances; added them to group %q.\n", len(created), count, activeGroup.Name)
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+func destroyGroup(args []string) error {
+	fs := flag.NewFlagSet("destroy", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "group destroy usage: gomote group destroy [destroy-opts] <name>")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	dryRun := addDryRunFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+	}
+	name := fs.Arg(0)
+	_, err := loadGroupRaw(name)
 	if errors.Is(err, os.ErrNotExist) {
 		return fmt.Errorf("group %q does not exist", name)
 	} else if err != nil {
 		return fmt.Errorf("loading group %q: %w", name, err)
 	}
-	if err := deleteGroup(name); err != nil {
+	if err := doDeleteGroup(name, *dryRun); err != nil {
 		return err
 	}
-	if os.Getenv("GOMOTE_GROUP") == name {
+	if !*dryRun && os.Getenv("GOMOTE_GROUP") == name {
 		fmt.Fprintln(os.Stderr, "You may wish to now clear GOMOTE_GROUP.")
 	}
 	return nil
 }
 
-func addToGroup(args []string) error {
+func renameGroup(args []string) error {
 	usage := func() {
-		fmt.Fprintln(os.Stderr, "group add usage: gomote group add [instances ...]")
+		fmt.Fprintln(os.Stderr, "group rename usage: gomote group rename <old> <new>")
 		os.Exit(1)
 	}
-	if len(args) == 0 {
+	if len(args) != 2 {
 		usage()
 	}
-	if activeGroup == nil {
-		fmt.Fprintln(os.Stderr, "No active group found. Use -group or GOMOTE_GROUP.")
+	oldName, newName := args[0], args[1]
+	if err := doRenameGroup(oldName, newName); err != nil {
+		return err
+	}
+	if os.Getenv("GOMOTE_GROUP") == oldName {
+		fmt.Fprintf(os.Stderr, "You may wish to now set GOMOTE_GROUP=%s.\n", newName)
+	}
+	return nil
+}
+
+// doRenameGroup renames the group oldName to newName, which must not
+// already exist.
+func doRenameGroup(oldName, newName string) error {
+	g, err := loadGroup(oldName)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("group %q does not exist", oldName)
+	} else if err != nil {
+		return err
+	}
+	if oldName == newName {
+		return nil
+	}
+	if err := checkGroupName(newName); err != nil {
+		return err
+	}
+	if _, err := loadGroupRaw(newName); err == nil {
+		return fmt.Errorf("group %q already exists", newName)
+	}
+	g.Name = newName
+	if err := storeGroup(g); err != nil {
+		return err
+	}
+	runGroupHook(groupCreated, g)
+	return deleteGroup(oldName)
+}
+
+func copyGroup(args []string) error {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "group copy usage: gomote group copy <src> <dst>")
+		os.Exit(1)
+	}
+	if len(args) != 2 {
 		usage()
 	}
+	return doCopyGroup(args[0], args[1])
+}
+
+// doCopyGroup creates the group dst with the instances of src.
+func doCopyGroup(src, dst string) error {
+	g, err := loadGroup(src)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("group %q does not exist", src)
+	} else if err != nil {
+		return err
+	}
+	if err := checkGroupName(dst); err != nil {
+		return err
+	}
+	if _, err := loadGroupRaw(dst); err == nil {
+		return fmt.Errorf("group %q already exists", dst)
+	}
+	c := &groupData{Name: dst, Instances: slices.Clone(g.Instances), Created: time.Now()}
+	if err := storeGroup(c); err != nil {
+		return err
+	}
+	runGroupHook(groupCreated, c)
+	return nil
+}
+
+func mergeGroups(args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "group merge usage: gomote group merge [merge-opts] <a> <b> <dest>")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	var deleteSources bool
+	fs.BoolVar(&deleteSources, "delete", false, "delete the merged groups, other than dest")
+	dryRun := addDryRunFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() != 3 {
+		fs.Usage()
+	}
+	return doMergeGroups(fs.Arg(0), fs.Arg(1), fs.Arg(2), deleteSources, *dryRun)
+}
+
+// doMergeGroups stores the union of the instances of the groups a and b in
+// the group dest, which must be new or one of a and b, and if
+// deleteSources is true, deletes a and b unless they are dest. If dryRun
+// is true, it only prints what it would do.
+func doMergeGroups(a, b, dest string, deleteSources, dryRun bool) error {
+	var sources []*groupData
+	for _, name := range []string{a, b} {
+		g, err := loadGroup(name)
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("group %q does not exist", name)
+		} else if err != nil {
+			return err
+		}
+		sources = append(sources, g)
+	}
+	var g *groupData
+	for _, src := range sources {
+		if src.Name == dest {
+			g = src
+		}
+	}
+	if g == nil {
+		if err := checkGroupName(dest); err != nil {
+			return err
+		}
+		if _, err := loadGroupRaw(dest); err == nil {
+			return fmt.Errorf("group %q already exists", dest)
+		}
+		g = &groupData{Name: dest, Created: time.Now()}
+	}
+	g.Instances = mergeInstances(sources[0].Instances, sources[1].Instances)
+	if dryRun {
+		fmt.Fprintf(os.Stderr, "# Would store group %q with %d instance(s)\n", dest, len(g.Instances))
+	} else if err := storeGroup(g); err != nil {
+		return err
+	} else if g.Name == a || g.Name == b {
+		runGroupHook(groupModified, g)
+	} else {
+		runGroupHook(groupCreated, g)
+	}
+	if deleteSources {
+		for _, name := range []string{a, b} {
+			if name == dest || (name == b && b == a) {
+				continue
+			}
+			if err := doDeleteGroup(name, dryRun); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mergeInstances returns the instances in a or b, without duplicates, in
+// sorted order.
+func mergeInstances(a, b []string) []string {
+	var merged []string
+	seen := make(map[string]bool)
+	for _, inst := range append(slices.Clone(a), b...) {
+		if !seen[inst] {
+			seen[inst] = true
+			merged = append(merged, inst)
+		}
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+func addToGroup(args []string) error {
+	fs := flag.NewFlagSet("add", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "group add usage: gomote group add [-force] [instances ...]")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	var force bool
+	fs.BoolVar(&force, "force", false, "don't warn about instances that are already in another group")
+	fs.Parse(args)
+	requireActiveGroup("add")
+	if fs.NArg() == 0 {
+		fs.Usage()
+	}
+	var others []*groupData
+	if !force {
+		// The check only warns, so a group that can't be read doesn't
+		// stop the instances from being added.
+		groups, errs, err := loadReadableGroups()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "# Warning: not checking whether the instances are in other groups: %v\n", err)
+		}
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "# Warning: %v\n", err)
+		}
+		for _, g := range groups {
+			if g.Name != activeGroup.Name {
+				others = append(others, g)
+			}
+		}
+	}
+	toAdd, skipped := instancesToAdd(activeGroup, fs.Args())
 	ctx := context.Background()
-	for _, inst := range args {
+	for _, inst := range toAdd {
 		if err := doPing(ctx, inst); err != nil {
 			return fmt.Errorf("instance %q: %w", inst, err)
 		}
-		activeGroup.Instances = append(activeGroup.Instances, inst)
+		for _, name := range groupsWithInstance(others, inst) {
+			fmt.Fprintf(os.Stderr, "# Warning: instance %q is also in group %q.\n", inst, name)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "# Added %d instance(s) to group %q; skipped %d already in it.\n", len(toAdd), activeGroup.Name, skipped)
+	if len(toAdd) == 0 {
+		return nil
+	}
+	activeGroup.Instances = append(activeGroup.Instances, toAdd...)
+	return storeModifiedGroup(activeGroup)
+}
+
+// instancesToAdd returns the instances of insts that aren't already in g,
+// without duplicates, and the number of instances it left out.
+func instancesToAdd(g *groupData, insts []string) (toAdd []string, skipped int) {
+	for _, inst := range insts {
+		if g.has(inst) || slices.Contains(toAdd, inst) {
+			skipped++
+			continue
+		}
+		toAdd = append(toAdd, inst)
+	}
+	return toAdd, skipped
+}
+
+// groupsWithInstance returns the names of the groups that contain inst.
+func groupsWithInstance(groups []*groupData, inst string) []string {
+	var names []string
+	for _, g := range groups {
+		if g.has(inst) {
+			names = append(names, g.Name)
+		}
+	}
+	return names
+}
+
+func groupRun(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "group run usage: gomote group run [run-opts] <cmd> [args...]")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	var dir string
+	fs.StringVar(&dir, "dir", "", "Directory to run from. Defaults to the directory of the command, or the work directory if -system is true.")
+	var env stringSlice
+	fs.Var(&env, "e", "Environment variable KEY=value. The -e flag may be repeated multiple times to add multiple things to the environment.")
+	var sys bool
+	fs.BoolVar(&sys, "system", false, "run inside the system, and not inside the workdir; this is implicit if cmd starts with '/'")
+	fs.Parse(args)
+	requireActiveGroup("run")
+	if fs.NArg() == 0 {
+		fs.Usage()
+	}
+	if len(activeGroup.Instances) == 0 {
+		return fmt.Errorf("group %q has no instances", activeGroup.Name)
+	}
+	markGroupUsed()
+	cmd, cmdArgs := fs.Arg(0), fs.Args()[1:]
+
+	ctx := context.Background()
+	var outMu sync.Mutex
+	errs := make([]error, len(activeGroup.Instances))
+	var wg sync.WaitGroup
+	for i, inst := range activeGroup.Instances {
+		i, inst := i, inst
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := &prefixWriter{mu: &outMu, w: os.Stdout, prefix: inst + ": "}
+			errs[i] = doRun(ctx, inst, cmd, cmdArgs, runDir(dir), runEnv(env), runSystem(sys), runWriters(w))
+			if err := w.Flush(); err != nil && errs[i] == nil {
+				errs[i] = err
+			}
+		}()
+	}
+	wg.Wait()
+
+	failed := 0
+	for i, err := range errs {
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "# %s: %v\n", activeGroup.Instances[i], err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "# Command %q succeeded on %d of %d instances.\n", cmd, len(errs)-failed, len(errs))
+	if failed > 0 {
+		return fmt.Errorf("command failed on %d instance(s)", failed)
+	}
+	return nil
+}
+
+// prefixWriter writes each line written to it to w, prefixed with prefix.
+// It holds mu, which may be shared by prefixWriters writing to the same w,
+// while writing whole lines, so that lines from different writers aren't
+// interleaved.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte // incomplete last line
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	end := bytes.LastIndexByte(p.buf, '\n')
+	if end < 0 {
+		return len(b), nil
+	}
+	var out []byte
+	for _, line := range bytes.SplitAfter(p.buf[:end+1], []byte("\n")) {
+		if len(line) > 0 {
+			out = append(out, p.prefix...)
+			out = append(out, line...)
+		}
 	}
-	return storeGroup(activeGroup)
+	p.buf = append(p.buf[:0], p.buf[end+1:]...)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush writes any incomplete last line, followed by a newline.
+func (p *prefixWriter) Flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+	_, err := p.Write([]byte("\n"))
+	return err
 }
 
 func removeFromGroup(args []string) error {
 	usage := func() {
-		fmt.Fprintln(os.Stderr, "group add usage: gomote group add [instances ...]")
+		fmt.Fprintln(os.Stderr, "group remove usage: gomote group remove [instances ...]")
 		os.Exit(1)
 	}
+	requireActiveGroup("remove")
 	if len(args) == 0 {
 		usage()
 	}
-	if activeGroup == nil {
-		fmt.Fprintln(os.Stderr, "No active group found. Use -group or GOMOTE_GROUP.")
-		usage()
+	args, err := resolveInstanceRefs(activeGroup, args)
+	if err != nil {
+		return err
 	}
 	newInstances := make([]string, 0, len(activeGroup.Instances))
 	for _, inst := range activeGroup.Instances {
@@ -140,54 +765,531 @@ func removeFromGroup(args []string) error {
 		newInstances = append(newInstances, inst)
 	}
 	activeGroup.Instances = newInstances
-	return storeGroup(activeGroup)
+	return storeModifiedGroup(activeGroup)
 }
 
-func listGroups(args []string) error {
+func clearGroup(args []string) error {
 	usage := func() {
-		fmt.Fprintln(os.Stderr, "group list usage: gomote group list")
+		fmt.Fprintln(os.Stderr, "group clear usage: gomote group clear [name]")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Group name is optional if a group is active.")
 		os.Exit(1)
 	}
-	if len(args) != 0 {
+	var g *groupData
+	switch {
+	case len(args) == 1:
+		var err error
+		g, err = loadGroupRaw(args[0])
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("group %q does not exist", args[0])
+		} else if err != nil {
+			return err
+		}
+	case len(args) == 0:
+		requireActiveGroup("clear")
+		g = activeGroup
+	default:
 		usage()
 	}
-	groups, err := loadAllGroups()
+	n, err := doClearGroup(g)
 	if err != nil {
 		return err
 	}
+	fmt.Fprintf(os.Stderr, "# Removed %d instance(s) from group %q.\n", n, g.Name)
+	return nil
+}
+
+// doClearGroup removes all of the instances from g and stores it,
+// returning the number of instances removed.
+func doClearGroup(g *groupData) (int, error) {
+	n := len(g.Instances)
+	g.Instances = []string{}
+	if err := storeModifiedGroup(g); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func listGroups(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "group list usage: gomote group list [list-opts]")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	var sortBy string
+	fs.StringVar(&sortBy, "sort", "name", "order groups by name, size (largest first), or created (newest first)")
+	var filter string
+	fs.StringVar(&filter, "filter", "", "only list groups with an instance whose name contains this substring")
+	var showStatus bool
+	fs.BoolVar(&showStatus, "status", false, "also list the builder type and expiry of each instance (requires a request to the gomote server)")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+	}
+	less, ok := groupOrders[sortBy]
+	if !ok {
+		return fmt.Errorf("unknown sort order %q", sortBy)
+	}
 	// N.B. Glob ignores I/O errors, so no matches also means the directory
 	// does not exist.
-	emit := func(name, inst string) {
-		fmt.Printf("%s\t%s\t\n", name, inst)
+	groups, err := loadAllGroups()
+	if err != nil {
+		return err
+	}
+	if filter != "" {
+		groups = filterGroups(groups, filter)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return less(groups[i], groups[j])
+	})
+	var byID map[string]*protos.Instance
+	if showStatus {
+		ctx := context.Background()
+		resp, err := gomoteServerClient(ctx).ListInstances(ctx, &protos.ListInstancesRequest{})
+		if err != nil {
+			return fmt.Errorf("unable to list instances: %w", err)
+		}
+		byID = make(map[string]*protos.Instance)
+		for _, inst := range resp.GetInstances() {
+			byID[inst.GetGomoteId()] = inst
+		}
 	}
-	emit("Name", "Instances")
+	writeGroupList(os.Stdout, groups, byID, time.Now(), showStatus)
+	return nil
+}
+
+// writeGroupList writes a table of groups and their instances to w. If
+// showStatus is true, it also lists the builder type and status of each
+// instance, from byID, the instances known to the gomote server by ID.
+func writeGroupList(w io.Writer, groups []*groupData, byID map[string]*protos.Instance, now time.Time, showStatus bool) {
+	// emit writes a row; inst is the instance's ID, if the row is for an
+	// instance, and label is what is shown in the Instances column.
+	emit := func(name, inst, label, lastUsed string) {
+		if showStatus {
+			builderType, status := "", ""
+			switch {
+			case label == "Instances":
+				builderType, status = "Builder type", "Status"
+			case inst != "":
+				builderType, status = instanceStatus(inst, byID, now)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t\n", name, label, builderType, status, lastUsed)
+			return
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t\n", name, label, lastUsed)
+	}
+	emit("Name", "", "Instances", "Last used")
 	for _, g := range groups {
 		sort.Strings(g.Instances)
+		name := g.Name
+		if g.expired(now) {
+			name += " (expired)"
+		}
 		emitted := false
 		for _, inst := range g.Instances {
 			if !emitted {
-				emit(g.Name, inst)
+				emit(name, inst, inst, g.lastUsed())
 			} else {
-				emit("", inst)
+				emit("", inst, inst, "")
 			}
 			emitted = true
 		}
 		if !emitted {
-			emit(g.Name, "(none)")
+			emit(name, "", "(none)", g.lastUsed())
 		}
 	}
 	if len(groups) == 0 {
-		fmt.Println("(none)")
+		fmt.Fprintln(w, "(none)")
+	}
+}
+
+// instanceStatus returns the builder type of the named instance and a
+// description of its status, from byID, the instances known to the gomote
+// server, which only lists the current user's instances.
+func instanceStatus(name string, byID map[string]*protos.Instance, now time.Time) (builderType, status string) {
+	inst, ok := byID[name]
+	if !ok {
+		return "unknown", "not listed by the gomote server"
+	}
+	if inst.GetExpires() == 0 {
+		return inst.GetBuilderType(), "alive"
+	}
+	left := time.Unix(inst.GetExpires(), 0).Sub(now)
+	if left <= 0 {
+		return inst.GetBuilderType(), "expiring"
+	}
+	return inst.GetBuilderType(), fmt.Sprintf("alive, expires in %s", left.Round(time.Minute))
+}
+
+// resolveInstanceRefs returns the instances of g referred to by refs, each
+// of which is either the name of an instance or its 1-based index in g's
+// instances in sorted order, the order "gomote group list" lists them in.
+func resolveInstanceRefs(g *groupData, refs []string) ([]string, error) {
+	sorted := slices.Clone(g.Instances)
+	sort.Strings(sorted)
+	var insts []string
+	for _, ref := range refs {
+		i, err := strconv.Atoi(ref)
+		if err != nil || g.has(ref) {
+			insts = append(insts, ref)
+			continue
+		}
+		if i < 1 || i > len(sorted) {
+			return nil, fmt.Errorf("instance index %d out of range: group %q has %d instance(s)", i, g.Name, len(sorted))
+		}
+		insts = append(insts, sorted[i-1])
+	}
+	return insts, nil
+}
+
+// filterGroups returns the groups with an instance whose name contains substr.
+func filterGroups(groups []*groupData, substr string) []*groupData {
+	var matched []*groupData
+	for _, g := range groups {
+		for _, inst := range g.Instances {
+			if strings.Contains(inst, substr) {
+				matched = append(matched, g)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+func setGroupTTL(args []string) error {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "group set-ttl usage: gomote group set-ttl <duration>")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Sets the active group to expire after duration (like 36h).")
+		fmt.Fprintln(os.Stderr, "A duration of 0 removes the expiry. Expired groups are only")
+		fmt.Fprintln(os.Stderr, "deleted by \"gomote group gc\" or the -auto-gc flag.")
+		os.Exit(1)
+	}
+	requireActiveGroup("set-ttl")
+	if len(args) != 1 {
+		usage()
+	}
+	ttl, err := time.ParseDuration(args[0])
+	if err != nil || ttl < 0 {
+		return fmt.Errorf("invalid duration %q", args[0])
+	}
+	if ttl == 0 {
+		activeGroup.ExpiresAt = time.Time{}
+	} else {
+		activeGroup.ExpiresAt = time.Now().Add(ttl)
+	}
+	return storeModifiedGroup(activeGroup)
+}
+
+func gcGroups(args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "group gc usage: gomote group gc [gc-opts]")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Deletes groups that have expired.")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	var destroyInstances bool
+	fs.BoolVar(&destroyInstances, "destroy-instances", false, "also destroy the instances in expired groups")
+	dryRun := addDryRunFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+	}
+	return doGCGroups(destroyInstances, *dryRun)
+}
+
+// doGCGroups deletes expired groups, and if destroyInstances is true,
+// destroys their instances. If dryRun is true, it only prints what it
+// would do.
+func doGCGroups(destroyInstances, dryRun bool) error {
+	groups, err := loadAllGroups()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	ctx := context.Background()
+	for _, g := range groups {
+		if !g.expired(now) {
+			continue
+		}
+		if destroyInstances && dryRun {
+			for _, inst := range g.Instances {
+				fmt.Fprintf(os.Stderr, "# Would destroy %s\n", inst)
+			}
+		} else if destroyInstances {
+			client := gomoteServerClient(ctx)
+			for _, inst := range g.Instances {
+				fmt.Fprintf(os.Stderr, "# Destroying %s\n", inst)
+				_, err := client.DestroyInstance(ctx, &protos.DestroyInstanceRequest{GomoteId: inst})
+				if err != nil && !instanceDoesNotExist(err) {
+					return fmt.Errorf("unable to destroy instance %q: %w", inst, err)
+				}
+			}
+		}
+		if err := doDeleteGroup(g.Name, dryRun); err != nil {
+			return err
+		}
+		if !dryRun {
+			fmt.Fprintf(os.Stderr, "# Deleted group %q, which expired at %s\n", g.Name, g.ExpiresAt.Format(time.DateTime))
+		}
+	}
+	return nil
+}
+
+func importGroup(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "group import usage: gomote group import [import-opts] < group.json")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Creates a group from a group definition, such as one written by")
+		fmt.Fprintln(os.Stderr, "\"gomote group export\", read from stdin. Instances that don't exist")
+		fmt.Fprintln(os.Stderr, "or aren't accessible to the current user are dropped.")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	var name string
+	fs.StringVar(&name, "name", "", "store the group under this name instead of the one in the definition")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+	}
+	g, err := decodeGroup(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("reading group definition: %w", err)
+	}
+	if name != "" {
+		g.Name = name
+	}
+	if err := checkGroupName(g.Name); err != nil {
+		return err
+	}
+	if _, err := loadGroupRaw(g.Name); err == nil {
+		return fmt.Errorf("group %q already exists", g.Name)
+	}
+	ctx := context.Background()
+	kept := make([]string, 0, len(g.Instances))
+	for _, inst := range g.Instances {
+		err := doPing(ctx, inst)
+		switch {
+		case instanceDoesNotExist(err):
+			fmt.Fprintf(os.Stderr, "# Dropping %s: instance does not exist\n", inst)
+		case instanceNotAccessible(err):
+			fmt.Fprintf(os.Stderr, "# Dropping %s: instance is not accessible to the current user\n", inst)
+		case err != nil:
+			return err
+		default:
+			kept = append(kept, inst)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "# Imported group %q with %d of %d instance(s)\n", g.Name, len(kept), len(g.Instances))
+	g.Instances = kept
+	if g.Created.IsZero() {
+		g.Created = time.Now()
+	}
+	if err := storeGroup(g); err != nil {
+		return err
+	}
+	runGroupHook(groupCreated, g)
+	return nil
+}
+
+func exportGroup(args []string) error {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "group export usage: gomote group export [name]")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Group name is optional if a group is active.")
+		os.Exit(1)
+	}
+	var g *groupData
+	switch {
+	case len(args) == 1:
+		var err error
+		g, err = loadGroupRaw(args[0])
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("group %q does not exist", args[0])
+		} else if err != nil {
+			return err
+		}
+	case len(args) == 0:
+		requireActiveGroup("export")
+		g = activeGroup
+	default:
+		usage()
+	}
+	return encodeGroup(os.Stdout, g)
+}
+
+func showGroup(args []string) error {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "group show usage: gomote group show <name>")
+		os.Exit(1)
+	}
+	if len(args) != 1 {
+		usage()
+	}
+	return doShowGroup(os.Stdout, args[0])
+}
+
+// doShowGroup writes the named group to w as JSON, after pruning
+// instances that no longer exist.
+func doShowGroup(w io.Writer, name string) error {
+	g, err := loadGroup(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("group %q does not exist", name)
+	} else if err != nil {
+		return err
+	}
+	return encodeGroup(w, g)
+}
+
+// encodeGroup writes g to w in the format of the group files, which
+// decodeGroup reads.
+func encodeGroup(w io.Writer, g *groupData) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(g)
+}
+
+func groupStatus(args []string) error {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "group status usage: gomote group status [name]")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Group name is optional if a group is active.")
+		os.Exit(1)
+	}
+	var g *groupData
+	switch {
+	case len(args) == 1:
+		var err error
+		g, err = loadGroupRaw(args[0])
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("group %q does not exist", args[0])
+		} else if err != nil {
+			return err
+		}
+	case len(args) == 0:
+		requireActiveGroup("status")
+		g = activeGroup
+	default:
+		usage()
+	}
+	ctx := context.Background()
+	client := gomoteServerClient(ctx)
+	resp, err := client.ListInstances(ctx, &protos.ListInstancesRequest{})
+	if err != nil {
+		return fmt.Errorf("unable to list instances: %w", err)
+	}
+	fmt.Printf("%s: %d instance(s)\n", g.Name, len(g.Instances))
+	if len(g.Instances) > 0 {
+		fmt.Printf("  %s\n", builderTypeSummary(g.Instances, resp.GetInstances()))
 	}
+	fmt.Printf("  last used: %s\n", g.lastUsed())
 	return nil
 }
 
+// builderTypeSummary returns a compact summary of the builder types of
+// the named instances, like "3× linux-amd64, 2× windows-amd64".
+// Instances missing from insts are counted as "unknown".
+func builderTypeSummary(names []string, insts []*protos.Instance) string {
+	types := make(map[string]string)
+	for _, inst := range insts {
+		types[inst.GetGomoteId()] = inst.GetBuilderType()
+	}
+	counts := make(map[string]int)
+	for _, name := range names {
+		bt, ok := types[name]
+		if !ok || bt == "" {
+			bt = "unknown"
+		}
+		counts[bt]++
+	}
+	keys := make([]string, 0, len(counts))
+	for bt := range counts {
+		keys = append(keys, bt)
+	}
+	// Most common builder types first, then by name for stability.
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	parts := make([]string, 0, len(keys))
+	for _, bt := range keys {
+		parts = append(parts, fmt.Sprintf("%d× %s", counts[bt], bt))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// groupOrders are the orderings that groups may be listed in.
+var groupOrders = map[string]func(a, b *groupData) bool{
+	"name": func(a, b *groupData) bool {
+		return a.Name < b.Name
+	},
+	"size": func(a, b *groupData) bool {
+		if len(a.Instances) != len(b.Instances) {
+			return len(a.Instances) > len(b.Instances)
+		}
+		return a.Name < b.Name
+	},
+	"created": func(a, b *groupData) bool {
+		// Groups without a creation time sort last.
+		if !a.Created.Equal(b.Created) {
+			return a.Created.After(b.Created)
+		}
+		return a.Name < b.Name
+	},
+}
+
 type groupData struct {
 	// User-provided name of the group.
 	Name string `json:"name"`
 
 	// Instances is a list of instances in the group.
 	Instances []string `json:"instances"`
+
+	// Created is when the group was created.
+	// It is the zero time for groups created before it was recorded.
+	Created time.Time `json:"created"`
+
+	// LastUsed is when a command last ran on all of the group's
+	// instances, or the zero time if that has never happened or the
+	// group predates recording it.
+	LastUsed time.Time `json:"lastUsed"`
+
+	// ExpiresAt is when the group expires, or the zero time if it
+	// never expires, as is the case for groups created before expiry
+	// was supported.
+	ExpiresAt time.Time `json:"expiresAt"`
+
+	// transient is whether the group was read from stdin rather than
+	// loaded from a file, in which case it is never stored.
+	transient bool
+}
+
+// lastUsed returns a description of when g was last used.
+func (g *groupData) lastUsed() string {
+	if g.LastUsed.IsZero() {
+		return "never"
+	}
+	return g.LastUsed.Format(time.DateTime)
+}
+
+// markGroupUsed records that a command is running on all of the active
+// group's instances.
+func markGroupUsed() {
+	activeGroup.LastUsed = time.Now()
+	if err := storeGroup(activeGroup); err != nil {
+		fmt.Fprintf(os.Stderr, "# Warning: unable to record use of group %q: %v\n", activeGroup.Name, err)
+	}
+}
+
+// expired reports whether g has expired as of now.
+func (g *groupData) expired(now time.Time) bool {
+	return !g.ExpiresAt.IsZero() && now.After(g.ExpiresAt)
 }
 
 func (g *groupData) has(inst string) bool {
@@ -199,38 +1301,88 @@ func (g *groupData) has(inst string) bool {
 	return false
 }
 
+// loadAllGroups reads all the stored groups, without pruning instances
+// that no longer exist.
 func loadAllGroups() ([]*groupData, error) {
+	groups, errs, err := loadReadableGroups()
+	if err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return groups, nil
+}
+
+// loadReadableGroups is like loadAllGroups, but skips the group files that
+// can't be read, returning an error for each of them.
+func loadReadableGroups() (groups []*groupData, errs []error, err error) {
 	dir, err := groupDir()
 	if err != nil {
-		return nil, fmt.Errorf("acquiring group directory: %w", err)
+		return nil, nil, fmt.Errorf("acquiring group directory: %w", err)
 	}
 	// N.B. Glob ignores I/O errors, so no matches also means the directory
 	// does not exist.
 	matches, _ := filepath.Glob(filepath.Join(dir, "*.json"))
-	var groups []*groupData
 	for _, match := range matches {
-		g, err := loadGroupFromFile(match)
+		g, err := readGroupFile(match)
 		if err != nil {
-			return nil, fmt.Errorf("reading group file for %q: %w", match, err)
+			errs = append(errs, fmt.Errorf("reading group file for %q: %w", match, err))
+			continue
 		}
 		groups = append(groups, g)
 	}
-	return groups, nil
+	return groups, errs, nil
 }
 
+// loadGroup reads the named group for a command that uses or modifies
+// it, pruning instances that no longer exist. If any are pruned, the
+// group is stored again without them.
 func loadGroup(name string) (*groupData, error) {
+	g, err := loadGroupRaw(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := pruneGroup(g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// pruneGroup pings the instances of g and drops those that no longer
+// exist, storing g if any were dropped, unless it is transient.
+// Otherwise, we can get into situations where we sometimes don't have an
+// accurate record.
+func pruneGroup(g *groupData) error {
+	instances, err := liveInstances(context.Background(), g.Instances, doPing)
+	if err != nil {
+		return fmt.Errorf("loading group %q: %w", g.Name, err)
+	}
+	if len(instances) == len(g.Instances) {
+		return nil
+	}
+	g.Instances = instances
+	if g.transient {
+		return nil
+	}
+	return storeGroup(g)
+}
+
+// loadGroupRaw reads the named group as stored, without pinging its
+// instances, for commands that only read it or check that it exists.
+func loadGroupRaw(name string) (*groupData, error) {
 	fname, err := groupFilePath(name)
 	if err != nil {
 		return nil, fmt.Errorf("loading group %q: %w", name, err)
 	}
-	g, err := loadGroupFromFile(fname)
+	g, err := readGroupFile(fname)
 	if err != nil {
 		return nil, fmt.Errorf("loading group %q: %w", name, err)
 	}
 	return g, nil
 }
 
-func loadGroupFromFile(fname string) (*groupData, error) {
+func readGroupFile(fname string) (*groupData, error) {
 	f, err := os.Open(fname)
 	if err != nil {
 		return nil, err
@@ -240,26 +1392,100 @@ func loadGroupFromFile(fname string) (*groupData, error) {
 	if err := json.NewDecoder(f).Decode(g); err != nil {
 		return nil, err
 	}
-	// On every load, ping for liveness and prune.
-	//
-	// Otherwise, we can get into situations where we sometimes
-	// don't have an accurate record.
-	ctx := context.Background()
-	newInstances := make([]string, 0, len(g.Instances))
+	return g, nil
+}
+
+// loadTransientGroup reads a group definition from r, for -group=-. Its
+// instances are pruned by pruneGroup like those of a stored group, but
+// the group is never stored.
+func loadTransientGroup(r io.Reader) (*groupData, error) {
+	g, err := decodeGroup(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading group from stdin: %w", err)
+	}
+	g.transient = true
+	return g, nil
+}
+
+// decodeGroup reads a group definition, in the format of the group files,
+// from r and checks that it is well formed.
+func decodeGroup(r io.Reader) (*groupData, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	g := new(groupData)
+	if err := dec.Decode(g); err != nil {
+		return nil, err
+	}
+	if g.Name == "" {
+		return nil, errors.New("group definition has no name")
+	}
+	seen := make(map[string]bool)
 	for _, inst := range g.Instances {
-		err := doPing(ctx, inst)
+		if inst == "" {
+			return nil, errors.New("group definition has an empty instance name")
+		}
+		if seen[inst] {
+			return nil, fmt.Errorf("group definition lists instance %q more than once", inst)
+		}
+		seen[inst] = true
+	}
+	return g, nil
+}
+
+// livenessAttempts is the number of times an instance must be reported
+// as not existing before it's pruned from a group, and livenessBackoff
+// is the delay before the first retry, which doubles after each retry.
+var (
+	livenessAttempts = 3
+	livenessBackoff  = time.Second
+)
+
+// liveInstances returns the instances that ping doesn't report as not
+// existing. Since a coordinator hiccup can make every instance appear
+// to be gone at once, instances that don't exist are checked again with
+// backoff, and only the ones that are consistently missing are dropped.
+func liveInstances(ctx context.Context, instances []string, ping func(context.Context, string) error) ([]string, error) {
+	missing := make(map[string]bool)
+	check := func(inst string) error {
+		err := ping(ctx, inst)
 		if instanceDoesNotExist(err) {
-			continue
-		} else if err != nil {
+			missing[inst] = true
+			return nil
+		}
+		delete(missing, inst)
+		return err
+	}
+	for _, inst := range instances {
+		if err := check(inst); err != nil {
 			return nil, err
 		}
-		newInstances = append(newInstances, inst)
 	}
-	g.Instances = newInstances
-	return g, storeGroup(g)
+	backoff := livenessBackoff
+	for attempt := 1; attempt < livenessAttempts && len(missing) > 0; attempt++ {
+		time.Sleep(backoff)
+		backoff *= 2
+		for _, inst := range instances {
+			if !missing[inst] {
+				continue
+			}
+			if err := check(inst); err != nil {
+				return nil, err
+			}
+		}
+	}
+	live := make([]string, 0, len(instances))
+	for _, inst := range instances {
+		if !missing[inst] {
+			live = append(live, inst)
+		}
+	}
+	return live, nil
 }
 
 func storeGroup(data *groupData) error {
+	if data.transient {
+		return nil
+	}
 	fname, err := groupFilePath(data.Name)
 	if err != nil {
 		return fmt.Errorf("storing group %q: %w", data.Name, err)
@@ -267,14 +1493,63 @@ func storeGroup(data *groupData) error {
 	if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
 		return fmt.Errorf("storing group %q: %w", data.Name, err)
 	}
-	f, err := os.Create(fname)
-	if err != nil {
+	if err := writeFileAtomic(fname, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(data)
+	}); err != nil {
 		return fmt.Errorf("storing group %q: %w", data.Name, err)
 	}
-	defer f.Close()
-	if err := json.NewEncoder(f).Encode(data); err != nil {
-		return fmt.Errorf("storing group %q: %w", data.Name, err)
+	return nil
+}
+
+// writeFileAtomic replaces the file fname with the contents written by
+// write. The contents are written to a temporary file in the same
+// directory, which is renamed to fname only if writing it succeeds, so
+// fname is never left partially written.
+func writeFileAtomic(fname string, write func(io.Writer) error) (err error) {
+	// N.B. The temporary file's name must not end in .json, or
+	// loadAllGroups would read it as a group.
+	f, err := os.CreateTemp(filepath.Dir(fname), filepath.Base(fname)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		return err
 	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fname)
+}
+
+// addDryRunFlag adds the -dry-run flag shared by the commands that destroy
+// instances or delete groups to fs.
+func addDryRunFlag(fs *flag.FlagSet) *bool {
+	return fs.Bool("dry-run", false, "print the instances that would be destroyed and the group files that would be deleted, without doing it")
+}
+
+// doDeleteGroup deletes the named group or, if dryRun is true, prints
+// the file that would be deleted.
+func doDeleteGroup(name string, dryRun bool) error {
+	if !dryRun {
+		return deleteGroup(name)
+	}
+	fname, err := groupFilePath(name)
+	if err != nil {
+		return fmt.Errorf("deleting group %q: %w", name, err)
+	}
+	fmt.Fprintf(os.Stderr, "# Would delete group %q (%s)\n", name, fname)
 	return nil
 }
 
@@ -286,10 +1561,32 @@ func deleteGroup(name string) error {
 	if err := os.Remove(fname); err != nil {
 		return fmt.Errorf("deleting group %q: %w", name, err)
 	}
+	runGroupHook(groupDestroyed, &groupData{Name: name})
+	return nil
+}
+
+// checkGroupName reports an error if name can't be used for a group.
+// Names are limited to letters, digits, '-', and '_', so that each group
+// is stored in a file of its own within the groups directory.
+func checkGroupName(name string) error {
+	if name == "" {
+		return errors.New("group name must not be empty")
+	}
+	for _, r := range name {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-' || r == '_') {
+			return fmt.Errorf("invalid group name %q: may contain only letters, digits, '-', and '_'", name)
+		}
+	}
 	return nil
 }
 
+// groupFilePath returns the path of the file of the named group. Every
+// group file is found through it, so names from arguments or -group that
+// could refer to files outside the groups directory are rejected here.
 func groupFilePath(name string) (string, error) {
+	if err := checkGroupName(name); err != nil {
+		return "", err
+	}
 	dir, err := groupDir()
 	if err != nil {
 		return "", err
@@ -0,0 +1,691 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/build/internal/gomote/protos"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBuilderTypeSummary(t *testing.T) {
+	insts := []*protos.Instance{
+		{GomoteId: "a", BuilderType: "linux-amd64"},
+		{GomoteId: "b", BuilderType: "windows-amd64"},
+		{GomoteId: "c", BuilderType: "linux-amd64"},
+		{GomoteId: "d", BuilderType: "darwin-arm64"},
+		{GomoteId: "e", BuilderType: "windows-amd64"},
+		{GomoteId: "f", BuilderType: "linux-amd64"},
+	}
+	for _, tc := range []struct {
+		names []string
+		want  string
+	}{
+		{[]string{"a", "b", "c", "e", "f"}, "3× linux-amd64, 2× windows-amd64"},
+		{[]string{"d", "b"}, "1× darwin-arm64, 1× windows-amd64"},
+		{[]string{"a", "gone"}, "1× linux-amd64, 1× unknown"},
+		{nil, ""},
+	} {
+		if got := builderTypeSummary(tc.names, insts); got != tc.want {
+			t.Errorf("builderTypeSummary(%q) = %q, want %q", tc.names, got, tc.want)
+		}
+	}
+}
+
+func TestGroupOrders(t *testing.T) {
+	now := time.Now()
+	groups := []*groupData{
+		{Name: "b", Instances: []string{"1"}, Created: now.Add(-time.Hour)},
+		{Name: "a", Instances: []string{"1", "2"}},
+		{Name: "c", Instances: []string{"1", "2"}, Created: now},
+	}
+	for _, tc := range []struct {
+		order string
+		want  []string
+	}{
+		{"name", []string{"a", "b", "c"}},
+		{"size", []string{"a", "c", "b"}},
+		{"created", []string{"c", "b", "a"}},
+	} {
+		less := groupOrders[tc.order]
+		sorted := slices.Clone(groups)
+		sort.SliceStable(sorted, func(i, j int) bool { return less(sorted[i], sorted[j]) })
+		var got []string
+		for _, g := range sorted {
+			got = append(got, g.Name)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("order %s: got %q, want %q", tc.order, got, tc.want)
+		}
+	}
+}
+
+func TestLiveInstances(t *testing.T) {
+	defer func(n int, d time.Duration) { livenessAttempts, livenessBackoff = n, d }(livenessAttempts, livenessBackoff)
+	livenessAttempts, livenessBackoff = 3, time.Millisecond
+
+	notFound := status.Error(codes.NotFound, "instance not found")
+	pings := make(map[string]int)
+	ping := func(ctx context.Context, inst string) error {
+		pings[inst]++
+		switch inst {
+		case "blip":
+			// Missing only on the first check.
+			if pings[inst] == 1 {
+				return notFound
+			}
+		case "gone":
+			return notFound
+		}
+		return nil
+	}
+	got, err := liveInstances(context.Background(), []string{"alive", "blip", "gone"}, ping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alive", "blip"}; !slices.Equal(got, want) {
+		t.Errorf("liveInstances = %q, want %q", got, want)
+	}
+	if want := map[string]int{"alive": 1, "blip": 2, "gone": 3}; !maps.Equal(pings, want) {
+		t.Errorf("pings = %v, want %v", pings, want)
+	}
+
+	failure := errors.New("coordinator unavailable")
+	if _, err := liveInstances(context.Background(), []string{"a"}, func(context.Context, string) error { return failure }); err != failure {
+		t.Errorf("liveInstances error = %v, want %v", err, failure)
+	}
+}
+
+func TestInstanceNotAccessible(t *testing.T) {
+	denied := fmt.Errorf("unable to ping instance: %w", status.Error(codes.PermissionDenied, "not allowed"))
+	if !instanceNotAccessible(denied) {
+		t.Errorf("instanceNotAccessible(%v) = false, want true", denied)
+	}
+	notFound := fmt.Errorf("unable to ping instance: %w", status.Error(codes.NotFound, "not found"))
+	if instanceNotAccessible(notFound) || instanceNotAccessible(nil) {
+		t.Errorf("instanceNotAccessible reported a missing instance as inaccessible")
+	}
+}
+
+func TestGroupLastUsed(t *testing.T) {
+	// Group files written before LastUsed was recorded lack the field.
+	var g groupData
+	if err := json.Unmarshal([]byte(`{"name":"old","instances":["a"]}`), &g); err != nil {
+		t.Fatal(err)
+	}
+	if got := g.lastUsed(); got != "never" {
+		t.Errorf("lastUsed for old group = %q, want %q", got, "never")
+	}
+	g.LastUsed = time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	if got, want := g.lastUsed(), "2024-03-01 12:30:00"; got != want {
+		t.Errorf("lastUsed = %q, want %q", got, want)
+	}
+}
+
+func TestDecodeGroup(t *testing.T) {
+	g, err := decodeGroup(strings.NewReader(`{"name": "debug", "instances": ["user-linux-amd64-0", "user-linux-amd64-1"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"user-linux-amd64-0", "user-linux-amd64-1"}; g.Name != "debug" || !slices.Equal(g.Instances, want) {
+		t.Errorf("decodeGroup = %+v, want group debug with instances %v", g, want)
+	}
+	for _, bad := range []string{
+		``,
+		`{"instances": ["user-linux-amd64-0"]}`,
+		`{"name": "debug", "instances": [""]}`,
+		`{"name": "debug", "instances": ["user-linux-amd64-0", "user-linux-amd64-0"]}`,
+		`{"name": "debug", "instance": ["user-linux-amd64-0"]}`,
+		`{"name": "debug", "instances": "user-linux-amd64-0"}`,
+	} {
+		if g, err := decodeGroup(strings.NewReader(bad)); err == nil {
+			t.Errorf("decodeGroup(%q) = %+v, want error", bad, g)
+		}
+	}
+}
+
+func TestGCGroupsDryRun(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	expired := &groupData{Name: "expired", ExpiresAt: time.Now().Add(-time.Hour)}
+	live := &groupData{Name: "live", ExpiresAt: time.Now().Add(time.Hour)}
+	for _, g := range []*groupData{expired, live} {
+		if err := storeGroup(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(name string) bool {
+		_, err := loadGroup(name)
+		return err == nil
+	}
+
+	if err := doGCGroups(false, true); err != nil {
+		t.Fatal(err)
+	}
+	if !exists("expired") || !exists("live") {
+		t.Fatal("dry run deleted a group")
+	}
+
+	if err := doGCGroups(false, false); err != nil {
+		t.Fatal(err)
+	}
+	if exists("expired") {
+		t.Error("expired group not deleted")
+	}
+	if !exists("live") {
+		t.Error("live group deleted")
+	}
+}
+
+func TestFilterGroups(t *testing.T) {
+	groups := []*groupData{
+		{Name: "a", Instances: []string{"user-linux-amd64-0", "user-linux-arm64-0"}},
+		{Name: "b", Instances: []string{"user-linux-amd64-1"}},
+		{Name: "c"},
+	}
+	for _, tc := range []struct {
+		substr string
+		want   []string
+	}{
+		{"user-linux-amd64-0", []string{"a"}},
+		{"amd64", []string{"a", "b"}},
+		{"windows", nil},
+	} {
+		var got []string
+		for _, g := range filterGroups(groups, tc.substr) {
+			got = append(got, g.Name)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("filterGroups(%q) = %v, want %v", tc.substr, got, tc.want)
+		}
+	}
+}
+
+func TestResolveInstanceRefs(t *testing.T) {
+	g := &groupData{Name: "debug", Instances: []string{"user-linux-arm64-0", "user-linux-amd64-0", "user-linux-amd64-1"}}
+	got, err := resolveInstanceRefs(g, []string{"2", "user-linux-arm64-0", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"user-linux-amd64-1", "user-linux-arm64-0", "user-linux-amd64-0"}; !slices.Equal(got, want) {
+		t.Errorf("resolveInstanceRefs = %q, want %q", got, want)
+	}
+	for _, bad := range []string{"0", "4", "-1"} {
+		if got, err := resolveInstanceRefs(g, []string{bad}); err == nil {
+			t.Errorf("resolveInstanceRefs(%q) = %q, want error", bad, got)
+		}
+	}
+}
+
+func TestResolveInstanceRefsListOrder(t *testing.T) {
+	// The help for group remove says positions count the instances in
+	// the order that group list shows them in.
+	g := &groupData{Name: "debug", Instances: []string{"user-windows-amd64-0", "user-linux-arm64-0", "user-linux-amd64-0"}}
+	listed := &groupData{Name: g.Name, Instances: slices.Clone(g.Instances)}
+	var buf strings.Builder
+	writeGroupList(&buf, []*groupData{listed}, nil, time.Now(), false)
+	rows := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")[1:]
+	if len(rows) != len(g.Instances) {
+		t.Fatalf("group list output:\n%s\nwant %d instance rows", buf.String(), len(g.Instances))
+	}
+	for i, row := range rows {
+		want := strings.Split(row, "\t")[1]
+		got, err := resolveInstanceRefs(g, []string{strconv.Itoa(i + 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || got[0] != want {
+			t.Errorf("resolveInstanceRefs(%d) = %q, want %q, as listed", i+1, got, want)
+		}
+	}
+}
+
+func TestRenameGroup(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	ttl := time.Now().Add(time.Hour).Round(0)
+	for _, g := range []*groupData{{Name: "old", ExpiresAt: ttl}, {Name: "taken"}} {
+		if err := storeGroup(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := doRenameGroup("missing", "new"); err == nil {
+		t.Error("renaming a missing group succeeded")
+	}
+	if err := doRenameGroup("old", "taken"); err == nil {
+		t.Error("renaming onto an existing group succeeded")
+	}
+	if err := doRenameGroup("old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadGroup("old"); err == nil {
+		t.Error("old group still exists after rename")
+	}
+	g, err := loadGroup("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Name != "new" || !g.ExpiresAt.Equal(ttl) {
+		t.Errorf("renamed group = %+v, want name new and expiry %v", g, ttl)
+	}
+}
+
+func TestClearGroup(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	ttl := time.Now().Add(time.Hour).Round(0)
+	g := &groupData{Name: "mygroup", Instances: []string{"a", "b"}, ExpiresAt: ttl}
+	if err := storeGroup(g); err != nil {
+		t.Fatal(err)
+	}
+	n, err := doClearGroup(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("doClearGroup removed %d instances, want 2", n)
+	}
+	g, err = loadGroupRaw("mygroup")
+	if err != nil {
+		t.Fatalf("cleared group no longer exists: %v", err)
+	}
+	if len(g.Instances) != 0 || !g.ExpiresAt.Equal(ttl) {
+		t.Errorf("cleared group = %+v, want no instances and expiry %v", g, ttl)
+	}
+}
+
+func TestInstanceStatus(t *testing.T) {
+	now := time.Now()
+	byID := map[string]*protos.Instance{
+		"a": {GomoteId: "a", BuilderType: "linux-amd64", Expires: now.Add(90 * time.Minute).Unix()},
+		"b": {GomoteId: "b", BuilderType: "windows-amd64", Expires: now.Add(-time.Minute).Unix()},
+		"c": {GomoteId: "c", BuilderType: "darwin-arm64"},
+	}
+	for _, tc := range []struct {
+		name, builderType, status string
+	}{
+		{"a", "linux-amd64", "alive, expires in 1h30m0s"},
+		{"b", "windows-amd64", "expiring"},
+		{"c", "darwin-arm64", "alive"},
+		{"d", "unknown", "not listed by the gomote server"},
+	} {
+		bt, status := instanceStatus(tc.name, byID, now)
+		if bt != tc.builderType || status != tc.status {
+			t.Errorf("instanceStatus(%q) = %q, %q, want %q, %q", tc.name, bt, status, tc.builderType, tc.status)
+		}
+	}
+}
+
+func TestWriteGroupListStatus(t *testing.T) {
+	now := time.Now()
+	byID := map[string]*protos.Instance{
+		"user-linux-amd64-0": {GomoteId: "user-linux-amd64-0", BuilderType: "linux-amd64"},
+	}
+	groups := []*groupData{{Name: "debug", Instances: []string{"user-windows-amd64-0", "user-linux-amd64-0"}}}
+	var buf strings.Builder
+	writeGroupList(&buf, groups, byID, now, true)
+	for _, want := range []string{
+		"\tuser-linux-amd64-0\tlinux-amd64\talive\t",
+		"\tuser-windows-amd64-0\tunknown\tnot listed by the gomote server\t",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("group list output:\n%s\nwant it to contain %q", buf.String(), want)
+		}
+	}
+}
+
+func TestCopyGroup(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	for _, g := range []*groupData{{Name: "src", ExpiresAt: time.Now().Add(time.Hour)}, {Name: "taken"}} {
+		if err := storeGroup(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := doCopyGroup("missing", "dst"); err == nil {
+		t.Error("copying a missing group succeeded")
+	}
+	if err := doCopyGroup("src", "taken"); err == nil {
+		t.Error("copying onto an existing group succeeded")
+	}
+	if err := doCopyGroup("src", "dst"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"src", "dst"} {
+		if _, err := loadGroup(name); err != nil {
+			t.Errorf("group %s after copy: %v", name, err)
+		}
+	}
+	if g, _ := loadGroup("dst"); g != nil && (!g.ExpiresAt.IsZero() || g.Created.IsZero()) {
+		t.Errorf("copied group = %+v, want a new group without an expiry", g)
+	}
+}
+
+func TestMergeInstances(t *testing.T) {
+	got := mergeInstances([]string{"c", "a", "b"}, []string{"b", "d", "a"})
+	if want := []string{"a", "b", "c", "d"}; !slices.Equal(got, want) {
+		t.Errorf("mergeInstances = %q, want %q", got, want)
+	}
+	if got := mergeInstances(nil, nil); len(got) != 0 {
+		t.Errorf("mergeInstances(nil, nil) = %q, want none", got)
+	}
+}
+
+func TestMergeGroups(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	for _, name := range []string{"a", "b", "taken"} {
+		if err := storeGroup(&groupData{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(name string) bool {
+		_, err := loadGroup(name)
+		return err == nil
+	}
+	if err := doMergeGroups("a", "missing", "dest", false, false); err == nil {
+		t.Error("merging a missing group succeeded")
+	}
+	if err := doMergeGroups("a", "b", "taken", false, false); err == nil {
+		t.Error("merging into an existing group succeeded")
+	}
+	if err := doMergeGroups("a", "b", "dest", true, true); err != nil {
+		t.Fatal(err)
+	}
+	if exists("dest") || !exists("a") || !exists("b") {
+		t.Error("dry run changed groups")
+	}
+	if err := doMergeGroups("a", "b", "a", true, false); err != nil {
+		t.Fatal(err)
+	}
+	if !exists("a") || exists("b") {
+		t.Errorf("after merging b into a with -delete: a exists %v, b exists %v; want true, false", exists("a"), exists("b"))
+	}
+}
+
+func TestLoadGroupRaw(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	want := &groupData{Name: "g", Instances: []string{"user-linux-amd64-0", "user-linux-amd64-1"}}
+	if err := storeGroup(want); err != nil {
+		t.Fatal(err)
+	}
+	fname, err := groupFilePath("g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The instances don't exist, but loadGroupRaw must neither prune them
+	// nor store the group.
+	g, err := loadGroupRaw("g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(g.Instances, want.Instances) {
+		t.Errorf("loadGroupRaw instances = %q, want %q", g.Instances, want.Instances)
+	}
+	groups, err := loadAllGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || !slices.Equal(groups[0].Instances, want.Instances) {
+		t.Errorf("loadAllGroups = %+v, want just %+v", groups, want)
+	}
+	after, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Errorf("loading the group changed its file from %q to %q", before, after)
+	}
+	if _, err := loadGroupRaw("missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("loadGroupRaw(missing) error = %v, want one matching os.ErrNotExist", err)
+	}
+}
+
+func TestStoreGroupAtomic(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	orig := &groupData{Name: "g", Instances: []string{"user-linux-amd64-0"}}
+	if err := storeGroup(orig); err != nil {
+		t.Fatal(err)
+	}
+	fname, err := groupFilePath("g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Times with years after 9999 can't be encoded as JSON, so this fails
+	// partway through encoding the group.
+	bad := &groupData{Name: "g", Instances: []string{"user-linux-amd64-1"}, Created: time.Date(10000, 1, 1, 0, 0, 0, 0, time.UTC)}
+	if err := storeGroup(bad); err == nil {
+		t.Fatal("storing a group that can't be encoded succeeded")
+	}
+	after, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Errorf("failed store changed the group file from %q to %q", before, after)
+	}
+	entries, err := os.ReadDir(filepath.Dir(fname))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("group directory contains %q, want just the group file", names)
+	}
+}
+
+func TestEncodeGroupRoundTrip(t *testing.T) {
+	want := &groupData{
+		Name:      "debug",
+		Instances: []string{"user-linux-amd64-0", "user-windows-amd64-0"},
+		Created:   time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		ExpiresAt: time.Date(2024, 3, 3, 12, 30, 0, 0, time.UTC),
+	}
+	var buf strings.Builder
+	if err := encodeGroup(&buf, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeGroup(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatalf("decoding exported group %q: %v", buf.String(), err)
+	}
+	if got.Name != want.Name || !slices.Equal(got.Instances, want.Instances) || !got.Created.Equal(want.Created) || !got.ExpiresAt.Equal(want.ExpiresAt) {
+		t.Errorf("exported and imported group = %+v, want %+v", got, want)
+	}
+}
+
+func TestShowGroup(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	if err := storeGroup(&groupData{Name: "debug"}); err != nil {
+		t.Fatal(err)
+	}
+	var buf strings.Builder
+	if err := doShowGroup(&buf, "debug"); err != nil {
+		t.Fatal(err)
+	}
+	g, err := decodeGroup(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatalf("decoding shown group %q: %v", buf.String(), err)
+	}
+	if g.Name != "debug" {
+		t.Errorf("shown group name = %q, want %q", g.Name, "debug")
+	}
+	if err := doShowGroup(&buf, "missing"); err == nil {
+		t.Error("showing a missing group succeeded")
+	}
+}
+
+func TestInstancesToAdd(t *testing.T) {
+	g := &groupData{Name: "g", Instances: []string{"user-linux-amd64-0"}}
+	for _, tc := range []struct {
+		insts       []string
+		want        []string
+		wantSkipped int
+	}{
+		{[]string{"user-linux-amd64-1"}, []string{"user-linux-amd64-1"}, 0},
+		{[]string{"user-linux-amd64-0"}, nil, 1},
+		{[]string{"user-linux-amd64-1", "user-linux-amd64-1"}, []string{"user-linux-amd64-1"}, 1},
+		{[]string{"user-linux-amd64-0", "user-linux-amd64-2", "user-linux-amd64-1", "user-linux-amd64-2"}, []string{"user-linux-amd64-2", "user-linux-amd64-1"}, 2},
+	} {
+		got, skipped := instancesToAdd(g, tc.insts)
+		if !slices.Equal(got, tc.want) || skipped != tc.wantSkipped {
+			t.Errorf("instancesToAdd(%q) = %q, %d; want %q, %d", tc.insts, got, skipped, tc.want, tc.wantSkipped)
+		}
+	}
+}
+
+func TestLoadReadableGroups(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	if err := storeGroup(&groupData{Name: "good", Instances: []string{"a"}}); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := groupDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "bad.json"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	groups, errs, err := loadReadableGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || groups[0].Name != "good" || len(errs) != 1 {
+		t.Errorf("loadReadableGroups = %v, %v, want the good group and an error for the bad one", groups, errs)
+	}
+	if _, err := loadAllGroups(); err == nil {
+		t.Error("loadAllGroups with an unreadable group succeeded, want error")
+	}
+}
+
+func TestGroupsWithInstance(t *testing.T) {
+	groups := []*groupData{
+		{Name: "a", Instances: []string{"user-linux-amd64-0", "user-linux-amd64-1"}},
+		{Name: "b", Instances: []string{"user-windows-amd64-0"}},
+		{Name: "c", Instances: []string{"user-linux-amd64-1"}},
+	}
+	for inst, want := range map[string][]string{
+		"user-linux-amd64-0":   {"a"},
+		"user-linux-amd64-1":   {"a", "c"},
+		"user-windows-amd64-0": {"b"},
+		"user-darwin-arm64-0":  nil,
+	} {
+		if got := groupsWithInstance(groups, inst); !slices.Equal(got, want) {
+			t.Errorf("groupsWithInstance(%q) = %q, want %q", inst, got, want)
+		}
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var mu sync.Mutex
+	var out bytes.Buffer
+	a := &prefixWriter{mu: &mu, w: &out, prefix: "a: "}
+	b := &prefixWriter{mu: &mu, w: &out, prefix: "b: "}
+	io.WriteString(a, "one\ntw")
+	io.WriteString(b, "three\n")
+	io.WriteString(a, "o\nfour")
+	io.WriteString(b, "\n\nfive")
+	for _, w := range []*prefixWriter{a, b} {
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := "a: one\nb: three\na: two\nb: \nb: \na: four\nb: five\n"
+	if got := out.String(); got != want {
+		t.Errorf("got output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCheckGroupName(t *testing.T) {
+	for _, name := range []string{"mygroup", "debug-1", "my_group", "A9"} {
+		if err := checkGroupName(name); err != nil {
+			t.Errorf("checkGroupName(%q) = %v, want nil", name, err)
+		}
+	}
+	for _, name := range []string{"", ".", "..", "../evil", "a/b", `a\b`, "my group", "grp.json", "é"} {
+		if err := checkGroupName(name); err == nil {
+			t.Errorf("checkGroupName(%q) = nil, want error", name)
+		}
+	}
+}
+
+func TestCreateGroupInvalidName(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	for _, name := range []string{"", "..", "../evil"} {
+		if _, err := doCreateGroup(name); err == nil {
+			t.Errorf("doCreateGroup(%q) succeeded, want error", name)
+		}
+	}
+	if err := storeGroup(&groupData{Name: "src"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := doCopyGroup("src", "a/b"); err == nil {
+		t.Error(`doCopyGroup("src", "a/b") succeeded, want error`)
+	}
+	if err := doRenameGroup("src", ".."); err == nil {
+		t.Error(`doRenameGroup("src", "..") succeeded, want error`)
+	}
+	// Existing groups are looked up by name too, as by destroy.
+	outside := filepath.Join(os.Getenv("XDG_CONFIG_HOME"), "x.json")
+	if err := os.WriteFile(outside, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"../../x", "../x", ".."} {
+		if _, err := loadGroupRaw(name); err == nil || errors.Is(err, os.ErrNotExist) {
+			t.Errorf("loadGroupRaw(%q) = %v, want invalid name error", name, err)
+		}
+		if err := doDeleteGroup(name, false); err == nil {
+			t.Errorf("doDeleteGroup(%q) succeeded, want error", name)
+		}
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("file outside the groups directory: %v", err)
+	}
+}
+
+func TestUsesGroupInstances(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"run", "go/bin/go", "version"}, true},
+		{[]string{"destroy"}, true},
+		{[]string{"create", "linux-amd64"}, false},
+		{[]string{"list"}, false},
+		{[]string{"group", "run", "go/bin/go", "version"}, true},
+		{[]string{"group", "list"}, false},
+		{[]string{"group", "show", "debug"}, false},
+		{[]string{"group", "export"}, false},
+		{[]string{"group"}, false},
+	} {
+		if got := usesGroupInstances(tc.args); got != tc.want {
+			t.Errorf("usesGroupInstances(%q) = %v, want %v", tc.args, got, tc.want)
+		}
+	}
+}
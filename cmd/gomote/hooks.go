@@ -0,0 +1,89 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Actions reported to the group hook.
+const (
+	groupCreated   = "create"
+	groupModified  = "modify"
+	groupDestroyed = "destroy"
+)
+
+// groupHookTimeout is how long the group hook may take.
+const groupHookTimeout = 30 * time.Second
+
+// groupEvent is the JSON body posted to a group hook URL.
+type groupEvent struct {
+	Action    string   `json:"action"`
+	Group     string   `json:"group"`
+	Instances []string `json:"instances"`
+}
+
+// runGroupHook notifies the hook named by $GOMOTE_GROUP_HOOK, if set, that
+// action was applied to g. If the hook is an http or https URL, a
+// groupEvent is posted to it as JSON. Otherwise it is a command, which is
+// run with the action and group name as arguments, and with the group's
+// instances, separated by spaces, in $GOMOTE_GROUP_INSTANCES.
+// A hook failure is reported but does not fail the command.
+func runGroupHook(action string, g *groupData) {
+	hook := os.Getenv("GOMOTE_GROUP_HOOK")
+	if hook == "" || g.transient {
+		return
+	}
+	if err := doGroupHook(hook, groupEvent{action, g.Name, g.Instances}); err != nil {
+		fmt.Fprintf(os.Stderr, "# Warning: group hook for %s of group %q failed: %v\n", action, g.Name, err)
+	}
+}
+
+func doGroupHook(hook string, ev groupEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), groupHookTimeout)
+	defer cancel()
+	if !strings.HasPrefix(hook, "http://") && !strings.HasPrefix(hook, "https://") {
+		cmd := exec.CommandContext(ctx, hook, ev.Action, ev.Group)
+		cmd.Env = append(os.Environ(), "GOMOTE_GROUP_INSTANCES="+strings.Join(ev.Instances, " "))
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		return cmd.Run()
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", hook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", hook, resp.Status)
+	}
+	return nil
+}
+
+// storeModifiedGroup stores g, which has been modified, and runs the
+// group hook.
+func storeModifiedGroup(g *groupData) error {
+	if err := storeGroup(g); err != nil {
+		return err
+	}
+	runGroupHook(groupModified, g)
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+)
+
+func TestGroupHookCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook is a shell script")
+	}
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	hook := filepath.Join(dir, "hook.sh")
+	script := "#!/bin/sh\necho \"$1 $2 $GOMOTE_GROUP_INSTANCES\" >> " + out + "\n"
+	if err := os.WriteFile(hook, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("GOMOTE_GROUP_HOOK", hook)
+
+	g, err := doCreateGroup("debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Instances = []string{"a", "b"}
+	if err := storeModifiedGroup(g); err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteGroup("debug"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "create debug \nmodify debug a b\ndestroy debug \n"; string(got) != want {
+		t.Errorf("hook output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestGroupHookURL(t *testing.T) {
+	var events []groupEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev groupEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Errorf("decoding event: %v", err)
+		}
+		events = append(events, ev)
+	}))
+	defer srv.Close()
+
+	ev := groupEvent{Action: groupModified, Group: "debug", Instances: []string{"a"}}
+	if err := doGroupHook(srv.URL, ev); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Action != ev.Action || events[0].Group != ev.Group || !slices.Equal(events[0].Instances, ev.Instances) {
+		t.Errorf("hook received %+v, want [%+v]", events, ev)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	if err := doGroupHook(failing.URL, ev); err == nil {
+		t.Error("doGroupHook succeeded with a failing server")
+	}
+}
@@ -60,6 +60,7 @@ func putTar(args []string) error {
 		for _, inst := range activeGroup.Instances {
 			putSet = append(putSet, inst)
 		}
+		markGroupUsed()
 		src = fs.Arg(0)
 	case 2:
 		// Instance and source is specified.
@@ -224,6 +225,7 @@ func putBootstrap(args []string) error {
 		for _, inst := range activeGroup.Instances {
 			putSet = append(putSet, inst)
 		}
+		markGroupUsed()
 	case 1:
 		putSet = []string{fs.Arg(0)}
 	default:
@@ -281,6 +283,7 @@ func put(args []string) error {
 		for _, inst := range activeGroup.Instances {
 			putSet = append(putSet, inst)
 		}
+		markGroupUsed()
 		src = fs.Arg(0)
 		if fs.NArg() == 2 {
 			dst = fs.Arg(1)
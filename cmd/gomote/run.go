@@ -91,13 +91,14 @@ func run(args []string) error {
 	if err := doPing(ctx, fs.Arg(0)); instanceDoesNotExist(err) {
 		// When there's no active group, this is just an error.
 		if activeGroup == nil {
-			return fmt.Errorf("instance %q: %w", fs.Arg(0), err)
+			return fmt.Errorf("instance %q: %w (no active group; use -group or GOMOTE_GROUP to run on a group)", fs.Arg(0), err)
 		}
 		// When there is an active group, this just means that we're going
 		// to use the group instead and assume the rest is a command.
 		for _, inst := range activeGroup.Instances {
 			runSet = append(runSet, inst)
 		}
+		markGroupUsed()
 		cmd = fs.Arg(0)
 		cmdArgs = fs.Args()[1:]
 	} else if err == nil {
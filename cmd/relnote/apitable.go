@@ -0,0 +1,142 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/build/relnote"
+)
+
+// apiTable returns a Markdown section with a table of the API additions
+// to pkgs listed in the API files in apiFS, which is the api/next directory
+// of the Go repo. Files that cannot be parsed and packages without any
+// additions are reported as warnings rather than errors, so that one bad
+// file doesn't prevent the notes from being generated.
+func apiTable(apiFS fs.FS, pkgs []string) (string, error) {
+	files, err := fs.Glob(apiFS, "*.txt")
+	if err != nil {
+		return "", err
+	}
+	want := make(map[string]bool)
+	for _, p := range pkgs {
+		want[p] = true
+	}
+	seen := make(map[relnote.APIFeature]bool)
+	var features []relnote.APIFeature
+	for _, file := range files {
+		feats, err := relnote.ParseAPIFile(apiFS, file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: skipping API file: %v\n", err)
+			continue
+		}
+		for _, f := range feats {
+			if !want[f.Package] {
+				continue
+			}
+			// The same feature may be listed once per build.
+			f.Build = ""
+			if !seen[f] {
+				seen[f] = true
+				features = append(features, f)
+			}
+		}
+	}
+	found := make(map[string]bool)
+	for _, f := range features {
+		found[f.Package] = true
+	}
+	for _, p := range pkgs {
+		if !found[p] {
+			fmt.Fprintf(os.Stderr, "warning: no new API found for package %s\n", p)
+		}
+	}
+	if len(features) == 0 {
+		return "", nil
+	}
+	sort.Slice(features, func(i, j int) bool {
+		fi, fj := features[i], features[j]
+		if fi.Package != fj.Package {
+			return fi.Package < fj.Package
+		}
+		return fi.Feature < fj.Feature
+	})
+
+	var b strings.Builder
+	b.WriteString("## New API {#new-api}\n\n")
+	b.WriteString("| Package | API | Issue |\n")
+	b.WriteString("| --- | --- | --- |\n")
+	for _, f := range features {
+		api := "`" + f.Feature + "`"
+		if anchor := apiAnchor(f.Feature); anchor != "" {
+			api = fmt.Sprintf("[%s](https://pkg.go.dev/%s#%s)", api, f.Package, anchor)
+		}
+		issue := ""
+		if f.Issue != 0 {
+			issue = fmt.Sprintf("[#%d](/issue/%[1]d)", f.Issue)
+		}
+		fmt.Fprintf(&b, "| [%s](https://pkg.go.dev/%[1]s) | %s | %s |\n", f.Package, strings.ReplaceAll(api, "|", `\|`), issue)
+	}
+	return b.String(), nil
+}
+
+// apiAnchor returns the pkg.go.dev anchor for the symbol described by
+// an API file feature, or "" if it can't be determined.
+//
+// Features look like
+//
+//	func Name(...) ...
+//	method (*T) Name(...) ...
+//	type T struct
+//	type T struct, Field int
+//	const Name = ...
+func apiAnchor(feature string) string {
+	kind, rest, ok := strings.Cut(feature, " ")
+	if !ok {
+		return ""
+	}
+	switch kind {
+	case "func", "const", "var":
+		return ident(rest)
+	case "type":
+		name := ident(rest)
+		if _, field, ok := strings.Cut(rest, ", "); ok {
+			// A field or interface method.
+			if f := ident(field); f != "" && name != "" {
+				return name + "." + f
+			}
+		}
+		return name
+	case "method":
+		recv, meth, ok := strings.Cut(rest, ") ")
+		if !ok {
+			return ""
+		}
+		recv = ident(strings.TrimLeft(recv, "(*"))
+		if meth = ident(meth); recv == "" || meth == "" {
+			return ""
+		}
+		return recv + "." + meth
+	}
+	return ""
+}
+
+// ident returns the identifier at the start of s.
+func ident(s string) string {
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return !(r == '_' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9')
+	})
+	if i < 0 {
+		return s
+	}
+	// Type parameters are not part of the name.
+	return s[:i]
+}
@@ -0,0 +1,57 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+
+package main
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestAPIAnchor(t *testing.T) {
+	for _, tc := range []struct {
+		feature, want string
+	}{
+		{"func ServeFileFS(ResponseWriter, *Request, fs.FS, string)", "ServeFileFS"},
+		{"func Collect[$0 interface{}](Seq[$0]) []$0", "Collect"},
+		{"method (*Request) PathValue(string) string", "Request.PathValue"},
+		{"method (Value) Len() int", "Value.Len"},
+		{"type Seq[$0 interface{}] func(func($0) bool)", "Seq"},
+		{"type Request struct, Pattern string", "Request.Pattern"},
+		{"type Handler interface, ServeHTTP(ResponseWriter, *Request)", "Handler.ServeHTTP"},
+		{"const MaxInt = 9223372036854775807", "MaxInt"},
+		{"var ErrSkip error", "ErrSkip"},
+		{"bogus", ""},
+	} {
+		if got := apiAnchor(tc.feature); got != tc.want {
+			t.Errorf("apiAnchor(%q) = %q, want %q", tc.feature, got, tc.want)
+		}
+	}
+}
+
+func TestAPITable(t *testing.T) {
+	apiFS := fstest.MapFS{
+		"1.txt":   {Data: []byte("pkg net/http, func ServeFileFS(ResponseWriter, *Request, fs.FS, string) #51971\n")},
+		"2.txt":   {Data: []byte("pkg os (linux-386), func Foo() #2\npkg os (linux-amd64), func Foo() #2\npkg io, func Bar() #3\n")},
+		"bad.txt": {Data: []byte("not an api line\n")},
+	}
+	got, err := apiTable(apiFS, []string{"os", "net/http", "strings"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "## New API {#new-api}\n\n" +
+		"| Package | API | Issue |\n" +
+		"| --- | --- | --- |\n" +
+		"| [net/http](https://pkg.go.dev/net/http) | [`func ServeFileFS(ResponseWriter, *Request, fs.FS, string)`](https://pkg.go.dev/net/http#ServeFileFS) | [#51971](/issue/51971) |\n" +
+		"| [os](https://pkg.go.dev/os) | [`func Foo()`](https://pkg.go.dev/os#Foo) | [#2](/issue/2) |\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	if got, err := apiTable(apiFS, []string{"strings"}); err != nil || got != "" {
+		t.Errorf("apiTable for package without new API = %q, %v; want empty", got, err)
+	}
+}
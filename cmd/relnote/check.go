@@ -0,0 +1,80 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/build/relnote"
+)
+
+// check writes the problems that would keep the notes from being generated
+// from the fragments in fsys to w, and returns an error if there are any.
+// Unlike validate, it is meant to be run while the fragments are still
+// being written, so the problems reported by relnote.Lint, like TODOs, are
+// only written as warnings. All problems are reported, not just the first.
+func check(w io.Writer, fsys fs.FS) error {
+	var problems []error
+	if _, err := relnote.MergeWithOptions(fsys, relnote.MergeOptions{RequireAll: true}); err != nil {
+		problems = append(problems, splitErrors(err)...)
+	}
+	invalid, err := invalidUTF8Fragments(fsys)
+	if err != nil {
+		return err
+	}
+	problems = append(problems, invalid...)
+	diags, warnings, err := relnote.Diagnose(fsys, relnote.Checks{
+		Directives:        true,
+		Anchors:           true,
+		DuplicateAnchors:  true,
+		Unfinished:        true,
+		UnfinishedMarkers: relnote.DefaultUnfinishedMarkers,
+		Lint:              true,
+	})
+	if err != nil {
+		return err
+	}
+	for _, d := range diags {
+		problems = append(problems, errors.New(d.String()))
+	}
+	for _, p := range problems {
+		fmt.Fprintln(w, p)
+	}
+	for _, d := range warnings {
+		fmt.Fprintf(w, "warning: %s\n", d)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problem(s) in the fragments", len(problems))
+	}
+	return nil
+}
+
+// invalidUTF8Fragments returns an error for each Markdown fragment in fsys
+// that is not valid UTF-8, which the Markdown parser silently accepts.
+func invalidUTF8Fragments(fsys fs.FS) ([]error, error) {
+	var errs []error
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || path.Ext(name) != ".md" || strings.HasPrefix(d.Name(), ".") {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		if !utf8.Valid(data) {
+			errs = append(errs, errors.New(name+": fragment is not valid UTF-8"))
+		}
+		return nil
+	})
+	return errs, err
+}
@@ -0,0 +1,48 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestCheck(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1-intro.md":                          {Data: []byte("# Intro\n\nSee [tools](#tools).\n\n[ref]: /a\n")},
+		"2-dup.md":                            {Data: []byte("Again.\n\n[ref]: /b\n")},
+		"3-bad.md":                            {Data: []byte("Bad \xff byte.\n")},
+		"4-empty.md":                          {Data: []byte("\n")},
+		"6-stdlib/99-minor/net/http/12345.md": {Data: []byte("TODO: write this.\n")},
+	}
+	var buf strings.Builder
+	err := check(&buf, fsys)
+	if err == nil {
+		t.Fatal("got nil, want error")
+	}
+	want := `duplicate link reference "ref"; second in 2-dup.md
+4-empty.md: not merged: fragment has no content
+3-bad.md: fragment is not valid UTF-8
+1-intro.md:3: link to undefined anchor #tools
+warning: 6-stdlib/99-minor/net/http/12345.md:1: unresolved TODO
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got output\n%s\nwant\n%s", got, want)
+	}
+
+	// TODOs are only warnings.
+	fsys = fstest.MapFS{
+		"1-intro.md":                          {Data: []byte("# Intro\n\nSee [tools](#tools).\n")},
+		"2-tools.md":                          {Data: []byte("## Tools {#tools}\n\nText.\n")},
+		"6-stdlib/99-minor/net/http/12345.md": {Data: []byte("TODO: write this.\n")},
+	}
+	buf.Reset()
+	if err := check(&buf, fsys); err != nil {
+		t.Errorf("got %v, want nil; output:\n%s", err, buf.String())
+	}
+}
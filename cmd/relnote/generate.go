@@ -7,10 +7,18 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/build/relnote"
 	"rsc.io/markdown"
@@ -18,31 +26,500 @@ import (
 
 const prefixFormat = `
 ---
-path: /doc/go1.%s
-template: false
-title: Go 1.%[1]s Release Notes
+path: %s
+template: %t
+title: %s
 ---
 
 `
 
+// frontMatter returns the front matter that begins the notes for Go 1.version,
+// with the given path and title, or the usual ones for the release if they
+// are empty.
+func frontMatter(version, urlPath, title string, template bool) string {
+	if urlPath == "" {
+		urlPath = "/doc/go1." + version
+	}
+	if title == "" {
+		title = "Go 1." + version + " Release Notes"
+	}
+	if strings.ContainsAny(title, ":#\"'") {
+		// Quote the title so it is a single YAML string.
+		title = strconv.Quote(title)
+	}
+	return fmt.Sprintf(prefixFormat, urlPath, template, title)
+}
+
+// generateOptions are the settings of generate, from its flags.
+type generateOptions struct {
+	goRoot           string // root of the Go repo, whose doc/next holds the fragments
+	extraDirs        dirList
+	include, exclude globList
+	exts             []string // extensions of fragment files
+	locale           string
+	unfinished       []string // markers of placeholder text
+	checkAnchors     bool
+	strict           bool
+	verbose          bool
+	apiPkgs          []string
+	provenance       bool
+	appendMode       bool
+	out              string // file to write, "-" for standard output, or empty for the default
+	title, urlPath   string
+	template         bool
+}
+
 // generate takes the root of the Go repo.
 // It generates release notes by combining the fragments in the doc/next directory
 // of the repo.
-func generate(version, goRoot string) error {
-	if goRoot == "" {
-		goRoot = runtime.GOROOT()
+func generate(version string, args []string) error {
+	opts, err := parseGenerateFlags(args)
+	if err != nil {
+		return err
 	}
-	dir := filepath.Join(goRoot, "doc", "next")
-	doc, err := relnote.Merge(os.DirFS(dir))
+	dirs := append([]string{filepath.Join(opts.goRoot, "doc", "next")}, opts.extraDirs...)
+	fsys, err := opts.fragments(dirs)
 	if err != nil {
 		return err
 	}
-	out := markdown.ToMarkdown(doc)
-	out = fmt.Sprintf(prefixFormat, version) + out
-	outFile := fmt.Sprintf("go1.%s.md", version)
-	if err := os.WriteFile(outFile, []byte(out), 0644); err != nil {
+	if err := opts.checkFragments(fsys); err != nil {
+		return err
+	}
+	out, err := opts.merge(fsys)
+	if err != nil {
+		return err
+	}
+	if opts.provenance {
+		out = fmt.Sprintf("<!-- generated by relnote from %s at %s -->\n\n", strings.Join(dirs, ", "), time.Now().UTC().Format(time.RFC3339)) + out
+	}
+	return opts.write(version, out)
+}
+
+// parseGenerateFlags parses the flags of generate from args.
+func parseGenerateFlags(args []string) (*generateOptions, error) {
+	opts := new(generateOptions)
+	flags := flag.NewFlagSet("generate", flag.ContinueOnError)
+	flags.Var(&opts.extraDirs, "dir", "also merge the fragments in this directory, as if they were in doc/next (may be repeated)")
+	flags.Var(&opts.include, "include", "only merge fragments matching this glob (may be repeated)")
+	flags.Var(&opts.exclude, "exclude", "skip fragments matching this glob (may be repeated)")
+	flags.BoolVar(&opts.appendMode, "append", false, "replace only the generated region of an existing notes file, keeping everything outside the markers")
+	flags.BoolVar(&opts.provenance, "provenance", false, "add a comment recording when the notes were generated (makes the output differ between runs)")
+	flags.BoolVar(&opts.checkAnchors, "check-anchors", false, "fail if a fragment links to an anchor (#id) that no fragment defines")
+	flags.BoolVar(&opts.strict, "strict", false, "treat all problems found in the fragments, including TODOs, as errors (implies -check-anchors)")
+	flags.StringVar(&opts.out, "o", "", "write the notes to this file, or to standard output if \"-\" (default go1.N.md)")
+	exts := flags.String("ext", ".md", "comma-separated list of the extensions of fragment files; other files are skipped")
+	flags.BoolVar(&opts.verbose, "v", false, "list the fragments merged and the files skipped because they are not fragments")
+	flags.StringVar(&opts.locale, "locale", "", "merge the fragments translated for this locale, from the subdirectory of doc/next named for it, using untranslated fragments where there is no translation")
+	flags.StringVar(&opts.title, "title", "", "title of the notes in their front matter (default \"Go 1.N Release Notes\")")
+	flags.StringVar(&opts.urlPath, "path", "", "URL path of the notes in their front matter (default /doc/go1.N)")
+	flags.BoolVar(&opts.template, "template", false, "mark the notes in their front matter as a template for the website to execute")
+	unfinished := flags.String("unfinished", strings.Join(relnote.DefaultUnfinishedMarkers, ","), "comma-separated list of markers of placeholder text, like TODO(; fragments containing one, or marked \"status: draft\" in their front matter, are errors")
+	apiPkgs := flags.String("api-table", "", "comma-separated list of packages whose new API, from the files in api/next, is listed in a table after the notes")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if opts.appendMode && opts.out == "-" {
+		return nil, errors.New("-append cannot be used with -o -")
+	}
+	opts.exts = strings.Split(*exts, ",")
+	for _, m := range strings.Split(*unfinished, ",") {
+		if m != "" {
+			opts.unfinished = append(opts.unfinished, m)
+		}
+	}
+	if *apiPkgs != "" {
+		opts.apiPkgs = strings.Split(*apiPkgs, ",")
+	}
+	opts.goRoot = flags.Arg(0)
+	if opts.goRoot == "" {
+		opts.goRoot = runtime.GOROOT()
+	}
+	return opts, nil
+}
+
+// fragments returns a file system with the fragments to merge from dirs,
+// those for the locale if one is set and those selected by the -include
+// and -exclude patterns, reporting what it selected to standard error.
+func (o *generateOptions) fragments(dirs []string) (fs.FS, error) {
+	notesFS, err := dirsFS(dirs)
+	if err != nil {
+		return nil, err
+	}
+	lfs := &localeFS{FS: notesFS, locale: o.locale}
+	if o.locale != "" {
+		if err := reportLocale(lfs); err != nil {
+			return nil, err
+		}
+	}
+	if len(o.include) == 0 && len(o.exclude) == 0 {
+		return lfs, nil
+	}
+	ffs := &filterFS{FS: lfs, include: o.include, exclude: o.exclude, exts: o.exts}
+	matched, err := ffs.matches()
+	if err != nil {
+		return nil, err
+	}
+	if len(matched) == 0 {
+		return nil, errors.New("no fragments match the -include and -exclude patterns")
+	}
+	fmt.Fprintf(os.Stderr, "merging %d matching fragment(s):\n", len(matched))
+	for _, m := range matched {
+		fmt.Fprintf(os.Stderr, "\t%s\n", m)
+	}
+	return ffs, nil
+}
+
+// reportLocale checks the locale of lfs and reports to standard error which
+// fragments are translated to it.
+func reportLocale(lfs *localeFS) error {
+	if err := lfs.checkLocale(); err != nil {
+		return err
+	}
+	translated, untranslated, ignored, err := lfs.sources()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d of %d fragment(s) translated to %s\n", len(translated), len(translated)+len(untranslated), lfs.locale)
+	if len(untranslated) > 0 {
+		fmt.Fprintf(os.Stderr, "using untranslated fragment(s):\n")
+		for _, name := range untranslated {
+			fmt.Fprintf(os.Stderr, "\t%s\n", name)
+		}
+	}
+	for _, name := range ignored {
+		fmt.Fprintf(os.Stderr, "warning: ignoring %s: no untranslated fragment %s\n", name, strings.TrimPrefix(name, lfs.locale+"/"))
+	}
+	return nil
+}
+
+// checkFragments reports the problems in the fragments of fsys to standard
+// error, and returns an error if any of them keep the notes from being
+// generated.
+func (o *generateOptions) checkFragments(fsys fs.FS) error {
+	// Unresolved template directives would be copied into the notes
+	// verbatim, duplicate anchors would make links in the notes go to
+	// the wrong place, and unfinished fragments would publish
+	// placeholders, so they are always errors.
+	problems, warnings, err := relnote.Diagnose(fsys, relnote.Checks{
+		Directives:        true,
+		Anchors:           o.checkAnchors || o.strict,
+		DuplicateAnchors:  true,
+		Unfinished:        true,
+		UnfinishedMarkers: o.unfinished,
+		Lint:              true,
+	})
+	if err != nil {
+		return err
+	}
+	if o.strict {
+		problems, warnings = append(problems, warnings...), nil
+	}
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", w)
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, p)
+		}
+		return fmt.Errorf("found %d problem(s) in the fragments", len(problems))
+	}
+	return nil
+}
+
+// merge merges the fragments of fsys into the notes, followed by the API
+// table if one was requested.
+func (o *generateOptions) merge(fsys fs.FS) (string, error) {
+	// A fragment that isn't merged, because it is hidden or empty, is
+	// probably a mistake that would silently drop a note, so fail.
+	var merged []string
+	opts := relnote.MergeOptions{
+		Extensions: o.exts,
+		Merged:     func(name string) { merged = append(merged, name) },
+		RequireAll: true,
+	}
+	if o.verbose {
+		opts.Skipped = func(name string) {
+			fmt.Fprintf(os.Stderr, "skipping %s: not a fragment\n", name)
+		}
+	}
+	out, err := mergeNotes(fsys, opts)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(os.Stderr, "merged %d fragment(s)\n", len(merged))
+	if o.verbose {
+		for _, name := range merged {
+			fmt.Fprintf(os.Stderr, "\t%s\n", name)
+		}
+	}
+	if len(o.apiPkgs) > 0 {
+		table, err := apiTable(os.DirFS(filepath.Join(o.goRoot, "api", "next")), o.apiPkgs)
+		if err != nil {
+			return "", err
+		}
+		if table != "" {
+			out += "\n" + table
+		}
+	}
+	return out, nil
+}
+
+// write writes the notes for Go 1.version, out, with their front matter, to
+// the output file, or with -append, into its generated region.
+func (o *generateOptions) write(version, out string) error {
+	outFile := o.out
+	if outFile == "" {
+		outFile = fmt.Sprintf("go1.%s.md", version)
+		if o.locale != "" {
+			outFile = fmt.Sprintf("go1.%s.%s.md", version, o.locale)
+		}
+	}
+	if o.appendMode {
+		existing, err := os.ReadFile(outFile)
+		if errors.Is(err, fs.ErrNotExist) {
+			out = frontMatter(version, o.urlPath, o.title, o.template) + wrapGenerated(out)
+		} else if err != nil {
+			return err
+		} else if out, err = replaceGenerated(string(existing), out); err != nil {
+			return fmt.Errorf("%s: %v", outFile, err)
+		}
+	} else {
+		out = frontMatter(version, o.urlPath, o.title, o.template) + out
+	}
+	if outFile == "-" {
+		_, err := os.Stdout.WriteString(out)
+		return err
+	}
+	if err := writeFileAtomic(outFile, []byte(out)); err != nil {
 		return err
 	}
 	fmt.Printf("wrote %s\n", outFile)
 	return nil
 }
+
+// dirsFS returns a file system with the files of all of dirs, which must
+// not have any files in common.
+func dirsFS(dirs []string) (fs.FS, error) {
+	if len(dirs) == 1 {
+		return os.DirFS(dirs[0]), nil
+	}
+	var fsyss []fs.FS
+	for _, d := range dirs {
+		fsyss = append(fsyss, os.DirFS(d))
+	}
+	fsys, err := relnote.UnionFS(fsyss...)
+	if err != nil {
+		// Say which directory each source in the error is.
+		var b strings.Builder
+		for i, d := range dirs {
+			fmt.Fprintf(&b, "\n\tsource %d: %s", i+1, d)
+		}
+		return nil, fmt.Errorf("%v%s", err, b.String())
+	}
+	return fsys, nil
+}
+
+// writeFileAtomic writes data to the named file. A regular file is written
+// to a temporary file that is then renamed into place, so that readers never
+// see a partially written file. Other files, like named pipes and devices,
+// are written directly.
+func writeFileAtomic(name string, data []byte) (err error) {
+	if fi, err := os.Stat(name); err == nil && !fi.Mode().IsRegular() {
+		f, err := os.OpenFile(name, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// splitErrors returns the errors joined in err by errors.Join, or err
+// itself if it was not created by errors.Join.
+func splitErrors(err error) []error {
+	if err == nil {
+		return nil
+	}
+	if u, ok := err.(interface{ Unwrap() []error }); ok {
+		return u.Unwrap()
+	}
+	return []error{err}
+}
+
+// mergeNotes merges the fragments in fsys and returns the resulting Markdown.
+// The result depends only on the contents of fsys, so that regenerating
+// the notes from unchanged fragments produces identical output.
+func mergeNotes(fsys fs.FS, opts relnote.MergeOptions) (string, error) {
+	doc, err := relnote.MergeWithOptions(fsys, opts)
+	if err != nil {
+		return "", err
+	}
+	return normalizeWhitespace(markdown.ToMarkdown(doc)), nil
+}
+
+// normalizeWhitespace removes trailing whitespace from the lines of s outside
+// of fenced code blocks, and ensures that s ends in a single newline.
+func normalizeWhitespace(s string) string {
+	var b strings.Builder
+	relnote.ForEachLine(strings.TrimRight(s, " \t\r\n"), func(_ int, line string, inFence bool) {
+		if !inFence {
+			line = strings.TrimRight(line, " \t\r")
+		}
+		b.WriteString(line)
+		b.WriteByte('\n')
+	})
+	return b.String()
+}
+
+// The generated region of a notes file maintained with "generate -append"
+// is delimited by these markers, each on a line of its own. Everything
+// between the markers is replaced when the notes are regenerated, and
+// everything outside them, like manual edits, is preserved. The markers
+// must appear exactly once each and in order; edits made between them
+// are lost.
+const (
+	beginGenerated = "<!-- BEGIN GENERATED NOTES: edits between these markers are overwritten -->"
+	endGenerated   = "<!-- END GENERATED NOTES -->"
+)
+
+// wrapGenerated surrounds generated content with the generated-region markers.
+func wrapGenerated(content string) string {
+	return beginGenerated + "\n\n" + content + "\n" + endGenerated + "\n"
+}
+
+// replaceGenerated replaces the generated region of existing with content.
+func replaceGenerated(existing, content string) (string, error) {
+	before, rest, ok := strings.Cut(existing, beginGenerated+"\n")
+	if !ok {
+		return "", errors.New("missing begin marker for generated notes")
+	}
+	_, after, ok := strings.Cut(rest, endGenerated+"\n")
+	if !ok {
+		return "", errors.New("missing end marker for generated notes")
+	}
+	if strings.Contains(before, endGenerated) || strings.Contains(after, beginGenerated) {
+		return "", errors.New("generated notes markers are out of order or repeated")
+	}
+	return before + wrapGenerated(content) + after, nil
+}
+
+// globList is a flag.Value holding a list of path.Match patterns.
+type globList []string
+
+func (g *globList) String() string { return strings.Join(*g, ",") }
+
+func (g *globList) Set(s string) error {
+	if _, err := path.Match(s, ""); err != nil {
+		return fmt.Errorf("bad pattern %q: %v", s, err)
+	}
+	*g = append(*g, s)
+	return nil
+}
+
+// match reports whether any pattern in g matches name or one of its
+// parent directories.
+func (g globList) match(name string) bool {
+	for p := name; p != "." && p != "/"; p = path.Dir(p) {
+		for _, pat := range g {
+			if ok, _ := path.Match(pat, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dirList is a flag.Value holding a list of directories.
+type dirList []string
+
+func (d *dirList) String() string { return strings.Join(*d, ",") }
+
+func (d *dirList) Set(s string) error {
+	*d = append(*d, s)
+	return nil
+}
+
+// filterFS is a file system that hides the files of the underlying
+// file system that do not match the include patterns (if any), or that
+// match an exclude pattern. Directories are never hidden.
+type filterFS struct {
+	fs.FS
+	include, exclude globList
+	exts             []string // extensions of fragment files, or ".md" if empty
+}
+
+func (f *filterFS) keep(name string) bool {
+	if len(f.include) > 0 && !f.include.match(name) {
+		return false
+	}
+	return !f.exclude.match(name)
+}
+
+func (f *filterFS) Open(name string) (fs.File, error) {
+	file, err := f.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := file.Stat(); err == nil && !fi.IsDir() && !f.keep(name) {
+		file.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return file, nil
+}
+
+func (f *filterFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(f.FS, name)
+	if err != nil {
+		return nil, err
+	}
+	kept := entries[:0]
+	for _, e := range entries {
+		if e.IsDir() || f.keep(path.Join(name, e.Name())) {
+			kept = append(kept, e)
+		}
+	}
+	return kept, nil
+}
+
+// matches returns the fragment files in f, those with one of its
+// extensions, in walk order.
+func (f *filterFS) matches() ([]string, error) {
+	exts := f.exts
+	if len(exts) == 0 {
+		exts = []string{".md"}
+	}
+	var names []string
+	err := fs.WalkDir(f, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && slices.Contains(exts, path.Ext(name)) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names, err
+}
@@ -0,0 +1,275 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"golang.org/x/build/relnote"
+)
+
+func TestFilterFS(t *testing.T) {
+	dir := fstest.MapFS{
+		"1-intro.md":                      {Data: []byte("# Intro\n")},
+		"3-tools.md":                      {Data: []byte("## Tools\n")},
+		"6-stdlib/99-minor/0-heading.md":  {Data: []byte("### Minor\n")},
+		"6-stdlib/99-minor/net/1.md":      {Data: []byte("net.\n")},
+		"6-stdlib/99-minor/net/http/2.md": {Data: []byte("http.\n")},
+		"6-stdlib/99-minor/os/3.md":       {Data: []byte("os.\n")},
+		"7-ports.markdown":                {Data: []byte("## Ports\n")},
+		"README.txt":                      {Data: []byte("Not a fragment.\n")},
+	}
+	for _, tc := range []struct {
+		include, exclude globList
+		exts             []string
+		want             []string
+	}{
+		{
+			include: globList{"6-stdlib/99-minor/net"},
+			want:    []string{"6-stdlib/99-minor/net/1.md", "6-stdlib/99-minor/net/http/2.md"},
+		},
+		{
+			include: globList{"6-stdlib/99-minor/*"},
+			exclude: globList{"*/*/net"},
+			want:    []string{"6-stdlib/99-minor/0-heading.md", "6-stdlib/99-minor/os/3.md"},
+		},
+		{
+			exclude: globList{"6-stdlib"},
+			want:    []string{"1-intro.md", "3-tools.md"},
+		},
+		{
+			exclude: globList{"6-stdlib"},
+			exts:    []string{".md", ".markdown"},
+			want:    []string{"1-intro.md", "3-tools.md", "7-ports.markdown"},
+		},
+		{
+			include: globList{"[7R]*"},
+			exts:    []string{".markdown"},
+			want:    []string{"7-ports.markdown"},
+		},
+	} {
+		ffs := &filterFS{FS: dir, include: tc.include, exclude: tc.exclude, exts: tc.exts}
+		got, err := ffs.matches()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("include %q, exclude %q, exts %q:\ngot  %q\nwant %q", tc.include, tc.exclude, tc.exts, got, tc.want)
+		}
+		for _, name := range tc.want {
+			if _, err := ffs.Open(name); err != nil {
+				t.Errorf("Open(%q): %v", name, err)
+			}
+		}
+	}
+}
+
+func TestReplaceGenerated(t *testing.T) {
+	existing := "# Title\n\nManual intro.\n\n" + wrapGenerated("Old notes.\n") + "\nManual outro.\n"
+	got, err := replaceGenerated(existing, "New notes.\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# Title\n\nManual intro.\n\n" + wrapGenerated("New notes.\n") + "\nManual outro.\n"
+	if got != want {
+		t.Errorf("\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	for _, bad := range []string{
+		"no markers\n",
+		beginGenerated + "\nno end\n",
+		endGenerated + "\n" + beginGenerated + "\n",
+		wrapGenerated("x") + wrapGenerated("y"),
+	} {
+		if _, err := replaceGenerated(bad, "z"); err == nil {
+			t.Errorf("replaceGenerated(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestMergeNotesDeterministic(t *testing.T) {
+	dir := fstest.MapFS{
+		"1-intro.md":                     {Data: []byte("## Introduction  \n\nSome text.   \n\n\n\n")},
+		"3-tools.md":                     {Data: []byte("## Tools {#tools}\n\n\tcode\n")},
+		"6-stdlib/99-minor/0-heading.md": {Data: []byte("### Minor changes to the library\n")},
+		"6-stdlib/99-minor/net/1.md":     {Data: []byte("[Dialer] is faster.\n")},
+		"6-stdlib/99-minor/os/2.md":      {Data: []byte("[File] is better.\n")},
+	}
+	first, err := mergeNotes(dir, relnote.MergeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		again, err := mergeNotes(dir, relnote.MergeOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again != first {
+			t.Fatalf("output differs between runs:\nfirst:\n%s\nagain:\n%s", first, again)
+		}
+	}
+	if strings.Contains(first, " \n") || !strings.HasSuffix(first, "\n") || strings.HasSuffix(first, "\n\n") {
+		t.Errorf("output has unnormalized whitespace:\n%q", first)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "go1.99.md")
+	for _, content := range []string{"first\n", "second\n"} {
+		if err := writeFileAtomic(name, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != content {
+			t.Errorf("got %q, want %q", got, content)
+		}
+	}
+	// No temporary files are left behind.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory has %d entries, want 1", len(entries))
+	}
+
+	if err := writeFileAtomic(filepath.Join(dir, "missing", "x.md"), []byte("x")); err == nil {
+		t.Error("writing to a missing directory succeeded, want error")
+	}
+}
+
+func TestGenerateOutput(t *testing.T) {
+	goRoot := t.TempDir()
+	next := filepath.Join(goRoot, "doc", "next")
+	if err := os.MkdirAll(next, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(next, "1-intro.md"), []byte("## Introduction\n\nSome text.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := "\n---\npath: /doc/go1.99\ntemplate: false\ntitle: Go 1.99 Release Notes\n---\n\n## Introduction\n\nSome text.\n"
+
+	out := filepath.Join(t.TempDir(), "notes.md")
+	if err := generate("99", []string{"-o", out, goRoot}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(out); err != nil {
+		t.Fatal(err)
+	} else if string(got) != want {
+		t.Errorf("-o %s: got\n%q\nwant\n%q", out, got, want)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	err = generate("99", []string{"-o", "-", goRoot})
+	os.Stdout = stdout
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(r); err != nil {
+		t.Fatal(err)
+	} else if string(got) != want {
+		t.Errorf("-o -: got\n%q\nwant\n%q", got, want)
+	}
+
+	if err := generate("99", []string{"-append", "-o", "-", goRoot}); err == nil {
+		t.Error("-append with -o - succeeded, want error")
+	}
+}
+
+func TestGenerateDirs(t *testing.T) {
+	goRoot := t.TempDir()
+	next := filepath.Join(goRoot, "doc", "next")
+	internal := t.TempDir()
+	for name, content := range map[string]string{
+		filepath.Join(next, "1-intro.md"):     "## Introduction\n\nSome text.\n",
+		filepath.Join(next, "5-ports.md"):     "## Ports\n\nPorts text.\n",
+		filepath.Join(internal, "3-tools.md"): "## Tools\n\nTools text.\n",
+	} {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := filepath.Join(t.TempDir(), "notes.md")
+	if err := generate("99", []string{"-dir", internal, "-o", out, goRoot}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "## Introduction\n\nSome text.\n\n## Tools\n\nTools text.\n\n## Ports\n\nPorts text.\n"
+	if !strings.HasSuffix(string(got), want) {
+		t.Errorf("-dir %s: got\n%s\nwant it to end with\n%s", internal, got, want)
+	}
+
+	if err := os.WriteFile(filepath.Join(internal, "1-intro.md"), []byte("## Intro\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = generate("99", []string{"-dir", internal, "-o", out, goRoot})
+	if err == nil || !strings.Contains(err.Error(), "1-intro.md: in both source 1 and source 2") || !strings.Contains(err.Error(), "source 2: "+internal) {
+		t.Errorf("-dir with a fragment also in doc/next: got error %v, want one naming both directories", err)
+	}
+}
+
+func TestGenerateUnfinished(t *testing.T) {
+	goRoot := t.TempDir()
+	next := filepath.Join(goRoot, "doc", "next")
+	if err := os.MkdirAll(next, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(next, "1-intro.md"), []byte("## Introduction\n\nFIXME: write this.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "notes.md")
+	if err := generate("99", []string{"-o", out, goRoot}); err != nil {
+		t.Fatalf("without a FIXME marker: %v", err)
+	}
+	if err := generate("99", []string{"-unfinished", "TODO(,FIXME", "-o", out, goRoot}); err == nil {
+		t.Error("-unfinished FIXME with a FIXME fragment succeeded, want error")
+	}
+	if err := os.WriteFile(filepath.Join(next, "2-language.md"), []byte("---\nstatus: draft\n---\n\n## Language\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := generate("99", []string{"-unfinished", "", "-o", out, goRoot}); err == nil {
+		t.Error("generate with a draft fragment succeeded, want error")
+	}
+}
+
+func TestFrontMatter(t *testing.T) {
+	for _, test := range []struct {
+		path, title string
+		template    bool
+		want        string
+	}{
+		{"", "", false, "\n---\npath: /doc/go1.99\ntemplate: false\ntitle: Go 1.99 Release Notes\n---\n\n"},
+		{"/doc/go1.99rc1", "Go 1.99 RC 1 Release Notes", true, "\n---\npath: /doc/go1.99rc1\ntemplate: true\ntitle: Go 1.99 RC 1 Release Notes\n---\n\n"},
+		{"", "Go 1.99: Draft", false, "\n---\npath: /doc/go1.99\ntemplate: false\ntitle: \"Go 1.99: Draft\"\n---\n\n"},
+	} {
+		if got := frontMatter("99", test.path, test.title, test.template); got != test.want {
+			t.Errorf("frontMatter(%q, %q, %v) = %q, want %q", test.path, test.title, test.template, got, test.want)
+		}
+	}
+}
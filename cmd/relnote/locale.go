@@ -0,0 +1,117 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// localeRegexp matches the names of the subdirectories of doc/next that
+// hold translated fragments, like "ja", "zh-Hans", or "pt-BR".
+var localeRegexp = regexp.MustCompile(`^[a-z]{2,3}(-[A-Z][a-z]{3})?(-[A-Z]{2})?$`)
+
+// localeFS is a file system of release note fragments in which the
+// fragments translated for a locale, which are in the subdirectory of
+// doc/next named for the locale, replace the untranslated fragments at
+// the same paths. Fragments without a translation are used as they are.
+// Locale subdirectories are otherwise hidden, so with an empty locale a
+// localeFS has only the untranslated fragments.
+type localeFS struct {
+	fs.FS         // doc/next
+	locale string // may be empty
+}
+
+// isLocaleDir reports whether name is a locale subdirectory of doc/next.
+func isLocaleDir(name string) bool {
+	return !strings.Contains(name, "/") && localeRegexp.MatchString(name)
+}
+
+// checkLocale reports an error if l's locale has no translations.
+func (l *localeFS) checkLocale() error {
+	if !isLocaleDir(l.locale) {
+		return fmt.Errorf("invalid locale %q: want a language tag like ja or pt-BR", l.locale)
+	}
+	if fi, err := fs.Stat(l.FS, l.locale); err != nil || !fi.IsDir() {
+		return fmt.Errorf("no directory of fragments for locale %s", l.locale)
+	}
+	return nil
+}
+
+// translated reports whether the file name has a translation.
+func (l *localeFS) translated(name string) bool {
+	if l.locale == "" {
+		return false
+	}
+	fi, err := fs.Stat(l.FS, path.Join(l.locale, name))
+	return err == nil && !fi.IsDir()
+}
+
+func (l *localeFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if top, _, _ := strings.Cut(name, "/"); isLocaleDir(top) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if l.translated(name) {
+		return l.FS.Open(path.Join(l.locale, name))
+	}
+	return l.FS.Open(name)
+}
+
+func (l *localeFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if top, _, _ := strings.Cut(name, "/"); isLocaleDir(top) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	entries, err := fs.ReadDir(l.FS, name)
+	if err != nil {
+		return nil, err
+	}
+	kept := entries[:0]
+	for _, e := range entries {
+		if !e.IsDir() || !isLocaleDir(path.Join(name, e.Name())) {
+			kept = append(kept, e)
+		}
+	}
+	return kept, nil
+}
+
+// sources returns the Markdown files in l that are translated and those
+// that are not, and the translations that are ignored because there is
+// no untranslated file at the same path.
+func (l *localeFS) sources() (translated, untranslated, ignored []string, err error) {
+	err = fs.WalkDir(l, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(name, ".md") {
+			return err
+		}
+		if l.translated(name) {
+			translated = append(translated, name)
+		} else {
+			untranslated = append(untranslated, name)
+		}
+		return nil
+	})
+	if err != nil || l.locale == "" {
+		return translated, untranslated, nil, err
+	}
+	err = fs.WalkDir(l.FS, l.locale, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel := strings.TrimPrefix(name, l.locale+"/")
+		if _, err := fs.Stat(l.FS, rel); errors.Is(err, fs.ErrNotExist) {
+			ignored = append(ignored, name)
+		}
+		return nil
+	})
+	return translated, untranslated, ignored, err
+}
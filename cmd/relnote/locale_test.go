@@ -0,0 +1,88 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+
+package main
+
+import (
+	"io/fs"
+	"maps"
+	"slices"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLocaleFS(t *testing.T) {
+	base := fstest.MapFS{
+		"1-intro.md":                 {Data: []byte("# Intro\n")},
+		"2-language.md":              {Data: []byte("## Language\n")},
+		"6-stdlib/0-heading.md":      {Data: []byte("## Standard library\n")},
+		"ja/1-intro.md":              {Data: []byte("# はじめに\n")},
+		"ja/6-stdlib/0-heading.md":   {Data: []byte("## 標準ライブラリ\n")},
+		"ja/9-removed.md":            {Data: []byte("## 削除\n")},
+		"pt-BR/2-language.md":        {Data: []byte("## Linguagem\n")},
+		"6-stdlib/99-minor/ja/1.md":  {Data: []byte("Not a locale.\n")},
+		"6-stdlib/99-minor/net/2.md": {Data: []byte("Package net.\n")},
+	}
+
+	readAll := func(fsys fs.FS) map[string]string {
+		files := make(map[string]string)
+		err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			data, err := fs.ReadFile(fsys, name)
+			files[name] = string(data)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return files
+	}
+
+	// Without a locale, translations are hidden.
+	got := readAll(&localeFS{FS: base})
+	want := map[string]string{
+		"1-intro.md":                 "# Intro\n",
+		"2-language.md":              "## Language\n",
+		"6-stdlib/0-heading.md":      "## Standard library\n",
+		"6-stdlib/99-minor/ja/1.md":  "Not a locale.\n",
+		"6-stdlib/99-minor/net/2.md": "Package net.\n",
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("no locale: got %v, want %v", got, want)
+	}
+
+	lfs := &localeFS{FS: base, locale: "ja"}
+	if err := lfs.checkLocale(); err != nil {
+		t.Fatal(err)
+	}
+	got = readAll(lfs)
+	want["1-intro.md"] = "# はじめに\n"
+	want["6-stdlib/0-heading.md"] = "## 標準ライブラリ\n"
+	if !maps.Equal(got, want) {
+		t.Errorf("ja: got %v, want %v", got, want)
+	}
+	translated, untranslated, ignored, err := lfs.sources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1-intro.md", "6-stdlib/0-heading.md"}; !slices.Equal(translated, want) {
+		t.Errorf("translated = %v, want %v", translated, want)
+	}
+	if want := []string{"2-language.md", "6-stdlib/99-minor/ja/1.md", "6-stdlib/99-minor/net/2.md"}; !slices.Equal(untranslated, want) {
+		t.Errorf("untranslated = %v, want %v", untranslated, want)
+	}
+	if want := []string{"ja/9-removed.md"}; !slices.Equal(ignored, want) {
+		t.Errorf("ignored = %v, want %v", ignored, want)
+	}
+
+	for _, bad := range []string{"fr", "JA", "6-stdlib", "../ja"} {
+		if err := (&localeFS{FS: base, locale: bad}).checkLocale(); err == nil {
+			t.Errorf("checkLocale(%q) = nil, want error", bad)
+		}
+	}
+}
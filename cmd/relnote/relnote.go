@@ -97,8 +97,30 @@ func usage() {
 	fmt.Fprintf(out, "   relnote\n")
 	fmt.Fprintf(out, "      summarize the Go changes in Gerrit marked with\n")
 	fmt.Fprintf(out, "      RELNOTE annotations for the release notes (obsolete)\n")
-	fmt.Fprintf(out, "   relnote generate [GOROOT]\n")
+	fmt.Fprintf(out, "   relnote generate [-dir dir] [-include glob] [-exclude glob] [-check-anchors] [-strict] [-unfinished markers] [-ext exts] [-v] [-locale locale] [-append] [-api-table pkgs] [-title title] [-path path] [-template] [-o file] [GOROOT]\n")
 	fmt.Fprintf(out, "      generate release notes from doc/next under GOROOT (default: runtime.GOROOT())\n")
+	fmt.Fprintf(out, "      -dir also merges the fragments in dir, as if they were in doc/next; it may be repeated, and no two\n")
+	fmt.Fprintf(out, "      directories may have a file in common\n")
+	fmt.Fprintf(out, "      -include and -exclude select fragments by path relative to doc/next\n")
+	fmt.Fprintf(out, "      -strict reports every problem in the fragments and fails if there are any\n")
+	fmt.Fprintf(out, "      -ext sets the fragment file extensions (default .md); -v lists the fragments merged and other files, which are skipped\n")
+	fmt.Fprintf(out, "      hidden or empty fragments are an error, since they would be silently left out of the notes\n")
+	fmt.Fprintf(out, "      unfinished fragments, containing a marker like TODO( (set with -unfinished) or marked \"status: draft\"\n")
+	fmt.Fprintf(out, "      in their front matter, are an error, since they would publish placeholder text\n")
+	fmt.Fprintf(out, "      -locale merges the translations in doc/next/<locale>, falling back to untranslated fragments, into go1.N.<locale>.md\n")
+	fmt.Fprintf(out, "      -append replaces only the region between the generated-notes markers\n")
+	fmt.Fprintf(out, "      -o writes to file (atomically) or, if \"-\", to standard output\n")
+	fmt.Fprintf(out, "      -title, -path, and -template override the front matter, for example for a release candidate\n")
+	fmt.Fprintf(out, "      -api-table lists the new API of the comma-separated packages from api/next\n")
+	fmt.Fprintf(out, "   relnote check [dir]\n")
+	fmt.Fprintf(out, "      report every problem that would keep the notes from being generated from the fragments in dir\n")
+	fmt.Fprintf(out, "      (default: doc/next under runtime.GOROOT()), without writing them; other problems, like TODOs, are\n")
+	fmt.Fprintf(out, "      warnings; exits with status 1 if there are any problems\n")
+	fmt.Fprintf(out, "   relnote validate\n")
+	fmt.Fprintf(out, "      report every problem that keeps the notes in doc/next from being ready for release;\n")
+	fmt.Fprintf(out, "      exits with status 1 if there are any\n")
+	fmt.Fprintf(out, "   relnote serve [-http addr] [-poll interval] [GOROOT]\n")
+	fmt.Fprintf(out, "      serve a preview of the notes merged from doc/next, regenerated and reloaded as fragments change\n")
 	fmt.Fprintf(out, "   relnote todo\n")
 	fmt.Fprintf(out, "      report which release notes need to be written\n")
 	flag.PrintDefaults()
@@ -130,7 +152,18 @@ func main() {
 	if cmd := flag.Arg(0); cmd != "" {
 		switch cmd {
 		case "generate":
-			err = generate(version, flag.Arg(1))
+			err = generate(version, flag.Args()[1:])
+		case "check":
+			dir := flag.Arg(1)
+			if dir == "" {
+				dir = filepath.Join(goroot, "doc", "next")
+			}
+			err = check(os.Stdout, os.DirFS(dir))
+		case "validate":
+			nextDir := filepath.Join(goroot, "doc", "next")
+			err = validate(os.Stdout, os.DirFS(nextDir))
+		case "serve":
+			err = serve(flag.Args()[1:])
 		case "todo":
 			nextDir := filepath.Join(goroot, "doc", "next")
 			err = todo(os.Stdout, os.DirFS(nextDir))
@@ -0,0 +1,180 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/build/relnote"
+	"rsc.io/markdown"
+)
+
+// serve serves a preview of the release notes merged from the fragments in
+// doc/next, which is regenerated whenever the fragments change. Pages
+// viewing the preview reload themselves when it is regenerated.
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := flags.String("http", "localhost:6060", "address to serve the preview on")
+	poll := flags.Duration("poll", time.Second, "how often to check the fragments for changes")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *poll <= 0 {
+		return fmt.Errorf("-poll must be positive")
+	}
+	goRoot := flags.Arg(0)
+	if goRoot == "" {
+		goRoot = runtime.GOROOT()
+	}
+	dir := filepath.Join(goRoot, "doc", "next")
+	s := &previewServer{fsys: os.DirFS(dir)}
+	if err := s.refresh(); err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(*poll) {
+			if err := s.refresh(); err != nil {
+				log.Print(err)
+			}
+		}
+	}()
+	fmt.Printf("serving a preview of the notes in %s at http://%s/\n", dir, *addr)
+	return http.ListenAndServe(*addr, s)
+}
+
+// previewServer serves the release notes merged from the fragments in fsys
+// as HTML at /, and at /version a number that changes whenever the notes
+// are regenerated, which the page polls to know when to reload.
+type previewServer struct {
+	fsys fs.FS
+
+	mu       sync.Mutex
+	state    string        // fingerprint of the fragments the notes were generated from
+	version  int           // incremented when the notes are regenerated
+	notes    template.HTML // the merged notes, or empty if merging failed
+	problems []string      // why merging failed, or anchor problems
+}
+
+// refresh regenerates the notes if the fragments have changed since they
+// were last generated. Problems with the fragments are shown in the
+// preview rather than returned; the error is non-nil only if the
+// fragments can't be read.
+func (s *previewServer) refresh() error {
+	state, err := fragmentState(s.fsys)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	unchanged := state == s.state
+	s.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+	var notes template.HTML
+	var problems []string
+	if doc, err := relnote.Merge(s.fsys); err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		notes = template.HTML(markdown.ToHTML(doc))
+		diags, _, err := relnote.Diagnose(s.fsys, relnote.Checks{Anchors: true, DuplicateAnchors: true})
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		for _, d := range diags {
+			problems = append(problems, d.String())
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state, s.notes, s.problems = state, notes, problems
+	s.version++
+	return nil
+}
+
+// fragmentState returns a string that changes whenever a file in fsys is
+// added, removed, or modified.
+func fragmentState(fsys fs.FS) (string, error) {
+	var b strings.Builder
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "%s %d %d\n", name, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	return b.String(), err
+}
+
+func (s *previewServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	version, notes, problems := s.version, s.notes, s.problems
+	s.mu.Unlock()
+	switch r.URL.Path {
+	case "/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		previewTemplate.Execute(w, struct {
+			Version  int
+			Notes    template.HTML
+			Problems []string
+		}{version, notes, problems})
+	case "/version":
+		w.Header().Set("Cache-Control", "no-store")
+		fmt.Fprintln(w, version)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Release notes preview</title>
+<style>
+body { max-width: 50em; margin: auto; font-family: sans-serif; }
+.problems { border: 1px solid #c00; padding: 0 1em; color: #c00; }
+</style>
+</head>
+<body>
+{{with .Problems}}
+<div class="problems">
+<p>Problems in the fragments:</p>
+<ul>{{range .}}<li>{{.}}</li>{{end}}</ul>
+</div>
+{{end}}
+{{.Notes}}
+<script>
+// Reload when the notes are regenerated.
+setInterval(async () => {
+	try {
+		const resp = await fetch("/version");
+		if ((await resp.text()).trim() !== "{{.Version}}") {
+			location.reload();
+		}
+	} catch (e) {
+		// The server is probably restarting.
+	}
+}, 1000);
+</script>
+</body>
+</html>
+`))
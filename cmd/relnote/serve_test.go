@@ -0,0 +1,63 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestPreviewServer(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1-intro.md": {Data: []byte("## Introduction {#intro}\n\nSee [tools](#tools).\n"), ModTime: time.Unix(1, 0)},
+	}
+	s := &previewServer{fsys: fsys}
+	get := func(path string) string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		body, _ := io.ReadAll(rec.Body)
+		return string(body)
+	}
+
+	if err := s.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	page := get("/")
+	for _, want := range []string{`<h2 id="intro">Introduction</h2>`, "link to undefined anchor #tools"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page does not contain %q:\n%s", want, page)
+		}
+	}
+	if v := get("/version"); v != "1\n" {
+		t.Errorf("version = %q, want 1", v)
+	}
+
+	// Unchanged fragments aren't merged again.
+	if err := s.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if v := get("/version"); v != "1\n" {
+		t.Errorf("version after refresh without changes = %q, want 1", v)
+	}
+
+	fsys["2-tools.md"] = &fstest.MapFile{Data: []byte("## Tools {#tools}\n\nNew tools.\n"), ModTime: time.Unix(2, 0)}
+	if err := s.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if v := get("/version"); v != "2\n" {
+		t.Errorf("version after adding a fragment = %q, want 2", v)
+	}
+	page = get("/")
+	if !strings.Contains(page, `<h2 id="tools">Tools</h2>`) || strings.Contains(page, "undefined anchor") {
+		t.Errorf("page not regenerated after adding a fragment:\n%s", page)
+	}
+}
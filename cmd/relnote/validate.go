@@ -0,0 +1,32 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+
+	"golang.org/x/build/relnote"
+)
+
+// validate writes the problems that keep the fragments in fsys from being
+// ready for release to w, and returns an error if there are any.
+func validate(w io.Writer, fsys fs.FS) error {
+	ready, diags, err := relnote.Validate(fsys)
+	if err != nil {
+		return err
+	}
+	for _, d := range diags {
+		fmt.Fprintln(w, d)
+	}
+	if !ready {
+		return fmt.Errorf("release notes are not ready: found %d problem(s)", len(diags))
+	}
+	fmt.Fprintln(w, "release notes are ready")
+	return nil
+}
@@ -0,0 +1,34 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestValidate(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1-intro.md":                          {Data: []byte("# Intro\n\nSee [tools](#tools).\n")},
+		"3-stdlib/99-minor/net/http/12345.md": {Data: []byte("The [Request] type has a new field.\n")},
+	}
+	var buf strings.Builder
+	err := validate(&buf, fsys)
+	if err == nil {
+		t.Fatal("got nil, want error")
+	}
+	if want := "1-intro.md:3: link to undefined anchor #tools\n"; buf.String() != want {
+		t.Errorf("got output %q, want %q", buf.String(), want)
+	}
+
+	fsys["2-tools.md"] = &fstest.MapFile{Data: []byte("## Tools {#tools}\n")}
+	buf.Reset()
+	if err := validate(&buf, fsys); err != nil {
+		t.Errorf("got %v, want nil; output:\n%s", err, buf.String())
+	}
+}
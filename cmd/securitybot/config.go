@@ -0,0 +1,334 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/build/dashboard"
+)
+
+// builderPolicy controls how tests are run on a single builder.
+type builderPolicy struct {
+	// retries is the number of times to rerun the tests on a fresh
+	// buildlet after they fail.
+	retries int
+	// timeout, if non-zero, is the maximum duration of one attempt.
+	timeout time.Duration
+	// skipBootstrap is whether to skip uploading the bootstrap toolchain,
+	// for builders whose images already include one.
+	skipBootstrap bool
+}
+
+// builderConfigFile is the format of the -builder-config file, a JSON object
+// with per-builder overrides keyed by builder type, and named profiles of
+// builders that can be selected with -profile, for example:
+//
+//	{
+//		"builders": {
+//			"linux-arm-aws": {"retries": 2, "timeout": "3h"},
+//			"linux-amd64-longtest-race": {"timeout": "4h", "skipBootstrap": true}
+//		},
+//		"profiles": {
+//			"windows-only": ["windows-386-2012", "windows-amd64-2016"]
+//		}
+//	}
+//
+// Builder fields that are omitted fall back to the -retries,
+// -builder-timeout, and -skip-bootstrap flags.
+type builderConfigFile struct {
+	Builders map[string]struct {
+		Retries       *int   `json:"retries"`
+		Timeout       string `json:"timeout"`
+		SkipBootstrap *bool  `json:"skipBootstrap"`
+	} `json:"builders"`
+	Profiles map[string][]string `json:"profiles"`
+}
+
+// builderConfig is a parsed builder config file.
+type builderConfig struct {
+	policies map[string]builderPolicy // per-builder overrides of the default policy
+	profiles map[string][]string      // named sets of builders
+}
+
+// defaultProfile is the name of the built-in profile used when neither
+// -profile nor -builders is set.
+const defaultProfile = "firstclass"
+
+// builtinProfiles are the profiles that are always available.
+var builtinProfiles = map[string][]string{
+	defaultProfile: firstClassBuilders,
+}
+
+// profileNameRegexp matches valid profile names.
+var profileNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// parseBuilderConfig reads a builder config file from r. The policies of the
+// builders it mentions have omitted fields taken from defaults, and its
+// profiles are added to the built-in ones.
+func parseBuilderConfig(r io.Reader, defaults builderPolicy) (*builderConfig, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var cfg builderConfigFile
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, err
+	}
+	builders := make([]string, 0, len(cfg.Builders))
+	for bt := range cfg.Builders {
+		builders = append(builders, bt)
+	}
+	sort.Strings(builders)
+	policies := make(map[string]builderPolicy)
+	for _, bt := range builders {
+		if _, ok := dashboard.Builders[bt]; !ok {
+			return nil, fmt.Errorf("%s: unknown builder type", bt)
+		}
+		c, p := cfg.Builders[bt], defaults
+		if c.Retries != nil {
+			if *c.Retries < 0 {
+				return nil, fmt.Errorf("%s: retries must not be negative", bt)
+			}
+			p.retries = *c.Retries
+		}
+		if c.Timeout != "" {
+			d, err := time.ParseDuration(c.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid timeout: %v", bt, err)
+			}
+			if d <= 0 {
+				return nil, fmt.Errorf("%s: timeout must be positive", bt)
+			}
+			p.timeout = d
+		}
+		if c.SkipBootstrap != nil {
+			p.skipBootstrap = *c.SkipBootstrap
+		}
+		policies[bt] = p
+	}
+	profiles := maps.Clone(builtinProfiles)
+	for name, members := range cfg.Profiles {
+		if !profileNameRegexp.MatchString(name) {
+			return nil, fmt.Errorf("invalid profile name %q", name)
+		}
+		if _, ok := builtinProfiles[name]; ok {
+			return nil, fmt.Errorf("profile %q is built in and cannot be redefined", name)
+		}
+		if len(members) == 0 {
+			return nil, fmt.Errorf("profile %q has no builders", name)
+		}
+		for _, bt := range members {
+			if !allowedBuilders[bt] {
+				return nil, fmt.Errorf("profile %q: builder type %q not allowed", name, bt)
+			}
+		}
+		profiles[name] = members
+	}
+	return &builderConfig{policies: policies, profiles: profiles}, nil
+}
+
+// loadBuilderConfig reads the builder config file at path. If path is
+// empty, it returns a config with only the built-in profiles.
+func loadBuilderConfig(path string, defaults builderPolicy) (*builderConfig, error) {
+	if path == "" {
+		return &builderConfig{profiles: builtinProfiles}, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg, err := parseBuilderConfig(f, defaults)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// parseAllowedBuilders reads an -allowed-builders file from r: a JSON
+// array of the builder types that may be used for testing, for example:
+//
+//	["linux-amd64", "linux-amd64-longtest", "windows-amd64-2016"]
+func parseAllowedBuilders(r io.Reader) (map[string]bool, error) {
+	var list []string
+	if err := json.NewDecoder(r).Decode(&list); err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, errors.New("no builders are allowed")
+	}
+	allowed := make(map[string]bool)
+	var errs []error
+	for _, bt := range list {
+		if _, ok := dashboard.Builders[bt]; !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown builder type", bt))
+		}
+		allowed[bt] = true
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return allowed, nil
+}
+
+// loadAllowedBuilders reads the -allowed-builders file at path.
+func loadAllowedBuilders(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	allowed, err := parseAllowedBuilders(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return allowed, nil
+}
+
+// selectBuilders returns the union of the builders in the comma-separated
+// list of builder types buildersList and the comma-separated list of
+// profiles profileList, in order and without duplicates. If both are empty,
+// it returns the builders of the default profile.
+func (cfg *builderConfig) selectBuilders(buildersList, profileList string) ([]string, error) {
+	if buildersList == "" && profileList == "" {
+		profileList = defaultProfile
+	}
+	var builders []string
+	seen := make(map[string]bool)
+	add := func(bt string) {
+		if !seen[bt] {
+			seen[bt] = true
+			builders = append(builders, bt)
+		}
+	}
+	if profileList != "" {
+		for _, name := range strings.Split(profileList, ",") {
+			members, ok := cfg.profiles[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown profile %q", name)
+			}
+			for _, bt := range members {
+				add(bt)
+			}
+		}
+	}
+	if buildersList != "" {
+		for _, bt := range strings.Split(buildersList, ",") {
+			if !allowedBuilders[bt] {
+				return nil, fmt.Errorf("builder type %q not allowed", bt)
+			}
+			add(bt)
+		}
+	}
+	return builders, nil
+}
+
+// resolveBuildConfigs returns the build configs of builders, by builder
+// type, or an error listing all the builders that are unknown.
+func resolveBuildConfigs(builders []string) (map[string]*dashboard.BuildConfig, error) {
+	configs := make(map[string]*dashboard.BuildConfig)
+	var errs []error
+	for _, bt := range builders {
+		bc, ok := dashboard.Builders[bt]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown builder type", bt))
+			continue
+		}
+		configs[bt] = bc
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return configs, nil
+}
+
+// builderHashtagPrefix is the prefix of the Gerrit hashtags that request
+// extra builders for a change, as a comma-separated list of builder types,
+// like "trybot-builders=linux-riscv64,freebsd-amd64".
+const builderHashtagPrefix = "trybot-builders="
+
+// hashtagBuilders returns the builders to test a change with the given
+// hashtags on: the defaults, followed by any extra builders requested by
+// its trybot-builders hashtags. Requested builders that aren't allowed, or
+// that are unknown, are returned in rejected, in the order they were
+// requested.
+func hashtagBuilders(hashtags, defaults []string) (builders, rejected []string) {
+	builders = slices.Clone(defaults)
+	for _, tag := range hashtags {
+		list, ok := strings.CutPrefix(tag, builderHashtagPrefix)
+		if !ok {
+			continue
+		}
+		for _, bt := range strings.Split(list, ",") {
+			bt = strings.TrimSpace(bt)
+			switch {
+			case bt == "", slices.Contains(builders, bt), slices.Contains(rejected, bt):
+			case !allowedBuilders[bt] || dashboard.Builders[bt] == nil:
+				rejected = append(rejected, bt)
+			default:
+				builders = append(builders, bt)
+			}
+		}
+	}
+	return builders, rejected
+}
+
+// policy returns the policy for builderType.
+func (t *tester) policy(builderType string) builderPolicy {
+	if p, ok := t.policies[builderType]; ok {
+		return p
+	}
+	return t.defaultPolicy
+}
+
+// builderOrders are the valid values of -builder-order.
+var builderOrders = []string{"config", "random", "slowest-first"}
+
+// Estimated durations of builders that have not been used yet, for ordering
+// builders slowest first.
+const (
+	estimatedDuration     = 30 * time.Minute
+	estimatedSlowDuration = 2 * time.Hour // long test and race builders
+)
+
+// orderBuilders returns builders in the order they should be started,
+// according to t.builderOrder.
+func (t *tester) orderBuilders(builders []string) []string {
+	ordered := slices.Clone(builders)
+	switch t.builderOrder {
+	case "random":
+		rand.Shuffle(len(ordered), func(i, j int) {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+	case "slowest-first":
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return t.estimateDuration(ordered[i]) > t.estimateDuration(ordered[j])
+		})
+	}
+	return ordered
+}
+
+// estimateDuration returns how long the tests are expected to take on
+// builderType: as long as they took last time, or if they haven't run
+// yet, a rough estimate based on the kind of builder.
+func (t *tester) estimateDuration(builderType string) time.Duration {
+	if d, ok := t.durations[builderType]; ok {
+		return d
+	}
+	if bc, ok := dashboard.Builders[builderType]; ok && (bc.IsLongTest() || bc.IsRace()) {
+		return estimatedSlowDuration
+	}
+	return estimatedDuration
+}
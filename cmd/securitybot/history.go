@@ -0,0 +1,126 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/build/gerrit"
+)
+
+// The history of successful test runs is kept in the GCS log bucket as
+// empty objects named "history/<revision>/<builder type>", one for each
+// builder that passed at that revision. It is written by historySink for
+// every revision that securitybot tests, and, with -require-parent-history,
+// for the parents of changes: the parent of a change is usually a commit
+// that securitybot never tested, such as one merged from the public
+// repository, so before passing a change, securitybot tests its parent on
+// the builders that have no history there (see parentUntested).
+
+// A historyStore holds the history of successful test runs.
+type historyStore interface {
+	// passed reports whether builderType has passed at revision.
+	passed(ctx context.Context, revision, builderType string) (bool, error)
+	// record records that builderType passed at revision.
+	record(ctx context.Context, revision, builderType string) error
+}
+
+// gcsHistoryStore is a historyStore kept in a GCS bucket.
+type gcsHistoryStore struct {
+	bucket *storage.BucketHandle
+}
+
+func historyObject(revision, builderType string) string {
+	return path.Join("history", revision, builderType)
+}
+
+func (s gcsHistoryStore) passed(ctx context.Context, revision, builderType string) (bool, error) {
+	_, err := s.bucket.Object(historyObject(revision, builderType)).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s gcsHistoryStore) record(ctx context.Context, revision, builderType string) error {
+	return s.bucket.Object(historyObject(revision, builderType)).NewWriter(ctx).Close()
+}
+
+// recordHistory records the builders in results that passed at revision.
+func recordHistory(ctx context.Context, h historyStore, revision string, results []builderResult) error {
+	for _, res := range results {
+		if res.err != nil || !res.passed {
+			continue
+		}
+		if err := h.record(ctx, revision, res.builderType); err != nil {
+			return fmt.Errorf("recording history for %s at %s: %w", res.builderType, revision, err)
+		}
+	}
+	return nil
+}
+
+// untestedBuilders returns the builders in results that have no recorded
+// successful run at revision.
+func untestedBuilders(ctx context.Context, h historyStore, revision string, results []builderResult) ([]string, error) {
+	var untested []string
+	for _, res := range results {
+		if res.skipped {
+			continue
+		}
+		ok, err := h.passed(ctx, revision, res.builderType)
+		if err != nil {
+			return nil, fmt.Errorf("checking history for %s at %s: %w", res.builderType, revision, err)
+		}
+		if !ok {
+			untested = append(untested, res.builderType)
+		}
+	}
+	return untested, nil
+}
+
+// parentUntested returns the builders in results that have no recorded
+// successful run at parent, the parent revision of the change they are the
+// results of. Builders that have none are first tested at parent by calling
+// test, and the ones that pass are recorded, so only the builders that fail
+// at parent are returned.
+func parentUntested(ctx context.Context, h historyStore, parent string, results []builderResult, test func(builders []string) ([]builderResult, error)) ([]string, error) {
+	untested, err := untestedBuilders(ctx, h, parent, results)
+	if err != nil || len(untested) == 0 {
+		return untested, err
+	}
+	loggerFrom(ctx).printf("parent-untested", "no history at parent %s on %s; testing it", parent, strings.Join(untested, ", "))
+	parentResults, err := test(untested)
+	if err != nil && parentResults == nil {
+		return nil, fmt.Errorf("testing parent %s: %w", parent, err)
+	}
+	if err := recordHistory(ctx, h, parent, parentResults); err != nil {
+		return nil, err
+	}
+	passed := make(map[string]bool)
+	for _, res := range parentResults {
+		if res.err == nil && res.passed {
+			passed[res.builderType] = true
+		}
+	}
+	return slices.DeleteFunc(untested, func(bt string) bool { return passed[bt] }), nil
+}
+
+// parentRevision returns the parent of the given revision of change, or the
+// empty string if it is unknown.
+func parentRevision(change *gerrit.ChangeInfo, revision string) string {
+	rev := change.Revisions[revision]
+	if rev.Commit == nil || len(rev.Commit.Parents) == 0 {
+		return ""
+	}
+	return rev.Commit.Parents[0].CommitID
+}
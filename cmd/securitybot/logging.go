@@ -0,0 +1,104 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+)
+
+// Keys of the fields attached to log events.
+const (
+	logBuilder  = "builder"
+	logChange   = "change"
+	logRevision = "revision"
+	logRunID    = "run-id"
+)
+
+// A logger logs events, identified by short names like "tests-failed",
+// together with fields identifying the builder, change, revision, and run
+// they relate to. The logger in use is carried in the context.
+type logger struct{ l *slog.Logger }
+
+// newLogger returns a logger writing in format, which is "text" or "json".
+// In text mode, events are logged by the log package as before, with the
+// message prefixed by the builder, if any, and the other fields omitted.
+// In json mode, each event is a JSON object on a line of its own.
+func newLogger(format string) (logger, error) {
+	switch format {
+	case "text":
+		return logger{slog.New(textHandler{})}, nil
+	case "json":
+		return logger{slog.New(slog.NewJSONHandler(os.Stderr, nil))}, nil
+	}
+	return logger{}, fmt.Errorf("unknown log format %q, want text or json", format)
+}
+
+// with returns a logger that adds the field key to each event.
+func (lg logger) with(key string, value any) logger {
+	return logger{lg.l.With(key, value)}
+}
+
+// printf logs an event.
+func (lg logger) printf(event, format string, args ...any) {
+	lg.l.Info(fmt.Sprintf(format, args...), "event", event)
+}
+
+// errorf logs an event reporting a failure.
+func (lg logger) errorf(event, format string, args ...any) {
+	lg.l.Error(fmt.Sprintf(format, args...), "event", event)
+}
+
+// fatalf logs an event reporting a failure and exits.
+func (lg logger) fatalf(event, format string, args ...any) {
+	lg.errorf(event, format, args...)
+	os.Exit(1)
+}
+
+type loggerKey struct{}
+
+// withLogger returns a copy of ctx carrying lg.
+func withLogger(ctx context.Context, lg logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, lg)
+}
+
+// loggerFrom returns the logger carried by ctx, or a text logger if none.
+func loggerFrom(ctx context.Context) logger {
+	if lg, ok := ctx.Value(loggerKey{}).(logger); ok {
+		return lg
+	}
+	return logger{slog.New(textHandler{})}
+}
+
+// textHandler is a slog.Handler that logs messages using the log package,
+// prefixed by the builder when there is one.
+type textHandler struct {
+	builder string
+}
+
+func (h textHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h textHandler) Handle(_ context.Context, r slog.Record) error {
+	if h.builder != "" {
+		log.Printf("%s: %s", h.builder, r.Message)
+	} else {
+		log.Print(r.Message)
+	}
+	return nil
+}
+
+func (h textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	for _, a := range attrs {
+		if a.Key == logBuilder {
+			h.builder = a.Value.String()
+		}
+	}
+	return h
+}
+
+func (h textHandler) WithGroup(string) slog.Handler { return h }
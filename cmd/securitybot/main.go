@@ -5,19 +5,28 @@
 package main
 
 import (
+	"archive/tar"
 	"bytes"
 	"compress/gzip"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -34,6 +43,8 @@ import (
 	"golang.org/x/build/types"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"cloud.google.com/go/storage"
 )
@@ -46,6 +57,245 @@ type tester struct {
 	gcs         *storage.Client
 	http        *http.Client
 	gerrit      *gerrit.Client
+
+	failureThreshold failureThreshold
+
+	// since limits the changes that are tested in polling mode to those
+	// updated recently.
+	since sinceFilter
+
+	// runBudget, if non-zero, is the maximum duration of a test run
+	// across all builders.
+	runBudget time.Duration
+
+	// requireHistory is whether changes only pass if every builder has
+	// previously passed at the parent of the change's revision.
+	requireHistory bool
+
+	// history, if non-nil, holds the history of successful test runs,
+	// which requireHistory checks.
+	history historyStore
+
+	// logEnv is whether to log the command and environment used to run
+	// the tests on each builder.
+	logEnv bool
+
+	// localArchive, if non-nil, is the Go source archive to test instead
+	// of fetching the archive of the revision from source.
+	localArchive []byte
+
+	// version, if non-empty, is the content of the go/VERSION file
+	// written on each builder, taking precedence over the version
+	// derived from the branch being tested (see buildInfo.versionFile).
+	version string
+
+	// logOptions configure the GCS log writer.
+	logOptions logOptions
+
+	// localLogDir, if non-empty, is the directory in which to also write
+	// each builder's output to a local file, whether or not it is written
+	// to GCS.
+	localLogDir string
+
+	// livenessInterval, if non-zero, is how often to check that a buildlet
+	// still exists while commands run on it.
+	livenessInterval time.Duration
+
+	// skipTests, if non-empty, is a regular expression matching the
+	// names of tests to skip, as with go test -skip.
+	skipTests string
+
+	// skipBuilders are the builders not to test on, such as ones known to
+	// be broken. They are reported as skipped.
+	skipBuilders map[string]bool
+
+	// singleComment is whether the results are the only comment of each
+	// run, rather than a reply to the comment that the run began.
+	singleComment bool
+
+	// snippetBytes, if positive, is the maximum number of bytes from the
+	// end of a failed builder's output to include in the results comment.
+	snippetBytes int
+
+	// createRetries is the number of times to retry creating a buildlet
+	// after a transient failure, waiting createBackoff before the first
+	// retry and twice as long before each one after that.
+	createRetries int
+	createBackoff time.Duration
+
+	// passLabel and failLabel are the TryBot-Result label values applied
+	// to changes that pass and fail, respectively.
+	passLabel, failLabel int
+
+	// pins holds the changes to test at a revision other than current.
+	pins pinnedRevisions
+
+	// bootstrapSHA256 holds the checksums of the bootstrap toolchains
+	// that are downloaded and verified by securitybot, rather than
+	// fetched by buildlets directly.
+	bootstrapSHA256 bootstrapChecksums
+
+	// sinks are where the results of each run are reported.
+	sinks []ResultSink
+
+	// policies holds the per-builder overrides of defaultPolicy.
+	policies      map[string]builderPolicy
+	defaultPolicy builderPolicy
+
+	// changeLocks serializes the reviews posted to each change.
+	changeLocks changeLocks
+
+	// maxParallel, if non-zero, is the maximum number of builders to
+	// test on at once, and builderOrder is the order in which they are
+	// started: "config", "random", or "slowest-first".
+	maxParallel  int
+	builderOrder string
+
+	// durations holds how long the tests took on each builder in the
+	// most recent run that used it, for ordering builders slowest first.
+	durations map[string]time.Duration
+}
+
+// parseRevisions splits the comma-separated revisions of -revision,
+// rejecting empty and repeated ones. It returns nil if s is empty.
+func parseRevisions(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	revs := strings.Split(s, ",")
+	for i, rev := range revs {
+		if rev == "" {
+			return nil, errors.New("empty revision")
+		}
+		if slices.Contains(revs[:i], rev) {
+			return nil, fmt.Errorf("%s: listed more than once", rev)
+		}
+	}
+	return revs, nil
+}
+
+// failureThreshold is the number or percentage of failed builders at which
+// the TryBot-Result-1 label is applied.
+type failureThreshold struct {
+	count   int     // used when percent is zero
+	percent float64 // in the range (0, 100]
+}
+
+// parseFailureThreshold parses s, which is either a positive count ("2")
+// or a percentage ("25%").
+func parseFailureThreshold(s string) (failureThreshold, error) {
+	if p, ok := strings.CutSuffix(s, "%"); ok {
+		f, err := strconv.ParseFloat(p, 64)
+		if err != nil || f <= 0 || f > 100 {
+			return failureThreshold{}, fmt.Errorf("invalid percentage %q, must be in the range (0, 100]", s)
+		}
+		return failureThreshold{percent: f}, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return failureThreshold{}, fmt.Errorf("invalid count %q, must be a positive integer", s)
+	}
+	return failureThreshold{count: n}, nil
+}
+
+// reached reports whether failures out of total builders meets the threshold.
+func (ft failureThreshold) reached(failures, total int) bool {
+	if failures == 0 {
+		return false
+	}
+	if ft.percent > 0 {
+		return float64(failures)*100 >= ft.percent*float64(total)
+	}
+	return failures >= ft.count
+}
+
+// pinnedRevisions maps change numbers to the revision to test for the
+// change instead of its current revision. It implements flag.Value, with
+// values of the form "change:revision", where revision is a patch set
+// number or a (possibly abbreviated) commit ID.
+type pinnedRevisions map[int]string
+
+func (p pinnedRevisions) String() string {
+	var pins []string
+	for change, rev := range p {
+		pins = append(pins, fmt.Sprintf("%d:%s", change, rev))
+	}
+	sort.Strings(pins)
+	return strings.Join(pins, ",")
+}
+
+func (p pinnedRevisions) Set(s string) error {
+	change, rev, ok := strings.Cut(s, ":")
+	n, err := strconv.Atoi(change)
+	if !ok || err != nil || n <= 0 || rev == "" {
+		return fmt.Errorf("invalid pin %q, want change:revision", s)
+	}
+	if old, ok := p[n]; ok && old != rev {
+		return fmt.Errorf("change %d pinned to both %s and %s", n, old, rev)
+	}
+	p[n] = rev
+	return nil
+}
+
+// resolve returns the revision of change to test, which is its current
+// revision unless the change is pinned.
+func (p pinnedRevisions) resolve(change *gerrit.ChangeInfo) (revision string, pinned bool, err error) {
+	pin, ok := p[change.ChangeNumber]
+	if !ok {
+		return change.CurrentRevision, false, nil
+	}
+	if ps, err := strconv.Atoi(pin); err == nil {
+		for id, rev := range change.Revisions {
+			if rev.PatchSetNumber == ps {
+				return id, true, nil
+			}
+		}
+		return "", false, fmt.Errorf("CL %d has no patch set %d", change.ChangeNumber, ps)
+	}
+	var matches []string
+	for id := range change.Revisions {
+		if strings.HasPrefix(id, pin) {
+			matches = append(matches, id)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", false, fmt.Errorf("CL %d has no revision %s", change.ChangeNumber, pin)
+	case 1:
+		return matches[0], true, nil
+	default:
+		return "", false, fmt.Errorf("CL %d has multiple revisions matching %s", change.ChangeNumber, pin)
+	}
+}
+
+// bootstrapChecksums maps the URLs of bootstrap toolchains to their
+// expected SHA-256 checksums, in lowercase hex.
+type bootstrapChecksums map[string]string
+
+func (b bootstrapChecksums) String() string {
+	var sums []string
+	for url, sum := range b {
+		sums = append(sums, url+"="+sum)
+	}
+	sort.Strings(sums)
+	return strings.Join(sums, ",")
+}
+
+func (b bootstrapChecksums) Set(s string) error {
+	// The checksum can't contain "=", but the URL can.
+	i := strings.LastIndex(s, "=")
+	if i <= 0 {
+		return fmt.Errorf("invalid checksum %q, want url=sha256", s)
+	}
+	url, sum := s[:i], strings.ToLower(s[i+1:])
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+		return fmt.Errorf("invalid checksum %q: not a hex SHA-256 checksum", sum)
+	}
+	if old, ok := b[url]; ok && old != sum {
+		return fmt.Errorf("%s has both checksum %s and %s", url, old, sum)
+	}
+	b[url] = sum
+	return nil
 }
 
 type builderResult struct {
@@ -53,13 +303,77 @@ type builderResult struct {
 	logURL      string
 	passed      bool
 	err         error
+
+	// queueTime is how long was spent waiting behind other requests for
+	// a buildlet, and testTime is how long was spent using the buildlet
+	// once it was created, summed over all attempts.
+	queueTime, testTime time.Duration
+
+	// duration is the wall-clock time from the start of the builder's
+	// first attempt to the end of its last.
+	duration time.Duration
+
+	// skipped is whether the builder wasn't tested because it is in
+	// -skip-builders.
+	skipped bool
+
+	// snippet, if the tests failed and -snippet-bytes is set, is the end of
+	// their output, formatted for a Gerrit comment.
+	snippet string
 }
 
 type buildInfo struct {
 	revision      string
 	branch        string
+	configs       map[string]*dashboard.BuildConfig // by builder type
 	changeArchive []byte
 	goArchive     []byte
+
+	// changeArchiveURL and goArchiveURL, if set, are the URLs of copies of
+	// changeArchive and goArchive previously uploaded to the coordinator,
+	// which buildlets can fetch directly instead of each having the archive
+	// uploaded to it separately.
+	changeArchiveURL string
+	goArchiveURL     string
+
+	// version, if non-empty, overrides the content of go/VERSION.
+	version string
+
+	// bootstraps holds the verified copies of bootstrap toolchains
+	// uploaded to the coordinator during this run, by their original URL.
+	bootstrapsMu sync.Mutex
+	bootstraps   map[string]*verifiedBootstrap
+
+	// logStarted, if non-nil, is called with the URL of each builder's
+	// log as soon as it is created, before the tests run. It may be
+	// called concurrently, and again for each retry.
+	logStarted func(builderType, logURL string)
+}
+
+// releaseBranchRegexp matches the release branches of the main Go repo,
+// capturing their Go version.
+var releaseBranchRegexp = regexp.MustCompile(`^release-branch\.(go1\.\d+)$`)
+
+// versionFile returns the content of the go/VERSION file to write on
+// the builders. In order of precedence, it is:
+//
+//   - bi.version, as set by -version, if non-empty;
+//   - for a release branch of the main repo, like release-branch.go1.22,
+//     the branch's Go version followed by "-devel_" and the revision, so
+//     that tests which depend on the Go version see the release's version
+//     and not that of a development build;
+//   - otherwise, "devel " followed by the revision, as for master.
+//
+// Subrepos are tested with the main repo at master, so they always get the
+// last of these.
+func (bi *buildInfo) versionFile() string {
+	if bi.version != "" {
+		return bi.version
+	}
+	if m := releaseBranchRegexp.FindStringSubmatch(bi.branch); m != nil {
+		return m[1] + "-devel_" + bi.revision
+	}
+	return "devel " + bi.revision
 }
 
 func (bi *buildInfo) isSubrepo() bool {
@@ -67,58 +381,129 @@ func (bi *buildInfo) isSubrepo() bool {
 	return repos.ByGerritProject[repo] != nil
 }
 
-func createBuildletWithRetry(ctx context.Context, coordinator *buildlet.GRPCCoordinatorClient, builderType string) (buildlet.RemoteClient, error) {
-	const retries int = 5
-	var err error
-	for i := 0; i < retries; i++ {
-		var c buildlet.RemoteClient
-		c, err = coordinator.CreateBuildletWithStatus(ctx, builderType, func(status types.BuildletWaitStatus) {})
+// retryableCreateError reports whether err, returned by an attempt to create
+// a buildlet, is likely transient, such as running out of quota or the
+// coordinator being briefly unavailable, so that trying again may succeed.
+// Other errors, such as an unknown builder type, are permanent.
+func retryableCreateError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		// We were cancelled, or ran out of time overall.
+		return false
+	}
+	switch status.Code(err) {
+	case codes.ResourceExhausted, codes.Unavailable, codes.DeadlineExceeded, codes.Aborted:
+		return true
+	case codes.InvalidArgument, codes.NotFound, codes.PermissionDenied, codes.Unauthenticated:
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	msg := err.Error()
+	for _, s := range []string{
+		"ResourceNotReady: failed waiting for successful resource state", // AWS
+		"quota",
+		"503",
+	} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// createBuildletWithRetry calls create to create a buildlet, retrying up to
+// retries times with exponential backoff, starting at backoff, if it fails
+// with a retryable error. Attempts are numbered from 1.
+func createBuildletWithRetry(ctx context.Context, retries int, backoff time.Duration, create func(attempt int) (buildlet.RemoteClient, error)) (buildlet.RemoteClient, error) {
+	lg := loggerFrom(ctx)
+	for attempt := 1; ; attempt++ {
+		c, err := create(attempt)
 		if err == nil {
 			return c, nil
 		}
-		// TODO(roland): we currently only care about retrying when we hit this
-		// particular AWS error, but we may want to retry in other cases in the
-		// future?
-		if !strings.Contains(err.Error(), "ResourceNotReady: failed waiting for successful resource state") {
+		if !retryableCreateError(ctx, err) {
 			return nil, err
 		}
-		log.Printf("%s: failed to create buildlet (attempt %d): %s", builderType, retries, err)
-		time.Sleep(time.Second * 30)
+		if attempt > retries {
+			return nil, fmt.Errorf("failed to create buildlet after %d attempts, last error: %w", attempt, err)
+		}
+		lg.printf("create-buildlet-retry", "failed to create buildlet (attempt %d of %d), retrying in %s: %s", attempt, retries+1, backoff, err)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to create buildlet: %w (after attempt %d: %s)", ctx.Err(), attempt, err)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
 	}
-	return nil, fmt.Errorf("failed to create buildlet after %d attempts, last error: %s", retries, err)
 }
 
 // runTests creates a buildlet for the specified builderType, sends a copy of go1.4 and the change tarball to
 // the buildlet, and then executes the platform specific 'all' script, streaming the output to a GCS bucket.
 // The buildlet is destroyed on return.
-func (t *tester) runTests(ctx context.Context, builderType string, info *buildInfo) builderResult {
-	log.Printf("%s: creating buildlet", builderType)
-	c, err := createBuildletWithRetry(ctx, t.coordinator, builderType)
+func (t *tester) runTests(ctx context.Context, builderType string, info *buildInfo) (result builderResult) {
+	lg := loggerFrom(ctx)
+	lg.printf("create-buildlet", "creating buildlet")
+	// The coordinator reports the number of requests ahead of ours while
+	// we wait, so the queue time is up to its last report of any.
+	start := time.Now()
+	var queued time.Duration
+	c, err := createBuildletWithRetry(ctx, t.createRetries, t.createBackoff, func(attempt int) (buildlet.RemoteClient, error) {
+		ahead := -1
+		return t.coordinator.CreateBuildletWithStatus(ctx, builderType, func(st types.BuildletWaitStatus) {
+			if st.Ahead > 0 {
+				queued = time.Since(start)
+			}
+			if st.Ahead != ahead {
+				ahead = st.Ahead
+				lg.printf("waiting-for-buildlet", "waiting for buildlet (attempt %d of %d): %d requests ahead", attempt, t.createRetries+1, ahead)
+			}
+		})
+	})
 	if err != nil {
-		return builderResult{builderType: builderType, err: fmt.Errorf("failed to create buildlet: %s", err)}
+		return builderResult{builderType: builderType, err: fmt.Errorf("failed to create buildlet: %s", err), queueTime: queued}
 	}
+	ready := time.Now()
+	defer func() {
+		result.queueTime, result.testTime = queued, time.Since(ready)
+	}()
 	buildletName := c.RemoteName()
-	log.Printf("%s: created buildlet (%s)", builderType, buildletName)
+	lg.printf("created-buildlet", "created buildlet (%s) after %s, %s of it queued", buildletName, ready.Sub(start).Round(time.Second), queued.Round(time.Second))
 	defer func() {
 		if err := c.Close(); err != nil {
-			log.Printf("%s: unable to close buildlet %q: %s", builderType, buildletName, err)
+			lg.errorf("close-buildlet-failed", "unable to close buildlet %q: %s", buildletName, err)
 		} else {
-			log.Printf("%s: destroyed buildlet", builderType)
+			lg.printf("destroyed-buildlet", "destroyed buildlet")
 		}
 	}()
 
-	buildConfig, ok := dashboard.Builders[builderType]
-	if !ok {
-		log.Printf("%s: unknown builder type", builderType)
-		return builderResult{builderType: builderType, err: errors.New("unknown builder type")}
+	// Commands can run for hours, so rather than wait for them to time out
+	// if the buildlet is preempted, watch for it going away and cancel them.
+	ctx, cancelWatch := context.WithCancelCause(ctx)
+	defer cancelWatch(nil)
+	if t.livenessInterval > 0 {
+		go t.watchBuildlet(ctx, buildletName, t.livenessInterval, cancelWatch)
 	}
+
+	buildConfig := info.configs[builderType]
 	bootstrapURL := buildConfig.GoBootstrapURL(buildenv.Production)
 	// Assume if bootstrapURL == "" the buildlet is already bootstrapped
-	if bootstrapURL != "" {
+	switch {
+	case bootstrapURL == "":
+		lg.printf("bootstrap-not-needed", "no bootstrap needed")
+	case t.policy(builderType).skipBootstrap:
+		lg.printf("bootstrap-skipped", "skipped bootstrap upload")
+	default:
+		bootstrapURL, err := t.verifiedBootstrapURL(ctx, info, bootstrapURL)
+		if err != nil {
+			lg.errorf("bootstrap-verify-failed", "failed to verify bootstrap toolchain: %s", err)
+			return builderResult{builderType: builderType, err: fmt.Errorf("failed to verify bootstrap toolchain: %s", err)}
+		}
 		if err := c.PutTarFromURL(ctx, bootstrapURL, "go1.4"); err != nil {
-			log.Printf("%s: failed to bootstrap buildlet: %s", builderType, err)
+			lg.errorf("bootstrap-failed", "failed to bootstrap buildlet: %s", err)
 			return builderResult{builderType: builderType, err: fmt.Errorf("failed to bootstrap buildlet: %s", err)}
 		}
+		lg.printf("bootstrap-uploaded", "uploaded bootstrap")
 	}
 
 	suffix := make([]byte, 4)
@@ -129,29 +514,66 @@ func (t *tester) runTests(ctx context.Context, builderType string, info *buildIn
 
 	if t.gcs != nil {
 		gcsBucket, gcsObject := *gcsBucket, fmt.Sprintf("%s-%x/%s", info.revision, suffix, builderType)
-		gcsWriter, err := newLiveWriter(ctx, t.gcs.Bucket(gcsBucket).Object(gcsObject))
+		gcsWriter, err := newLiveWriter(ctx, t.gcs.Bucket(gcsBucket), gcsObject, t.logOptions)
 		if err != nil {
-			log.Printf("%s: failed to create log writer: %s", builderType, err)
+			lg.errorf("log-writer-failed", "failed to create log writer: %s", err)
 			return builderResult{builderType: builderType, err: fmt.Errorf("failed to create log writer: %s", err)}
 		}
 		defer func() {
 			if err := gcsWriter.Close(); err != nil {
-				log.Printf("%s: failed to flush GCS writer: %s", builderType, err)
+				lg.errorf("log-flush-failed", "failed to flush GCS writer: %s", err)
 			}
 		}()
 		logURL = "https://storage.cloud.google.com/" + path.Join(gcsBucket, gcsObject)
 		output = gcsWriter
+		if info.logStarted != nil {
+			info.logStarted(builderType, logURL)
+		}
 	} else {
 		output = &localWriter{buildletName}
 	}
+	if t.localLogDir != "" {
+		f, err := openLocalLog(t.localLogDir, info.revision, builderType)
+		if err != nil {
+			lg.errorf("log-writer-failed", "failed to create local log file: %s", err)
+			return builderResult{builderType: builderType, err: fmt.Errorf("failed to create local log file: %s", err)}
+		}
+		defer func() {
+			if err := f.Close(); err != nil {
+				lg.errorf("log-flush-failed", "failed to close local log file: %s", err)
+			}
+		}()
+		lg.printf("local-log", "writing output to %s", f.Name())
+		output = io.MultiWriter(output, f)
+	}
+	var tail *tailBuffer
+	if t.snippetBytes > 0 {
+		tail = &tailBuffer{max: t.snippetBytes}
+		output = io.MultiWriter(output, tail)
+	}
+
+	// lost reports whether the buildlet has gone away, as when it is
+	// preempted, in which case a failed command is an infrastructure
+	// failure rather than a test failure.
+	lost := func(stage string) (builderResult, bool) {
+		if !errors.Is(context.Cause(ctx), errBuildletLost) && (ctx.Err() != nil || !t.buildletLost(ctx, buildletName)) {
+			return builderResult{}, false
+		}
+		lg.errorf("buildlet-lost", "buildlet %s went away during %s, probably preempted", buildletName, stage)
+		return builderResult{builderType: builderType, logURL: logURL, err: fmt.Errorf("%w during %s", errBuildletLost, stage)}, true
+	}
 
 	work, err := c.WorkDir(ctx)
 	if err != nil {
-		log.Printf("%s: failed to retrieve work dir: %s", builderType, err)
+		lg.errorf("workdir-failed", "failed to retrieve work dir: %s", err)
 		return builderResult{builderType: builderType, err: fmt.Errorf("failed to get work dir: %s", err)}
 	}
 
 	env := append(buildConfig.Env(), "GOPATH="+work+"/gopath", "GOROOT_FINAL="+dashboard.GorootFinal(buildConfig.GOOS()), "GOROOT="+work+"/go")
+	if t.skipTests != "" {
+		lg.printf("tests-skipped", "WARNING: skipping tests matching %q", t.skipTests)
+		env = skipTestsEnv(env, t.skipTests)
+	}
 	// Because we are unable to determine the internal GCE hostname of the
 	// coordinator, we cannot use the same GOPROXY proxy that the public TryBots
 	// use to get around the disabled network. Instead of using that proxy
@@ -172,12 +594,12 @@ func (t *tester) runTests(ctx context.Context, builderType string, info *buildIn
 		dirName = info.branch
 
 		// fetch and build go at master first
-		if err := c.PutTar(ctx, bytes.NewReader(info.goArchive), "go"); err != nil {
-			log.Printf("%s: failed to upload change archive: %s", builderType, err)
+		if err := putArchive(ctx, c, info.goArchive, info.goArchiveURL, "go"); err != nil {
+			lg.errorf("upload-failed", "failed to upload change archive: %s", err)
 			return builderResult{builderType: builderType, err: fmt.Errorf("failed to upload change archive: %s", err)}
 		}
-		if err := c.Put(ctx, strings.NewReader("devel "+info.revision), "go/VERSION", 0644); err != nil {
-			log.Printf("%s: failed to upload VERSION file: %s", builderType, err)
+		if err := c.Put(ctx, strings.NewReader(info.versionFile()), "go/VERSION", 0644); err != nil {
+			lg.errorf("upload-failed", "failed to upload VERSION file: %s", err)
 			return builderResult{builderType: builderType, err: fmt.Errorf("failed to upload VERSION file: %s", err)}
 		}
 
@@ -187,27 +609,32 @@ func (t *tester) runTests(ctx context.Context, builderType string, info *buildIn
 			ExtraEnv: append(env, "GO_DISABLE_OUTBOUND_NETWORK=0"),
 			Args:     args,
 			OnStartExec: func() {
-				log.Printf("%s: starting make.bash %s", builderType, logURL)
+				lg.printf("make-started", "starting make.bash %s", logURL)
 			},
 		})
+		if execErr != nil || remoteErr != nil {
+			if res, ok := lost("make.bash"); ok {
+				return res
+			}
+		}
 		if execErr != nil {
-			log.Printf("%s: failed to execute make.bash: %s", builderType, execErr)
-			return builderResult{builderType: builderType, err: fmt.Errorf("failed to execute make.bash: %s", err)}
+			lg.errorf("make-exec-failed", "failed to execute make.bash: %s", execErr)
+			return builderResult{builderType: builderType, err: fmt.Errorf("failed to execute make.bash: %s", execErr)}
 		}
 		if remoteErr != nil {
-			log.Printf("%s: make.bash failed: %s", builderType, remoteErr)
+			lg.errorf("make-failed", "make.bash failed: %s", remoteErr)
 			return builderResult{builderType: builderType, err: fmt.Errorf("make.bash failed: %s", remoteErr)}
 		}
 	}
 
-	if err := c.PutTar(ctx, bytes.NewReader(info.changeArchive), dirName); err != nil {
-		log.Printf("%s: failed to upload change archive: %s", builderType, err)
+	if err := putArchive(ctx, c, info.changeArchive, info.changeArchiveURL, dirName); err != nil {
+		lg.errorf("upload-failed", "failed to upload change archive: %s", err)
 		return builderResult{builderType: builderType, err: fmt.Errorf("failed to upload change archive: %s", err)}
 	}
 
 	if !info.isSubrepo() {
-		if err := c.Put(ctx, strings.NewReader("devel "+info.revision), "go/VERSION", 0644); err != nil {
-			log.Printf("%s: failed to upload VERSION file: %s", builderType, err)
+		if err := c.Put(ctx, strings.NewReader(info.versionFile()), "go/VERSION", 0644); err != nil {
+			lg.errorf("upload-failed", "failed to upload VERSION file: %s", err)
 			return builderResult{builderType: builderType, err: fmt.Errorf("failed to upload VERSION file: %s", err)}
 		}
 	}
@@ -224,7 +651,7 @@ func (t *tester) runTests(ctx context.Context, builderType string, info *buildIn
 		ExtraEnv: env,
 		Args:     args,
 		OnStartExec: func() {
-			log.Printf("%s: starting tests %s", builderType, logURL)
+			lg.printf("tests-started", "starting tests %s", logURL)
 		},
 	}
 	if info.isSubrepo() {
@@ -236,111 +663,254 @@ func (t *tester) runTests(ctx context.Context, builderType string, info *buildIn
 			Dir:      dirName,
 			Output:   output,
 			OnStartExec: func() {
-				log.Printf("%s: downloading modules %s", builderType, logURL)
+				lg.printf("mod-download-started", "downloading modules %s", logURL)
 			},
 		})
+		if execErr != nil || remoteErr != nil {
+			if res, ok := lost("go mod download"); ok {
+				return res
+			}
+		}
 		if execErr != nil {
-			log.Printf("%s: failed to execute go mod download: %s", builderType, execErr)
-			return builderResult{builderType: builderType, err: fmt.Errorf("failed to execute go mod download: %s", err)}
+			lg.errorf("mod-download-exec-failed", "failed to execute go mod download: %s", execErr)
+			return builderResult{builderType: builderType, err: fmt.Errorf("failed to execute go mod download: %s", execErr)}
 		}
 		if remoteErr != nil {
-			log.Printf("%s: go mod download failed: %s", builderType, remoteErr)
+			lg.errorf("mod-download-failed", "go mod download failed: %s", remoteErr)
 			return builderResult{builderType: builderType, err: fmt.Errorf("go mod download failed: %s", remoteErr)}
 		}
 	}
 	if disableNetwork {
 		opts.ExtraEnv = append(opts.ExtraEnv, "GO_DISABLE_OUTBOUND_NETWORK=1")
 	}
+	if t.logEnv {
+		header := execHeader(cmd, opts.Args, opts.ExtraEnv)
+		lg.printf("exec-header", "executing\n%s", header)
+		io.WriteString(output, header+"\n")
+	}
 	remoteErr, execErr := c.Exec(ctx, cmd, opts)
+	if execErr != nil || remoteErr != nil {
+		if res, ok := lost("tests"); ok {
+			return res
+		}
+	}
 	if execErr != nil {
-		log.Printf("%s: failed to execute tests: %s", builderType, execErr)
-		return builderResult{builderType: builderType, err: fmt.Errorf("failed to execute all.bash: %s", err)}
+		lg.errorf("tests-exec-failed", "failed to execute tests: %s", execErr)
+		return builderResult{builderType: builderType, err: fmt.Errorf("failed to execute all.bash: %s", execErr)}
 	}
 	if remoteErr != nil {
-		log.Printf("%s: tests failed: %s", builderType, remoteErr)
-		return builderResult{builderType: builderType, logURL: logURL, passed: false}
+		lg.printf("tests-failed", "tests failed: %s", remoteErr)
+		res := builderResult{builderType: builderType, logURL: logURL, passed: false}
+		if tail != nil {
+			res.snippet = tail.snippet()
+		}
+		return res
 	}
-	log.Printf("%s: tests succeeded", builderType)
+	lg.printf("tests-passed", "tests succeeded")
 	return builderResult{builderType: builderType, logURL: logURL, passed: true}
 }
 
-// gcsLiveWriter is an extremely hacky way of getting live(ish) updating logs while
-// using GCS. The buffer is written out to an object every 5 seconds.
-type gcsLiveWriter struct {
-	obj  *storage.ObjectHandle
-	buf  *bytes.Buffer
-	mu   *sync.Mutex
-	stop chan bool
-	err  chan error
+// errBuildletLost is the error of builder results whose buildlet went
+// away while running a command.
+var errBuildletLost = errors.New("buildlet went away")
+
+// maxLostBuildletRetries is the number of times the tests for a builder are
+// retried on a fresh buildlet after the buildlet goes away, in addition to
+// any retries permitted by the builder's policy.
+const maxLostBuildletRetries = 2
+
+// buildletLost reports whether the buildlet named name no longer exists.
+func (t *tester) buildletLost(ctx context.Context, name string) bool {
+	_, err := t.coordinator.Client.InstanceAlive(ctx, &protos.InstanceAliveRequest{GomoteId: name})
+	return status.Code(err) == codes.NotFound
 }
 
-func newLiveWriter(ctx context.Context, obj *storage.ObjectHandle) (*gcsLiveWriter, error) {
-	stopCh, errCh := make(chan bool, 1), make(chan error, 1)
-	mu := new(sync.Mutex)
-	buf := new(bytes.Buffer)
-	write := func(b []byte) error {
-		w := obj.NewWriter(ctx)
-		w.Write(b)
-		if err := w.Close(); err != nil {
-			return err
-		}
-		return nil
+// destroyOrphanedBuildlets destroys the buildlets left behind by a previous
+// run of securitybot that exited without destroying them, such as one that
+// crashed. Since securitybot isn't meant to run concurrently, every
+// buildlet of its user is assumed to be orphaned, so it must be called
+// before any buildlets are created. Failures are logged, since leaked
+// buildlets eventually expire anyway.
+func (t *tester) destroyOrphanedBuildlets(ctx context.Context) {
+	lg := loggerFrom(ctx)
+	names, err := t.coordinator.ListBuildlets(ctx)
+	if err != nil {
+		lg.errorf("list-buildlets-failed", "unable to list orphaned buildlets: %s", err)
+		return
 	}
-	if err := write([]byte{}); err != nil {
-		return nil, err
+	for _, name := range names {
+		if err := t.coordinator.DestroyBuildlet(ctx, name); err != nil && status.Code(err) != codes.NotFound {
+			lg.errorf("destroy-orphan-failed", "unable to destroy orphaned buildlet %q: %s", name, err)
+			continue
+		}
+		lg.printf("destroyed-orphan", "destroyed orphaned buildlet %q", name)
 	}
-	go func() {
-		t := time.NewTicker(time.Second * 5)
-		for {
-			select {
-			case <-stopCh:
-				mu.Lock()
-				errCh <- write(buf.Bytes())
-				mu.Unlock()
-			case <-t.C:
-				mu.Lock()
-				if err := write(buf.Bytes()); err != nil {
-					log.Printf("GCS write to %q failed! %s", path.Join(obj.BucketName(), obj.ObjectName()), err)
-					errCh <- err
-				}
-				mu.Unlock()
+}
+
+// watchBuildlet checks every interval whether the buildlet named name still
+// exists, until ctx is done. If it doesn't, watchBuildlet cancels ctx with
+// the cause errBuildletLost.
+func (t *tester) watchBuildlet(ctx context.Context, name string, interval time.Duration, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if t.buildletLost(ctx, name) && ctx.Err() == nil {
+				cancel(errBuildletLost)
+				return
 			}
 		}
-	}()
-	return &gcsLiveWriter{obj: obj, buf: buf, mu: mu, stop: stopCh, err: errCh}, nil
+	}
 }
 
-func (g *gcsLiveWriter) Write(b []byte) (int, error) {
-	g.mu.Lock()
-	g.buf.Write(b)
-	g.mu.Unlock()
-	return len(b), nil
+// runTestsWithPolicy runs the tests for builderType using runTests,
+// applying the builder's timeout to each attempt and retrying failed
+// attempts as permitted by its policy. Attempts whose buildlet went
+// away are retried without counting against the policy.
+func (t *tester) runTestsWithPolicy(ctx context.Context, builderType string, info *buildInfo) builderResult {
+	lg := loggerFrom(ctx).with(logBuilder, builderType)
+	ctx = withLogger(ctx, lg)
+	p := t.policy(builderType)
+	var result builderResult
+	var queueTime, testTime time.Duration
+	lostRetries, retryLost := 0, false
+	for attempt := 0; attempt <= p.retries; attempt++ {
+		if retryLost {
+			lg.printf("buildlet-lost-retry", "retrying tests on a fresh buildlet (%d of %d)", lostRetries, maxLostBuildletRetries)
+		} else if attempt > 0 {
+			lg.printf("tests-retry", "retrying tests (retry %d of %d)", attempt, p.retries)
+		}
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if p.timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, p.timeout)
+		}
+		result = t.runTests(attemptCtx, builderType, info)
+		queueTime += result.queueTime
+		testTime += result.testTime
+		if !result.passed && ctx.Err() == nil && errors.Is(attemptCtx.Err(), context.DeadlineExceeded) {
+			lg.errorf("tests-timeout", "timed out after %s", p.timeout)
+			result.err = fmt.Errorf("timed out after %s", p.timeout)
+		}
+		cancel()
+		if result.passed || ctx.Err() != nil {
+			break
+		}
+		retryLost = errors.Is(result.err, errBuildletLost) && lostRetries < maxLostBuildletRetries
+		if retryLost {
+			lostRetries++
+			attempt--
+		}
+	}
+	result.queueTime, result.testTime = queueTime, testTime
+	return result
 }
 
-func (g *gcsLiveWriter) Close() error {
-	g.stop <- true
-	return <-g.err
+// sensitiveEnvKeys are substrings of environment variable names whose
+// values are redacted when logged.
+var sensitiveEnvKeys = []string{"TOKEN", "SECRET", "PASSWORD", "PASSWD", "CREDENTIAL", "KEY", "AUTH"}
+
+// skipTestsEnv returns env with -skip=pattern added to GOFLAGS, so that
+// every go test run by all.bash skips the tests matching pattern.
+func skipTestsEnv(env []string, pattern string) []string {
+	env = slices.Clone(env)
+	skip := "-skip=" + pattern
+	for i, kv := range env {
+		if v, ok := strings.CutPrefix(kv, "GOFLAGS="); ok {
+			env[i] = "GOFLAGS=" + strings.TrimSpace(v+" "+skip)
+			return env
+		}
+	}
+	return append(env, "GOFLAGS="+skip)
 }
 
-type localWriter struct {
-	buildlet string
+// redactEnv returns a copy of env with the values of variables that look
+// like they hold secrets replaced.
+func redactEnv(env []string) []string {
+	redacted := make([]string, 0, len(env))
+	for _, kv := range env {
+		k, _, _ := strings.Cut(kv, "=")
+		for _, s := range sensitiveEnvKeys {
+			if strings.Contains(strings.ToUpper(k), s) {
+				kv = k + "=<redacted>"
+				break
+			}
+		}
+		redacted = append(redacted, kv)
+	}
+	return redacted
 }
 
-func (lw *localWriter) Write(b []byte) (int, error) {
-	prefix := []byte(lw.buildlet + ": ")
-	var prefixed []byte
-	for _, l := range bytes.Split(b, []byte("\n")) {
-		prefixed = append(prefixed, append(prefix, append(l, byte('\n'))...)...)
+// execHeader describes the command about to be executed on a buildlet, so
+// that the test run can be reproduced.
+func execHeader(cmd string, args, env []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "command: %s %s\n", cmd, strings.Join(args, " "))
+	b.WriteString("environment:\n")
+	for _, kv := range redactEnv(env) {
+		fmt.Fprintf(&b, "\t%s\n", kv)
 	}
+	return b.String()
+}
 
-	return os.Stdout.Write(prefixed)
+// putArchive extracts the gzipped tar archive into dir on the buildlet c,
+// fetching it from url if set, and otherwise uploading archive directly.
+// If fetching from url fails, it falls back to uploading archive.
+func putArchive(ctx context.Context, c buildlet.RemoteClient, archive []byte, url, dir string) error {
+	if url != "" {
+		err := c.PutTarFromURL(ctx, url, dir)
+		if err == nil {
+			return nil
+		}
+		loggerFrom(ctx).errorf("shared-archive-fetch-failed", "failed to fetch shared archive on %s, uploading directly: %s", c.RemoteName(), err)
+	}
+	return c.PutTar(ctx, bytes.NewReader(archive), dir)
 }
 
-// getTar retrieves the tarball for a specific git revision from t.source and returns
-// the bytes.
-func (t *tester) getTar(revision string) ([]byte, error) {
-	tarURL := t.source + "/" + t.repo + "/+archive/" + revision + ".tar.gz"
-	req, err := http.NewRequest("GET", tarURL, nil)
+// A verifiedBootstrap is a bootstrap toolchain whose checksum was verified
+// and that was uploaded to the coordinator for buildlets to fetch.
+type verifiedBootstrap struct {
+	once sync.Once
+	url  string // of the uploaded copy
+	err  error
+}
+
+// verifiedBootstrapURL returns the URL from which buildlets should fetch
+// the bootstrap toolchain at url. If t has a checksum for url, the
+// toolchain is downloaded and verified, once per run, and the URL is of a
+// copy uploaded to the coordinator; otherwise, it is url itself.
+func (t *tester) verifiedBootstrapURL(ctx context.Context, info *buildInfo, url string) (string, error) {
+	sum, ok := t.bootstrapSHA256[url]
+	if !ok {
+		return url, nil
+	}
+	info.bootstrapsMu.Lock()
+	if info.bootstraps == nil {
+		info.bootstraps = make(map[string]*verifiedBootstrap)
+	}
+	vb := info.bootstraps[url]
+	if vb == nil {
+		vb = new(verifiedBootstrap)
+		info.bootstraps[url] = vb
+	}
+	info.bootstrapsMu.Unlock()
+	vb.once.Do(func() {
+		var data []byte
+		data, vb.err = t.fetchVerified(ctx, url, sum)
+		if vb.err != nil {
+			return
+		}
+		vb.url, vb.err = t.coordinator.UploadFile(ctx, bytes.NewReader(data))
+	})
+	return vb.url, vb.err
+}
+
+// fetchVerified downloads url and returns its contents if their SHA-256
+// checksum is sum, in hex.
+func (t *tester) fetchVerified(ctx context.Context, url, sum string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -348,139 +918,1185 @@ func (t *tester) getTar(revision string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to fetch %q: %v", tarURL, resp.Status)
+		return nil, fmt.Errorf("failed to fetch %q: %v", url, resp.Status)
 	}
-	defer resp.Body.Close()
-	archive, err := io.ReadAll(resp.Body)
+	data, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
-
-	// Check what we got back was actually the archive, since Google's SSO page will
-	// return 200.
-	_, err = gzip.NewReader(bytes.NewReader(archive))
-	if err != nil {
-		return nil, err
+	if got := sha256.Sum256(data); hex.EncodeToString(got[:]) != sum {
+		return nil, fmt.Errorf("%s has SHA-256 checksum %x, want %s", url, got, sum)
 	}
-
-	return archive, nil
+	return data, nil
 }
 
-// run tests the specific revision on the builders specified.
-func (t *tester) run(ctx context.Context, revision, branch string, builders []string) ([]builderResult, error) {
-	changeArchive, err := t.getTar(revision)
-	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve change archive: %s", err)
-	}
-
-	info := &buildInfo{
-		revision:      revision,
-		branch:        branch,
-		changeArchive: changeArchive,
-	}
-
-	if branch != "master" {
-		goArchive, err := t.getTar("master")
+// shareArchives uploads the archives in info to the coordinator once, so
+// that each buildlet can fetch them rather than the same archive being
+// uploaded to every buildlet. If an upload fails, buildlets fall back to
+// having the archive uploaded to them directly.
+func (t *tester) shareArchives(ctx context.Context, info *buildInfo) {
+	lg := loggerFrom(ctx)
+	start := time.Now()
+	upload := func(archive []byte) string {
+		if archive == nil {
+			return ""
+		}
+		url, err := t.coordinator.UploadFile(ctx, bytes.NewReader(archive))
 		if err != nil {
-			return nil, fmt.Errorf("failed to retrieve go master archive: %s", err)
+			lg.errorf("shared-archive-upload-failed", "failed to upload shared archive, falling back to per-builder uploads: %s", err)
+			return ""
 		}
-		info.goArchive = goArchive
+		return url
 	}
+	info.changeArchiveURL = upload(info.changeArchive)
+	info.goArchiveURL = upload(info.goArchive)
+	lg.printf("shared-archives-uploaded", "uploaded shared archives in %s", time.Since(start).Round(time.Millisecond))
+}
 
-	wg := new(sync.WaitGroup)
-	resultsCh := make(chan builderResult, len(builders))
-	for _, bt := range builders {
-		wg.Add(1)
-		go func(bt string) {
-			defer wg.Done()
-			result := t.runTests(ctx, bt, info) // have a proper timeout
-			resultsCh <- result
-		}(bt)
-	}
-	wg.Wait()
-	close(resultsCh)
-	results := make([]builderResult, 0, len(builders))
-	for result := range resultsCh {
-		results = append(results, result)
-	}
+// gcsLiveWriter is an extremely hacky way of getting live(ish) updating logs while
+// using GCS. The buffer is written out to an object every interval, and also
+// whenever flushSize bytes have been written since the last write, if
+// flushSize is positive.
+type gcsLiveWriter struct {
+	name  string // bucket/object, for logging
+	write logWriteFunc
+	stop  chan struct{} // closed by Close
+	done  chan struct{} // closed when the flushing goroutine returns
+	flush chan struct{}
+
+	flushSize int
+	written   int // length of the buffer when last written; only used by run
+
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	unflushed int   // bytes written since the last write to obj
+	err       error // why the writer stopped, if it failed
+}
 
-	return results, nil
+// A logWriteFunc stores all of a log, of which the bytes before from have
+// already been stored.
+type logWriteFunc func(all []byte, from int) error
+
+// maxLogWriteFailures is the number of consecutive failed writes of a log
+// to GCS after which the writer gives up.
+const maxLogWriteFailures = 5
+
+// logOptions configure the writing of build logs to GCS.
+type logOptions struct {
+	// flushSize, if positive, is the number of bytes of new output
+	// after which the log is written without waiting for the interval.
+	flushSize int
+	// gzipLevel, if positive, is the level at which logs are stored
+	// compressed, with a gzip Content-Encoding so that they are still
+	// served as text.
+	gzipLevel int
+	// interval is how often the log is written while output arrives.
+	interval time.Duration
+	// append is whether to append new output to the log object, rather
+	// than rewrite the whole object each time. See appendLog.
+	append bool
 }
 
-// commentBeginning send the review message indicating the trybots are beginning.
-func (t *tester) commentBeginning(ctx context.Context, change *gerrit.ChangeInfo) error {
-	// It would be nice to do a similar thing to the coordinator, using comment
-	// threads that can be resolved, but that is slightly more complex than what
-	// we really need to start with.
-	//
-	// Similarly it would be nice to comment links to logs earlier.
-	return t.gerrit.SetReview(ctx, change.ID, change.CurrentRevision, gerrit.ReviewInput{
-		Message: "TryBots beginning",
-	})
+// A logStore stores the objects that make up build logs.
+type logStore interface {
+	// put creates or replaces the object name with contents b.
+	put(ctx context.Context, name string, b []byte) error
+	// compose replaces dst with the concatenation of srcs, which may
+	// include dst, and returns the number of components dst now has.
+	compose(ctx context.Context, dst string, srcs ...string) (components int64, err error)
+	delete(ctx context.Context, name string) error
 }
 
-// commentResults sends the review message containing the results for the change
-// and applies the TryBot-Result label.
-func (t *tester) commentResults(ctx context.Context, change *gerrit.ChangeInfo, results []builderResult) error {
-	state := "succeeded"
-	label := 1
-	buf := new(bytes.Buffer)
-	w := tabwriter.NewWriter(buf, 0, 0, 1, ' ', 0)
-	for _, res := range results {
-		s := "pass"
-		context := res.logURL
-		if res.err != nil {
-			s = "error"
-			state = "failed"
-			label = -1
-			context = res.err.Error()
-		} else if !res.passed {
-			s = "failed"
-			state = "failed"
-			label = -1
-		}
-		fmt.Fprintf(w, "    %s\t[%s]\t%s\n", res.builderType, s, context)
-	}
-	w.Flush()
+// gcsLogStore is a logStore in a GCS bucket.
+type gcsLogStore struct {
+	bucket    *storage.BucketHandle
+	gzipLevel int // see logOptions
+}
 
-	comment := fmt.Sprintf("Tests %s\n\n%s", state, buf.String())
-	if err := t.gerrit.SetReview(ctx, change.ID, change.CurrentRevision, gerrit.ReviewInput{
-		Message: comment,
-		Labels:  map[string]int{"TryBot-Result": label},
-	}); err != nil {
+func (s gcsLogStore) put(ctx context.Context, name string, b []byte) error {
+	w := s.bucket.Object(name).NewWriter(ctx)
+	if s.gzipLevel > 0 {
+		w.ContentType = "text/plain; charset=utf-8"
+		w.ContentEncoding = "gzip"
+		zw, _ := gzip.NewWriterLevel(w, s.gzipLevel)
+		zw.Write(b)
+		zw.Close()
+	} else {
+		w.Write(b)
+	}
+	if err := w.Close(); err != nil {
 		return err
 	}
-
 	return nil
 }
 
-// findChanges queries a gerrit instance for changes which should be tested, returning a
-// slice of revisions for each change.
-func (t *tester) findChanges(ctx context.Context) ([]*gerrit.ChangeInfo, error) {
-	return t.gerrit.QueryChanges(
-		ctx,
-		fmt.Sprintf("project:%s status:open label:Run-TryBot+1 -label:TryBot-Result-1 -label:TryBot-Result+1", t.repo),
-		gerrit.QueryChangesOpt{Fields: []string{"CURRENT_REVISION"}},
-	)
-}
-
-var (
-	username = flag.String("user", "user-security", "Coordinator username")
+func (s gcsLogStore) compose(ctx context.Context, dst string, srcs ...string) (int64, error) {
+	var objs []*storage.ObjectHandle
+	for _, src := range srcs {
+		objs = append(objs, s.bucket.Object(src))
+	}
+	c := s.bucket.Object(dst).ComposerFrom(objs...)
+	if s.gzipLevel > 0 {
+		// The members of a gzip file can be concatenated, so the
+		// result is still one valid gzip file.
+		c.ContentType = "text/plain; charset=utf-8"
+		c.ContentEncoding = "gzip"
+	}
+	attrs, err := c.Run(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return attrs.ComponentCount, nil
+}
+
+func (s gcsLogStore) delete(ctx context.Context, name string) error {
+	return s.bucket.Object(name).Delete(ctx)
+}
+
+// rewriteLog returns a logWriteFunc that stores the whole log in the object
+// name each time, so writing a log of n bytes in pieces uploads O(n²) bytes.
+func rewriteLog(ctx context.Context, store logStore, name string) logWriteFunc {
+	return func(all []byte, from int) error {
+		return store.put(ctx, name, all)
+	}
+}
+
+// maxLogComponents is the number of components at which appendLog rewrites
+// a log rather than appending to it. GCS limits composite objects to 1024.
+const maxLogComponents = 1000
+
+// appendLog returns a logWriteFunc that stores only the new part of the log
+// in a temporary object, and appends it to the object name by composing the
+// two, so that each byte is usually uploaded only once.
+func appendLog(ctx context.Context, store logStore, name string) logWriteFunc {
+	parts := 0
+	components := int64(1)
+	return func(all []byte, from int) error {
+		if from == len(all) {
+			return nil
+		}
+		if components >= maxLogComponents {
+			if err := store.put(ctx, name, all); err != nil {
+				return err
+			}
+			components = 1
+			return nil
+		}
+		parts++
+		part := fmt.Sprintf("%s.part%d", name, parts)
+		if err := store.put(ctx, part, all[from:]); err != nil {
+			return err
+		}
+		defer func() {
+			if err := store.delete(context.WithoutCancel(ctx), part); err != nil {
+				loggerFrom(ctx).errorf("log-part-delete-failed", "deleting log part %q failed: %s", part, err)
+			}
+		}()
+		n, err := store.compose(ctx, name, name, part)
+		if err != nil {
+			return err
+		}
+		components = n
+		return nil
+	}
+}
+
+// newLiveWriter returns a gcsLiveWriter writing to the object name in bucket.
+func newLiveWriter(ctx context.Context, bucket *storage.BucketHandle, name string, opts logOptions) (*gcsLiveWriter, error) {
+	if opts.gzipLevel < 0 || opts.gzipLevel > gzip.BestCompression {
+		return nil, fmt.Errorf("invalid gzip level %d", opts.gzipLevel)
+	}
+	if opts.interval <= 0 {
+		return nil, fmt.Errorf("invalid interval %s", opts.interval)
+	}
+	store := gcsLogStore{bucket, opts.gzipLevel}
+	if err := store.put(ctx, name, []byte{}); err != nil {
+		return nil, err
+	}
+	write := rewriteLog(ctx, store, name)
+	if opts.append {
+		write = appendLog(ctx, store, name)
+	}
+	logName := path.Join(bucket.Object(name).BucketName(), name)
+	return startLiveWriter(ctx, logName, write, opts.flushSize, opts.interval), nil
+}
+
+// startLiveWriter returns a gcsLiveWriter that calls write to store its
+// contents. It stops writing once write has failed
+// maxLogWriteFailures times in a row, and Close reports the failure.
+func startLiveWriter(ctx context.Context, name string, write logWriteFunc, flushSize int, interval time.Duration) *gcsLiveWriter {
+	g := &gcsLiveWriter{
+		name:      name,
+		write:     write,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		flush:     make(chan struct{}, 1),
+		flushSize: flushSize,
+	}
+	go g.run(ctx, interval)
+	return g
+}
+
+// run writes out the buffer periodically until Close is called, or until
+// too many writes in a row have failed.
+func (g *gcsLiveWriter) run(ctx context.Context, interval time.Duration) {
+	defer close(g.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	failures := 0
+	for {
+		select {
+		case <-g.stop:
+			if err := g.writeBuffer(); err != nil {
+				g.fail(err)
+			}
+			return
+		case <-t.C:
+		case <-g.flush:
+		}
+		err := g.writeBuffer()
+		if err == nil {
+			failures = 0
+			continue
+		}
+		failures++
+		loggerFrom(ctx).errorf("log-write-failed", "GCS write to %q failed (%d of %d in a row)! %s", g.name, failures, maxLogWriteFailures, err)
+		if failures >= maxLogWriteFailures {
+			g.fail(fmt.Errorf("giving up after %d failed writes in a row: %w", failures, err))
+			return
+		}
+	}
+}
+
+// writeBuffer writes out everything written to g so far. The buffer is
+// only ever appended to, so the bytes written don't change while g.mu is
+// not held.
+func (g *gcsLiveWriter) writeBuffer() error {
+	g.mu.Lock()
+	b := g.buf.Bytes()
+	g.unflushed = 0
+	g.mu.Unlock()
+	if err := g.write(b, g.written); err != nil {
+		return err
+	}
+	g.written = len(b)
+	return nil
+}
+
+// fail records that g stopped writing because of err.
+func (g *gcsLiveWriter) fail(err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.err = err
+}
+
+func (g *gcsLiveWriter) Write(b []byte) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.err != nil {
+		// Nothing more will be written, so there's no use buffering.
+		// The failure is reported by Close rather than interrupting
+		// the tests.
+		return len(b), nil
+	}
+	g.buf.Write(b)
+	g.unflushed += len(b)
+	if g.flushSize > 0 && g.unflushed >= g.flushSize {
+		select {
+		case g.flush <- struct{}{}:
+		default:
+		}
+	}
+	return len(b), nil
+}
+
+// Close writes out anything not yet written and stops g. It returns the
+// error that stopped g, if any.
+func (g *gcsLiveWriter) Close() error {
+	close(g.stop)
+	<-g.done
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.err
+}
+
+type localWriter struct {
+	buildlet string
+}
+
+func (lw *localWriter) Write(b []byte) (int, error) {
+	prefix := []byte(lw.buildlet + ": ")
+	var prefixed []byte
+	for _, l := range bytes.Split(b, []byte("\n")) {
+		prefixed = append(prefixed, append(prefix, append(l, byte('\n'))...)...)
+	}
+
+	return os.Stdout.Write(prefixed)
+}
+
+// openLocalLog opens the local log file of the tests of revision on
+// builderType, dir/<revision>/<builderType>.txt, creating the directories
+// as needed. The output of retries is appended to the same file.
+func openLocalLog(dir, revision, builderType string) (*os.File, error) {
+	revDir := filepath.Join(dir, sanitizeFilename(revision))
+	if err := os.MkdirAll(revDir, 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(filepath.Join(revDir, sanitizeFilename(builderType)+".txt"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+// sanitizeFilename returns name with the characters that aren't safe in a
+// file name, like path separators, replaced with underscores.
+func sanitizeFilename(name string) string {
+	safe := strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || r == '.' || '0' <= r && r <= '9' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' {
+			return r
+		}
+		return '_'
+	}, name)
+	if strings.Trim(safe, ".") == "" {
+		safe = strings.Repeat("_", len(safe)+1)
+	}
+	return safe
+}
+
+// tailBuffer is a writer that keeps the last max bytes written to it.
+type tailBuffer struct {
+	max       int
+	buf       []byte
+	truncated bool // whether earlier output was discarded
+}
+
+func (tb *tailBuffer) Write(b []byte) (int, error) {
+	tb.buf = append(tb.buf, b...)
+	// Discard old output only once there is plenty of it, rather than
+	// copying the tail on every write.
+	if len(tb.buf) > 2*tb.max {
+		tb.buf = append(tb.buf[:0], tb.buf[len(tb.buf)-tb.max:]...)
+		tb.truncated = true
+	}
+	return len(b), nil
+}
+
+// snippet returns the complete lines among the last max bytes written to
+// tb, indented so that Gerrit shows them as preformatted text rather than
+// interpreting them as Markdown.
+func (tb *tailBuffer) snippet() string {
+	b, truncated := tb.buf, tb.truncated
+	if len(b) > tb.max {
+		b, truncated = b[len(b)-tb.max:], true
+	}
+	if truncated {
+		// Drop the partial first line.
+		_, b, _ = bytes.Cut(b, []byte("\n"))
+	}
+	text := strings.TrimRight(strings.ToValidUTF8(string(b), "\uFFFD"), "\r\n")
+	if strings.TrimSpace(text) == "" {
+		return ""
+	}
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	for i, l := range lines {
+		lines[i] = "    " + l
+	}
+	return strings.Join(lines, "\n")
+}
+
+// readLocalArchive reads the Go source archive at path and checks that it
+// is a valid gzipped tar file.
+func readLocalArchive(path string) ([]byte, error) {
+	archive, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateArchive(archive); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return archive, nil
+}
+
+// validateArchive reports an error if archive isn't a non-empty gzipped tar file.
+func validateArchive(archive []byte) error {
+	_, err := archiveNames(archive)
+	return err
+}
+
+// archiveNames returns the names of the entries of archive, a gzipped tar
+// file, or an error if it is malformed or empty.
+func archiveNames(archive []byte) ([]string, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(zr)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return nil, err
+		}
+		names = append(names, hdr.Name)
+	}
+	if len(names) == 0 {
+		return nil, errors.New("archive is empty")
+	}
+	return names, nil
+}
+
+// validateSourceArchive reports an error if archive, as returned by
+// Gitiles, isn't a gzipped tar file of a source tree: either the main Go
+// repo, which has a top-level src directory, or another repo with a
+// top-level go.mod file. For example, an authentication page that is
+// served gzipped is a valid archive, but not of a source tree.
+func validateSourceArchive(archive []byte) error {
+	names, err := archiveNames(archive)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		name = strings.TrimPrefix(name, "./")
+		if strings.HasPrefix(name, "src/") || name == "go.mod" {
+			return nil
+		}
+	}
+	return fmt.Errorf("archive of %d entries has neither a top-level src directory nor a go.mod file", len(names))
+}
+
+// getTar retrieves the tarball for a specific git revision from t.source and returns
+// the bytes.
+func (t *tester) getTar(revision string) ([]byte, error) {
+	tarURL := t.source + "/" + t.repo + "/+archive/" + revision + ".tar.gz"
+	req, err := http.NewRequest("GET", tarURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %q: %v", tarURL, resp.Status)
+	}
+	defer resp.Body.Close()
+	archive, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check what we got back was actually the archive, since Google's SSO page will
+	// return 200.
+	if err := validateSourceArchive(archive); err != nil {
+		return nil, fmt.Errorf("fetched %q: %v", tarURL, err)
+	}
+
+	return archive, nil
+}
+
+// run tests the specific revision on the builders specified. If the run
+// can't be started, it returns no results and the reason. Otherwise it
+// returns the results of every builder, along with an error joining a
+// *builderError for each builder whose tests couldn't be run, if any.
+func (t *tester) run(ctx context.Context, revision, branch string, builders []string, logStarted func(builderType, logURL string)) ([]builderResult, error) {
+	runID := make([]byte, 4)
+	rand.Read(runID)
+	lg := loggerFrom(ctx).with(logRevision, revision).with(logRunID, fmt.Sprintf("%x", runID))
+	ctx = withLogger(ctx, lg)
+
+	var skipped []builderResult
+	builders = slices.DeleteFunc(slices.Clone(builders), func(bt string) bool {
+		if t.skipBuilders[bt] {
+			skipped = append(skipped, builderResult{builderType: bt, skipped: true})
+			return true
+		}
+		return false
+	})
+	if len(skipped) > 0 {
+		var names []string
+		for _, res := range skipped {
+			names = append(names, res.builderType)
+		}
+		lg.printf("builders-skipped", "skipping builders in -skip-builders: %s", strings.Join(names, ", "))
+	}
+	if len(builders) == 0 {
+		// Report the skipped builders, which fail the run, rather than
+		// returning an error, which would make it be retried every poll.
+		lg.errorf("all-builders-skipped", "all builders are in -skip-builders; not testing %s", revision)
+		return skipped, nil
+	}
+
+	configs, err := resolveBuildConfigs(builders)
+	if err != nil {
+		return nil, err
+	}
+
+	changeArchive := t.localArchive
+	if changeArchive == nil {
+		changeArchive, err = t.getTar(revision)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve change archive: %s", err)
+		}
+	}
+
+	info := &buildInfo{
+		revision:      revision,
+		branch:        branch,
+		configs:       configs,
+		changeArchive: changeArchive,
+		version:       t.version,
+		logStarted:    logStarted,
+	}
+
+	if branch != "master" {
+		goArchive, err := t.getTar("master")
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve go master archive: %s", err)
+		}
+		info.goArchive = goArchive
+	}
+	runCtx := ctx
+	if t.runBudget > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, t.runBudget)
+		defer cancel()
+	}
+	if len(builders) > 1 {
+		t.shareArchives(runCtx, info)
+	}
+
+	start := time.Now()
+	wg := new(sync.WaitGroup)
+	resultsCh := make(chan builderResult, len(builders))
+	var sem chan struct{}
+	if t.maxParallel > 0 {
+		sem = make(chan struct{}, t.maxParallel)
+	}
+	for _, bt := range t.orderBuilders(builders) {
+		// Wait for capacity here rather than in the goroutine, so that
+		// builders start in order.
+		acquired := false
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+				acquired = true
+			case <-runCtx.Done():
+			}
+		}
+		wg.Add(1)
+		go func(bt string) {
+			defer wg.Done()
+			if acquired {
+				defer func() { <-sem }()
+			}
+			started := time.Now()
+			result := t.runTestsWithPolicy(runCtx, bt, info)
+			result.duration = time.Since(started)
+			// Builders that didn't pass because they were cut off by the
+			// run budget are reported as such, rather than as failures.
+			if !result.passed && ctx.Err() == nil && errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+				lg.with(logBuilder, bt).errorf("run-budget-exceeded", "run budget of %s exceeded", t.runBudget)
+				result.err = fmt.Errorf("run budget of %s exceeded", t.runBudget)
+			}
+			resultsCh <- result
+		}(bt)
+	}
+	wg.Wait()
+	close(resultsCh)
+	results := make([]builderResult, 0, len(builders))
+	for result := range resultsCh {
+		results = append(results, result)
+		if result.testTime > 0 {
+			if t.durations == nil {
+				t.durations = make(map[string]time.Duration)
+			}
+			t.durations[result.builderType] = result.testTime
+		}
+	}
+	lg.printf("run-finished", "tested %s on %d builders in %s", revision, len(builders), time.Since(start).Round(time.Second))
+	results = append(results, skipped...)
+
+	return results, builderErrors(results)
+}
+
+// A builderError is the reason the tests couldn't be run on a builder.
+type builderError struct {
+	builderType string
+	err         error
+}
+
+func (e *builderError) Error() string { return e.builderType + ": " + e.err.Error() }
+func (e *builderError) Unwrap() error { return e.err }
+
+// builderErrors returns an error joining a *builderError for each of
+// results whose tests couldn't be run, or nil if there are none. Tests
+// that ran and failed are not errors.
+func builderErrors(results []builderResult) error {
+	var errs []error
+	for _, res := range results {
+		if res.err != nil {
+			errs = append(errs, &builderError{res.builderType, res.err})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Tags of the comments that begin a run and report its results. Like the
+// coordinator, securitybot posts these as a patch set level comment thread,
+// which is resolved when the tests pass.
+const (
+	beginningTag = "autogenerated:securitybot~beginning"
+	logTag       = "autogenerated:securitybot~log"
+	resultsTag   = "autogenerated:securitybot~results"
+)
+
+// patchSetLevel is the path of comments that are on a patch set as a whole,
+// rather than on a file.
+const patchSetLevel = "/PATCHSET_LEVEL"
+
+// commentBeginning starts the comment thread indicating the trybots are
+// beginning, resolving the threads of earlier runs that nobody has replied to.
+func (t *tester) commentBeginning(ctx context.Context, change *gerrit.ChangeInfo) error {
+	unresolved := true
+	review := gerrit.ReviewInput{
+		Tag: beginningTag,
+		Comments: map[string][]gerrit.CommentInput{
+			patchSetLevel: {{Message: "TryBots beginning", Unresolved: &unresolved}},
+		},
+	}
+	if _, ok := t.lastResultVote(change); ok {
+		// This is a re-run, so clear the stale result until there's a new one.
+		review.Labels = map[string]int{"TryBot-Result": 0}
+	}
+	threads, err := t.listThreads(ctx, change)
+	if err != nil {
+		loggerFrom(ctx).errorf("list-comments-failed", "listing comment threads on %s: %v", change.ID, err)
+	}
+	for _, th := range threads {
+		if th.unresolved && th.fromSecuritybot() {
+			resolved := false
+			review.Comments[patchSetLevel] = append(review.Comments[patchSetLevel], gerrit.CommentInput{
+				InReplyTo:  th.root.ID,
+				Message:    "Superseded.",
+				Unresolved: &resolved,
+			})
+		}
+	}
+	return t.setReview(ctx, change, review)
+}
+
+// commentThread is a thread of patch set level comments.
+type commentThread struct {
+	root     gerrit.CommentInfo
+	comments []gerrit.CommentInfo // including root, oldest first
+	// unresolved is whether the thread is unresolved, as set by its last comment.
+	unresolved bool
+}
+
+// fromSecuritybot reports whether all of the comments in th were posted by
+// securitybot, so that it can resolve th without hiding a reviewer's comment.
+func (th *commentThread) fromSecuritybot() bool {
+	for _, c := range th.comments {
+		if !strings.HasPrefix(c.Tag, "autogenerated:securitybot~") {
+			return false
+		}
+	}
+	return true
+}
+
+// listThreads returns the patch set level comment threads on change, in
+// the order they were started.
+func (t *tester) listThreads(ctx context.Context, change *gerrit.ChangeInfo) ([]*commentThread, error) {
+	comments, err := t.gerrit.ListChangeComments(ctx, change.ID)
+	if err != nil {
+		return nil, err
+	}
+	return commentThreads(comments[patchSetLevel]), nil
+}
+
+// commentThreads groups comments into threads, in the order they were
+// started. Replies to comments that aren't in comments are ignored.
+func commentThreads(comments []gerrit.CommentInfo) []*commentThread {
+	// Gerrit doesn't list comments in order, but a thread's resolution is
+	// set by its chronologically last comment.
+	comments = slices.Clone(comments)
+	sort.SliceStable(comments, func(i, j int) bool {
+		return comments[i].Updated.Time().Before(comments[j].Updated.Time())
+	})
+	var threads []*commentThread
+	byID := make(map[string]*commentThread) // thread of each comment ID
+	for _, c := range comments {
+		th := byID[c.InReplyTo]
+		if c.InReplyTo == "" {
+			th = &commentThread{root: c}
+			threads = append(threads, th)
+		} else if th == nil {
+			continue
+		}
+		th.comments = append(th.comments, c)
+		if c.Unresolved != nil {
+			th.unresolved = *c.Unresolved
+		}
+		byID[c.ID] = th
+	}
+	return threads
+}
+
+// resultsThread returns the ID of the comment that began the latest run on
+// change, to reply to with the results, or "" if there is none, in which
+// case the results start a new thread.
+func (t *tester) resultsThread(ctx context.Context, change *gerrit.ChangeInfo) string {
+	threads, err := t.listThreads(ctx, change)
+	if err != nil {
+		loggerFrom(ctx).errorf("list-comments-failed", "listing comment threads on %s: %v", change.ID, err)
+		return ""
+	}
+	for i := len(threads) - 1; i >= 0; i-- {
+		if threads[i].root.Tag == beginningTag {
+			return threads[i].root.ID
+		}
+	}
+	return ""
+}
+
+// commentRejectedBuilders explains on change that the builders in rejected,
+// which were requested by a trybot-builders hashtag, won't be used.
+func (t *tester) commentRejectedBuilders(ctx context.Context, change *gerrit.ChangeInfo, rejected []string) error {
+	var allowed []string
+	for bt := range allowedBuilders {
+		allowed = append(allowed, bt)
+	}
+	sort.Strings(allowed)
+	msg := fmt.Sprintf("Not testing on %s, requested by a %s hashtag: only these builders are allowed for security changes:\n\n    %s",
+		strings.Join(rejected, ", "), strings.TrimSuffix(builderHashtagPrefix, "="), strings.Join(allowed, "\n    "))
+	return t.setReview(ctx, change, gerrit.ReviewInput{Message: msg})
+}
+
+// commentLogLink comments a link to the log of the tests on builderType,
+// so that reviewers can follow them while they run. The link is a reply
+// to thread, the comment that the run began, so that links, which are
+// posted again for each retry, are kept together rather than each being a
+// message of its own. If thread is empty, the link starts a new thread.
+func (t *tester) commentLogLink(ctx context.Context, change *gerrit.ChangeInfo, thread, builderType, logURL string) error {
+	unresolved := true
+	return t.setReview(ctx, change, gerrit.ReviewInput{
+		Tag: logTag,
+		Comments: map[string][]gerrit.CommentInput{
+			patchSetLevel: {{
+				InReplyTo:  thread,
+				Message:    fmt.Sprintf("Tests started on %s: %s", builderType, logURL),
+				Unresolved: &unresolved,
+			}},
+		},
+	})
+}
+
+// setReview posts review on the current revision of change. Reviews of the
+// same change are posted one at a time, so that they can't conflict, but
+// concurrent calls may be applied in any order. Reviews that must be in
+// order, like the beginning and results of a run, are posted one after
+// another by the same goroutine.
+func (t *tester) setReview(ctx context.Context, change *gerrit.ChangeInfo, review gerrit.ReviewInput) error {
+	defer t.changeLocks.lock(change.ID)()
+	return t.gerrit.SetReview(ctx, change.ID, change.CurrentRevision, review)
+}
+
+// changeLocks is a set of mutexes keyed by change ID.
+// The zero value is ready to use.
+type changeLocks struct {
+	mu    sync.Mutex
+	locks map[string]*changeLock
+}
+
+type changeLock struct {
+	sync.Mutex
+	refs int // number of callers holding or waiting for the lock
+}
+
+// lock locks the mutex for the change with the given ID, and returns a
+// function that unlocks it. Mutexes are discarded when no longer in use.
+func (l *changeLocks) lock(id string) (unlock func()) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*changeLock)
+	}
+	m := l.locks[id]
+	if m == nil {
+		m = new(changeLock)
+		l.locks[id] = m
+	}
+	m.refs++
+	l.mu.Unlock()
+
+	m.Lock()
+	return func() {
+		m.Unlock()
+		l.mu.Lock()
+		if m.refs--; m.refs == 0 {
+			delete(l.locks, id)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// anyFailed reports whether any of the builders in results failed or
+// couldn't be tested, even if too few failed to reach the failure threshold.
+// Skipped builders count as untested only if no builder was tested.
+func anyFailed(results []builderResult) bool {
+	tested := false
+	for _, res := range results {
+		if res.skipped {
+			continue
+		}
+		tested = true
+		if res.err != nil || !res.passed {
+			return true
+		}
+	}
+	return !tested
+}
+
+// summarizeResults returns the state of the results ("succeeded", "failed",
+// and so on), whether they warrant a passing TryBot-Result label, and a table
+// of the individual builder results.
+func (t *tester) summarizeResults(results []builderResult) (state string, pass bool, table string) {
+	state = "succeeded"
+	pass = true
+	failures, tested := 0, 0
+	buf := new(bytes.Buffer)
+	w := tabwriter.NewWriter(buf, 0, 0, 1, ' ', 0)
+	for _, res := range results {
+		if res.skipped {
+			fmt.Fprintf(w, "    %s\t[skipped]\t\t%s\n", res.builderType, "known to be broken; not tested")
+			continue
+		}
+		tested++
+		s := "pass"
+		context := res.logURL
+		if res.err != nil {
+			s = "error"
+			failures++
+			context = res.err.Error()
+		} else if !res.passed {
+			s = "failed"
+			failures++
+		}
+		var timing []string
+		if res.duration > 0 {
+			timing = append(timing, fmt.Sprintf("took %s", res.duration.Round(time.Second)))
+		}
+		if res.queueTime > 0 || res.testTime > 0 {
+			timing = append(timing, fmt.Sprintf("queued %s, ran %s", res.queueTime.Round(time.Second), res.testTime.Round(time.Second)))
+		}
+		fmt.Fprintf(w, "    %s\t[%s]\t%s\t%s\n", res.builderType, s, strings.Join(timing, ", "), context)
+	}
+	w.Flush()
+	if tested == 0 {
+		// Nothing was tested, which mustn't be mistaken for a pass.
+		return "not run (all builders were skipped)", false, buf.String()
+	}
+	if failures > 0 {
+		state = "failed"
+		if t.failureThreshold.reached(failures, tested) {
+			pass = false
+		} else {
+			state = "failed (below the failure threshold)"
+		}
+	}
+	return state, pass, buf.String()
+}
+
+// commentResults replies to the thread begun by commentBeginning with the
+// results for the change, resolving it if the tests passed, and applies the
+// TryBot-Result label.
+func (t *tester) commentResults(ctx context.Context, change *gerrit.ChangeInfo, revision string, results []builderResult) error {
+	state, pass, table := t.summarizeResults(results)
+	if pass && t.requireHistory {
+		parent := parentRevision(change, revision)
+		if parent == "" {
+			pass = false
+			state = "failed (unable to determine the parent revision to check builder history)"
+		} else {
+			untested, err := parentUntested(ctx, t.history, parent, results, func(builders []string) ([]builderResult, error) {
+				return t.run(ctx, parent, change.Branch, builders, nil)
+			})
+			if err != nil {
+				return err
+			}
+			if len(untested) > 0 {
+				pass = false
+				state = fmt.Sprintf("failed (no successful run at parent %s on %s)", parent, strings.Join(untested, ", "))
+			}
+		}
+	}
+	label := t.failLabel
+	if pass {
+		label = t.passLabel
+	}
+	if err := checkLabelValue(change, "TryBot-Result", label); err != nil {
+		return err
+	}
+	comment := fmt.Sprintf("Tests %s\n\n%s", state, table)
+	if t.skipTests != "" {
+		comment = fmt.Sprintf("%s\nTests matching %q were skipped.\n", comment, t.skipTests)
+	}
+	comment += snippets(results, maxSnippetsBytes)
+	// In single-comment mode, the run didn't begin a thread, so the
+	// latest one is that of an earlier run.
+	inReplyTo := ""
+	if !t.singleComment {
+		inReplyTo = t.resultsThread(ctx, change)
+	}
+	unresolved := !pass
+	review := gerrit.ReviewInput{
+		Tag: resultsTag,
+		Comments: map[string][]gerrit.CommentInput{
+			patchSetLevel: {{
+				InReplyTo:  inReplyTo,
+				Unresolved: &unresolved,
+			}},
+		},
+	}
+	if revision == change.CurrentRevision {
+		review.Labels = map[string]int{"TryBot-Result": label}
+	} else {
+		// Reviews are posted on the current patch set, which wasn't
+		// tested, so only the message is posted.
+		comment = fmt.Sprintf("Tested pinned patch set %d (%s), not the current patch set, so no TryBot-Result vote is applied.\n\n%s", change.Revisions[revision].PatchSetNumber, revision, comment)
+	}
+	review.Comments[patchSetLevel][0].Message = comment
+	return t.setReview(ctx, change, review)
+}
+
+// maxSnippetsBytes is the maximum total size of the output snippets in a
+// results comment, which keeps it well within Gerrit's limit on the size of
+// comments however many builders fail.
+const maxSnippetsBytes = 10 << 10
+
+// snippets returns the output snippets of results to append to the
+// results comment. Once the snippets would exceed budget bytes in total,
+// the rest are omitted, with a note saying on which builders.
+func snippets(results []builderResult, budget int) string {
+	var b strings.Builder
+	var omitted []string
+	for _, res := range results {
+		if res.snippet == "" {
+			continue
+		}
+		s := fmt.Sprintf("\nEnd of the output on %s:\n\n%s\n", res.builderType, res.snippet)
+		if len(omitted) > 0 || b.Len()+len(s) > budget {
+			omitted = append(omitted, res.builderType)
+			continue
+		}
+		b.WriteString(s)
+	}
+	if len(omitted) > 0 {
+		fmt.Fprintf(&b, "\nThe output on %s is omitted to keep this comment short; see the logs.\n", strings.Join(omitted, ", "))
+	}
+	return b.String()
+}
+
+// checkLabelValue reports an error if change's label does not allow value.
+// If the allowed values of the label are not known, no error is reported.
+func checkLabelValue(change *gerrit.ChangeInfo, label string, value int) error {
+	values := change.Labels[label].Values
+	if len(values) == 0 {
+		return nil
+	}
+	for v := range values {
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && n == value {
+			return nil
+		}
+	}
+	return fmt.Errorf("value %d is not allowed for label %s on change %d", value, label, change.ChangeNumber)
+}
+
+// sinceFilter is a limit on how long ago the changes that are tested were
+// last updated: either a duration before each query, or a fixed time.
+// The zero value is no limit.
+type sinceFilter struct {
+	d time.Duration
+	t time.Time
+}
+
+// parseSince parses s, which is either a positive duration ("24h"), a
+// date ("2024-03-01"), or a time in RFC 3339 format. It returns the zero
+// sinceFilter if s is empty.
+func parseSince(s string) (sinceFilter, error) {
+	if s == "" {
+		return sinceFilter{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		if d <= 0 {
+			return sinceFilter{}, fmt.Errorf("duration %q must be positive", s)
+		}
+		return sinceFilter{d: d}, nil
+	}
+	for _, layout := range []string{time.DateOnly, time.RFC3339} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return sinceFilter{t: t}, nil
+		}
+	}
+	return sinceFilter{}, fmt.Errorf("%q is not a duration, a date, or an RFC 3339 time", s)
+}
+
+// after returns the time after which changes must have been updated to be
+// tested, as of now, or the zero time if there is no limit.
+func (f sinceFilter) after(now time.Time) time.Time {
+	if f.d != 0 {
+		return now.Add(-f.d)
+	}
+	return f.t
+}
+
+// changesQuery returns the Gerrit query for the open changes in repo that
+// have been voted Run-TryBot+1, limited to those updated after after
+// unless it is zero.
+func changesQuery(repo string, after time.Time) string {
+	q := fmt.Sprintf("project:%s status:open label:Run-TryBot+1", repo)
+	if !after.IsZero() {
+		q += fmt.Sprintf(` after:"%s"`, after.UTC().Format("2006-01-02 15:04:05 -0700"))
+	}
+	return q
+}
+
+// findChanges queries a gerrit instance for changes which should be tested, returning a
+// slice of revisions for each change.
+func (t *tester) findChanges(ctx context.Context) ([]*gerrit.ChangeInfo, error) {
+	fields := []string{"CURRENT_REVISION", "CURRENT_COMMIT", "DETAILED_LABELS"}
+	if len(t.pins) > 0 {
+		// Pinned revisions may be any patch set.
+		fields = append(fields, "ALL_REVISIONS", "ALL_COMMITS")
+	}
+	// Hashtags, which can request extra builders, are always included.
+	// Changes that already have a result are included so that re-runs,
+	// which the query can't distinguish, can be found by needsTesting.
+	changes, err := t.gerrit.QueryChanges(
+		ctx,
+		changesQuery(t.repo, t.since.after(time.Now())),
+		gerrit.QueryChangesOpt{Fields: fields},
+	)
+	if err != nil {
+		return nil, err
+	}
+	var found []*gerrit.ChangeInfo
+	for _, change := range changes {
+		if t.needsTesting(change) {
+			found = append(found, change)
+		}
+	}
+	return found, nil
+}
+
+// needsTesting reports whether change needs to be tested: either it has
+// no TryBot-Result vote, or it has been voted Run-TryBot+1 since its last
+// TryBot-Result vote, which is how reviewers ask for the tests to be run
+// again.
+func (t *tester) needsTesting(change *gerrit.ChangeInfo) bool {
+	result, ok := t.lastResultVote(change)
+	if !ok {
+		return true
+	}
+	run, ok := lastVote(change, "Run-TryBot", func(v int) bool { return v > 0 })
+	return ok && run.After(result)
+}
+
+// lastResultVote returns the time of the last vote applying one of the
+// TryBot-Result values used for results to change, if any.
+func (t *tester) lastResultVote(change *gerrit.ChangeInfo) (time.Time, bool) {
+	return lastVote(change, "TryBot-Result", func(v int) bool { return v == t.passLabel || v == t.failLabel })
+}
+
+// lastVote returns the time of the last vote on change's label with a
+// value for which match returns true, if any. It requires DETAILED_LABELS.
+func lastVote(change *gerrit.ChangeInfo, label string, match func(int) bool) (time.Time, bool) {
+	var last time.Time
+	found := false
+	for _, v := range change.Labels[label].All {
+		if match(v.Value) && (!found || v.Date.Time().After(last)) {
+			last, found = v.Date.Time(), true
+		}
+	}
+	return last, found
+}
+
+var (
+	username        = flag.String("user", "user-security", "Coordinator username")
+	coordinatorAddr = flag.String("coordinator", "build.golang.org:443", "Address (host:port) of the coordinator GRPC server")
 
 	gerritURL = flag.String("gerrit", "https://team-review.googlesource.com", "URL for the gerrit instance")
 	sourceURL = flag.String("source", "https://team.googlesource.com", "URL for the source instance")
 	repoName  = flag.String("repo", "golang/go-private", "Gerrit repository name")
 
+	sinceStr = flag.String("since", "", "In polling mode, only test changes updated within this duration of each poll (like 24h) or since this date (like 2024-03-01 or 2024-03-01T15:04:05Z), such as to skip a backlog after downtime (empty means all changes)")
+
 	gcsBucket = flag.String("gcs", "", "GCS bucket path for logs")
 
-	revision    = flag.String("revision", "", "Revision to test, when running in one-shot mode")
-	buildersStr = flag.String("builders", "", "Comma separated list of builder types to test against by default")
+	localLogDir = flag.String("local-log-dir", "", "Also write each builder's output to <dir>/<revision>/<builder>.txt, alongside GCS or standard output")
+
+	logBufferSize = flag.Int("log-buffer-size", 0, "Write a build log to GCS early once this many bytes of new output are buffered, rather than waiting for the next periodic write every -log-interval; lower values reduce log latency at the cost of more GCS writes (0 means only write periodically)")
+	logInterval   = flag.Duration("log-interval", 5*time.Second, "How often to write a build log to GCS while tests are running")
+	logAppend     = flag.Bool("log-append", false, "Append new output to build logs in GCS, uploading it as a separate object that is composed onto the log, rather than rewriting the whole log each time; this uploads much less for long logs")
+	logGzipLevel  = flag.Int("log-gzip-level", 0, "gzip compression level, from 1 (fastest) to 9 (smallest), for build logs written to GCS; compression saves storage at the cost of CPU (0 means store logs uncompressed)")
+
+	revision     = flag.String("revision", "", "Revision to test, or comma-separated revisions to test one after another, when running in one-shot mode")
+	localArchive = flag.String("local-archive", "", "Path to a gzipped tar archive of Go source to test in one-shot mode instead of fetching -revision from -source; -revision, if set, only labels the results")
+	versionStr   = flag.String("version", "", "In one-shot mode, with a single -revision or -local-archive, content of the go/VERSION file written on the builders, overriding the version derived from the branch being tested: \"goX.Y-devel_<revision>\" for a release-branch.goX.Y, otherwise \"devel <revision>\"")
+	buildersStr  = flag.String("builders", "", "Comma separated list of builder types to test against, in addition to those of -profile")
+	profile      = flag.String("profile", "", "Comma separated list of builder profiles to test against: \"firstclass\", or one defined in -builder-config (default \"firstclass\" if -builders is not set)")
+
+	skipBuildersStr = flag.String("skip-builders", "", "Comma separated list of builder types not to test on, such as ones known to be broken; results comments list them as skipped")
+
+	runBudget      = flag.Duration("run-budget", 0, "Maximum wall-clock time for testing a revision across all builders; builders still running are cancelled (0 means no limit)")
+	requireHistory = flag.Bool("require-parent-history", false, "Fail changes unless every builder has passed at the parent revision, first testing the parent on builders with no recorded history there (requires -gcs)")
+
+	singleComment = flag.Bool("single-comment", false, "Post only the results of each run, in a new comment thread, instead of also commenting when tests begin and linking to each log; Gerrit doesn't allow comments to be edited, so no comment is updated as the run progresses")
+
+	logFormat  = flag.String("log-format", "text", "Format of log output: text, or json for one JSON object per event with fields such as builder, change, revision, and run-id")
+	logEnv     = flag.Bool("log-env", false, "Log the command and environment (with secrets redacted) used to run the tests on each builder")
+	listenAddr = flag.String("listen", "", "Address (host:port) on which to serve GET /status, and POST /pause and /resume to pause and resume polling for changes, which SIGUSR1 also toggles; these are unauthenticated, so if host is empty only localhost is served (empty means don't listen)")
+	selfTest   = flag.Bool("selftest", false, "Check access to Gerrit, the source host, the coordinator, and GCS (if -gcs is set), creating and destroying a buildlet and a GCS object, then exit; the exit status is non-zero if any check fails")
+	dryRun     = flag.Bool("dry-run", false, "Find the changes to test and log the builders each would be tested on, without creating buildlets or commenting on changes")
+	jsonOut    = flag.String("json", "", "With -revision, write the results as JSON to this file, or to stdout if it is -")
+	reportOnly = flag.Bool("report-only", false, "Run tests and print the results locally, without ever commenting on or voting for changes; with -revision, the exit status is non-zero if any builder failed, regardless of -failure-threshold")
+
+	passLabelValue = flag.Int("pass-label-value", 1, "TryBot-Result label value applied to changes that pass")
+	failLabelValue = flag.Int("fail-label-value", -1, "TryBot-Result label value applied to changes that fail")
+
+	skipTests     = flag.String("skip-tests", "", "Skip the tests matching this regular expression, as with go test -skip, for example to work around a known failure unrelated to the change; results comments note the pattern")
+	snippetBytes  = flag.Int("snippet-bytes", 0, "Include up to this many bytes from the end of the output of failed tests in the results comment, so reviewers see the failure without opening the log; the output of all builders together is limited to 10 KB, to stay within Gerrit's limit on the size of comments (0 means no output is included)")
+	createRetries = flag.Int("create-retries", 4, "Number of times to retry creating a buildlet after a transient failure, such as exhausted quota or an unavailable coordinator")
+	createBackoff = flag.Duration("create-backoff", 30*time.Second, "How long to wait before the first retry of creating a buildlet; the wait doubles for each later retry")
+
+	destroyOrphans   = flag.Bool("destroy-orphans", false, "In polling mode, destroy all buildlets of -user, assuming they were left behind by a previous run, such as one that crashed, before testing any changes; only enable this if nothing else creates buildlets as -user (ignored with -report-only and -dry-run)")
+	stateFile        = flag.String("state-file", "", "In polling mode, path of a file recording the changes whose tests have begun, so that after a restart, changes being tested aren't commented on again when their tests begin again (empty means only remember them until securitybot exits)")
+	livenessInterval = flag.Duration("liveness-interval", time.Minute, "How often to check that a buildlet still exists while tests run on it, so that tests on a preempted buildlet are stopped promptly rather than timing out (0 disables the check)")
+
+	maxParallel  = flag.Int("max-parallel", 8, "Maximum number of builders to test a revision on at once, which keeps a run from requesting more buildlets at once than the quota allows (0 means no limit)")
+	builderOrder = flag.String("builder-order", "config", "Order in which to start builders, which matters when -max-parallel limits how many run at once: config (the order of -profile and -builders), random, or slowest-first (by the duration of their last run, or an estimate)")
+
+	allowedBuildersPath = flag.String("allowed-builders", "", "Path to a JSON array of the builder types allowed for testing security changes, replacing the built-in set; -builders, profiles, and trybot-builders hashtags may only use these")
+
+	builderConfigPath = flag.String("builder-config", "", "Path to a JSON file of builder profiles and per-builder overrides of -retries, -builder-timeout, and -skip-bootstrap")
+	retries           = flag.Int("retries", 0, "Number of times to retry a builder's tests after they fail, unless overridden by -builder-config")
+	builderTimeout    = flag.Duration("builder-timeout", 0, "Maximum duration of one attempt at running a builder's tests, unless overridden by -builder-config (0 means no limit)")
+	skipBootstrap     = flag.Bool("skip-bootstrap", false, "Don't upload the bootstrap toolchain to buildlets, for builder images that already include one, unless overridden by -builder-config")
+
+	pins            = make(pinnedRevisions)
+	bootstrapSHA256 = make(bootstrapChecksums)
+
+	failureThresholdStr = flag.String("failure-threshold", "1", "Number (e.g. 2) or percentage (e.g. 25%) of failed builders required to apply TryBot-Result-1")
 )
 
 // allowedBuilders contains the set of builders which are acceptable to use for testing
 // PRIVATE track security changes. These builders should, generally, be controlled by
-// Google.
+// Google. If -allowed-builders is set, the set is replaced by the builders in that
+// file before any builders are selected.
 var allowedBuilders = map[string]bool{
 	"js-wasm": true,
 
@@ -499,8 +2115,9 @@ var allowedBuilders = map[string]bool{
 	"windows-arm64-11":   true,
 }
 
-// firstClassBuilders is the default set of builders to test against,
-// representing the first class ports as defined by the port policy.
+// firstClassBuilders is the default set of builders to test against, the
+// "firstclass" profile, representing the first class ports as defined by
+// the port policy.
 var firstClassBuilders = []string{
 	"linux-386",
 	"linux-amd64-longtest-race",
@@ -514,25 +2131,175 @@ var firstClassBuilders = []string{
 	"windows-amd64-longtest",
 }
 
+// validateHostPort reports an error if addr is not of the form host:port.
+func validateHostPort(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("missing host in %q", addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("invalid port in %q", addr)
+	}
+	return nil
+}
+
+func init() {
+	flag.Var(bootstrapSHA256, "bootstrap-sha256", "Download the bootstrap toolchain at a URL and check its SHA-256 checksum before giving it to buildlets, failing builders that use it if the checksum doesn't match; of the form url=sha256 (may be repeated)")
+	flag.Var(pins, "pin", "Test the given revision of a change instead of its current revision, in polling mode; of the form change:revision, where revision is a patch set number or commit ID; the results are commented without a TryBot-Result vote, which would apply to the current revision (may be repeated)")
+}
+
 func main() {
 	flag.Parse()
-	ctx, cancel := context.WithCancel(context.Background())
+	if err := validateHostPort(*coordinatorAddr); err != nil {
+		log.Fatalf("invalid -coordinator address: %v", err)
+	}
+	threshold, err := parseFailureThreshold(*failureThresholdStr)
+	if err != nil {
+		log.Fatalf("invalid -failure-threshold: %v", err)
+	}
+	if *runBudget < 0 {
+		log.Fatalf("-run-budget must not be negative")
+	}
+	if *requireHistory && *gcsBucket == "" {
+		log.Fatalf("-require-parent-history requires -gcs")
+	}
+	if *passLabelValue <= 0 {
+		log.Fatalf("-pass-label-value must be positive, got %d", *passLabelValue)
+	}
+	if *failLabelValue >= 0 {
+		log.Fatalf("-fail-label-value must be negative, got %d", *failLabelValue)
+	}
+	if *logBufferSize < 0 {
+		log.Fatalf("-log-buffer-size must not be negative")
+	}
+	if *logInterval <= 0 {
+		log.Fatalf("-log-interval must be positive")
+	}
+	if *logGzipLevel < 0 || *logGzipLevel > gzip.BestCompression {
+		log.Fatalf("-log-gzip-level must be in the range [0, %d]", gzip.BestCompression)
+	}
+	since, err := parseSince(*sinceStr)
+	if err != nil {
+		log.Fatalf("invalid -since: %v", err)
+	}
+	revisions, err := parseRevisions(*revision)
+	if err != nil {
+		log.Fatalf("invalid -revision: %v", err)
+	}
+	if len(revisions) > 1 && *localArchive != "" {
+		log.Fatalf("-local-archive tests a single revision, but -revision lists %d", len(revisions))
+	}
+	if *versionStr != "" && *revision == "" && *localArchive == "" {
+		log.Fatalf("-version requires -revision or -local-archive: in polling mode, changes on different branches need different versions")
+	}
+	if len(revisions) > 1 && *versionStr != "" {
+		log.Fatalf("-version applies to a single revision, but -revision lists %d", len(revisions))
+	}
+	var localArchiveData []byte
+	if *localArchive != "" {
+		localArchiveData, err = readLocalArchive(*localArchive)
+		if err != nil {
+			log.Fatalf("invalid -local-archive: %v", err)
+		}
+		if *revision == "" {
+			*revision = "local"
+			revisions = []string{"local"}
+		}
+	}
+	skipBuilders := make(map[string]bool)
+	if *skipBuildersStr != "" {
+		for _, bt := range strings.Split(*skipBuildersStr, ",") {
+			if _, ok := dashboard.Builders[bt]; !ok {
+				log.Fatalf("invalid -skip-builders: %s: unknown builder type", bt)
+			}
+			skipBuilders[bt] = true
+		}
+	}
+	if *snippetBytes < 0 {
+		log.Fatalf("-snippet-bytes must not be negative")
+	}
+	if *retries < 0 {
+		log.Fatalf("-retries must not be negative")
+	}
+	if *builderTimeout < 0 {
+		log.Fatalf("-builder-timeout must not be negative")
+	}
+	if *skipTests != "" {
+		if _, err := regexp.Compile(*skipTests); err != nil {
+			log.Fatalf("invalid -skip-tests: %v", err)
+		}
+		// GOFLAGS is split at spaces.
+		if strings.ContainsAny(*skipTests, " \t\n") {
+			log.Fatalf("invalid -skip-tests: pattern must not contain spaces")
+		}
+	}
+	if *createRetries < 0 {
+		log.Fatalf("-create-retries must not be negative")
+	}
+	if *createBackoff < 0 {
+		log.Fatalf("-create-backoff must not be negative")
+	}
+	if *livenessInterval < 0 {
+		log.Fatalf("-liveness-interval must not be negative")
+	}
+	if *listenAddr != "" {
+		*listenAddr, err = listenAddress(*listenAddr)
+		if err != nil {
+			log.Fatalf("invalid -listen: %v", err)
+		}
+	}
+	if *maxParallel < 0 {
+		log.Fatalf("-max-parallel must not be negative")
+	}
+	if !slices.Contains(builderOrders, *builderOrder) {
+		log.Fatalf("invalid -builder-order %q: want one of %s", *builderOrder, strings.Join(builderOrders, ", "))
+	}
+	if *jsonOut != "" && *revision == "" {
+		log.Fatalf("-json requires -revision")
+	}
+	lg, err := newLogger(*logFormat)
+	if err != nil {
+		log.Fatalf("invalid -log-format: %v", err)
+	}
+	if *allowedBuildersPath != "" {
+		allowedBuilders, err = loadAllowedBuilders(*allowedBuildersPath)
+		if err != nil {
+			log.Fatalf("invalid -allowed-builders: %v", err)
+		}
+	}
+	defaultPolicy := builderPolicy{retries: *retries, timeout: *builderTimeout, skipBootstrap: *skipBootstrap}
+	cfg, err := loadBuilderConfig(*builderConfigPath, defaultPolicy)
+	if err != nil {
+		log.Fatalf("invalid -builder-config: %v", err)
+	}
+	builders, err := cfg.selectBuilders(*buildersStr, *profile)
+	if err != nil {
+		log.Fatalf("invalid builder selection: %v", err)
+	}
+	ctx, cancel := context.WithCancel(withLogger(context.Background(), lg))
 
 	// When kubernetes attempts to kill a workload (i.e. during a restart or
 	// rollout) it sends a SIGTERM, followed by a SIGKILL after a specified
 	// timeout. In order to cleanly shutdown the service, as well as destroying
 	// any created buildlets etc, cancel the global context we pass around,
-	// which should cascade down.
+	// which should cascade down. SIGINT, as from ^C when running by hand, is
+	// handled the same way; a second signal exits immediately.
 	sigtermChan := make(chan os.Signal, 1)
-	signal.Notify(sigtermChan, syscall.SIGTERM)
+	signal.Notify(sigtermChan, syscall.SIGTERM, os.Interrupt)
 	go func() {
-		<-sigtermChan
+		sig := <-sigtermChan
+		lg.printf("shutting-down", "received %s; shutting down once running tests are stopped and their buildlets destroyed", sig)
 		// Cancelling the context should cause the program to exit, either via
-		// a error leading to a log.Fatalf, or the select loop hitting ctx.Done.
-		// TODO(roland): we may want to make the shutdown somewhat more graceful,
-		// perhaps commenting that the current run was aborted if we are in the
-		// middle of one, but for now just exiting cleanly is better than nothing.
+		// a error leading to a log.Fatalf, or the polling loop noticing that
+		// ctx is done. Runs that are cut off aren't reported; with
+		// -state-file, their changes are tested again after a restart
+		// without commenting again that tests are beginning.
 		cancel()
+		sig = <-sigtermChan
+		lg.fatalf("shutdown-aborted", "received %s again; exiting without cleaning up", sig)
 	}()
 
 	creds, err := google.FindDefaultCredentials(ctx, gerrit.OAuth2Scopes...)
@@ -542,19 +2309,6 @@ func main() {
 	gerritClient := gerrit.NewClient(*gerritURL, gerrit.OAuth2Auth(creds.TokenSource))
 	httpClient := oauth2.NewClient(ctx, creds.TokenSource)
 
-	var builders []string
-	if *buildersStr != "" {
-		for _, b := range strings.Split(*buildersStr, ",") {
-			if !allowedBuilders[b] {
-				log.Fatalf("builder type %q not allowed", b)
-			}
-			builders = append(builders, b)
-		}
-
-	} else {
-		builders = firstClassBuilders
-	}
-
 	var gcsClient *storage.Client
 	if *gcsBucket != "" {
 		gcsClient, err = storage.NewClient(ctx)
@@ -563,7 +2317,7 @@ func main() {
 		}
 	}
 
-	cc, err := iapclient.GRPCClient(ctx, "build.golang.org:443")
+	cc, err := iapclient.GRPCClient(ctx, *coordinatorAddr)
 	if err != nil {
 		log.Fatalf("Could not connect to coordinator: %v", err)
 	}
@@ -578,13 +2332,142 @@ func main() {
 		http:        httpClient,
 		gcs:         gcsClient,
 		gerrit:      gerritClient,
+
+		failureThreshold: threshold,
+		since:            since,
+		runBudget:        *runBudget,
+		requireHistory:   *requireHistory,
+		logEnv:           *logEnv,
+		localArchive:     localArchiveData,
+		version:          *versionStr,
+		localLogDir:      *localLogDir,
+		logOptions:       logOptions{flushSize: *logBufferSize, gzipLevel: *logGzipLevel, interval: *logInterval, append: *logAppend},
+		livenessInterval: *livenessInterval,
+		skipTests:        *skipTests,
+		skipBuilders:     skipBuilders,
+		singleComment:    *singleComment,
+		snippetBytes:     *snippetBytes,
+		createRetries:    *createRetries,
+		createBackoff:    *createBackoff,
+		maxParallel:      *maxParallel,
+		builderOrder:     *builderOrder,
+		passLabel:        *passLabelValue,
+		failLabel:        *failLabelValue,
+		pins:             pins,
+		bootstrapSHA256:  bootstrapSHA256,
+		policies:         cfg.policies,
+		defaultPolicy:    defaultPolicy,
 	}
 
+	if gcsClient != nil {
+		t.history = gcsHistoryStore{gcsClient.Bucket(*gcsBucket)}
+	}
+	// A local archive's revision is only a label, so it has no history.
+	if t.history != nil && t.localArchive == nil {
+		t.sinks = append(t.sinks, historySink{t})
+	}
+	if *reportOnly {
+		t.sinks = append(t.sinks, textSink{t, os.Stdout})
+	} else if *revision == "" {
+		t.sinks = append(t.sinks, gerritSink{t})
+	}
+	// The results of several revisions are written together, once all have
+	// been tested.
+	if *jsonOut != "" && !strings.Contains(*revision, ",") {
+		t.sinks = append(t.sinks, jsonSink{t, *jsonOut})
+	}
+
+	if *selfTest {
+		if !runSelfChecks(ctx, os.Stdout, t.selfChecks()) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *revision != "" && *dryRun {
+		lg.printf("dry-run", "would test %s on %s", strings.Join(revisions, ", "), strings.Join(builders, ", "))
+		return
+	}
 	if *revision != "" {
-		if _, err := t.run(ctx, *revision, "", builders); err != nil {
+		// A local archive is a complete Go source tree, so it needs no
+		// archive of the main repo to be tested with.
+		branch := ""
+		if t.localArchive != nil {
+			branch = "master"
+		}
+		var (
+			errs       []error
+			allResults []Results
+			summary    strings.Builder
+			failed     bool
+		)
+		for _, rev := range revisions {
+			if ctx.Err() != nil {
+				break
+			}
+			results, err := t.run(ctx, rev, branch, builders, nil)
+			if results == nil {
+				errs = append(errs, fmt.Errorf("%s: %w", rev, err))
+				fmt.Fprintf(&summary, "%s: not tested: %v\n", rev, err)
+				continue
+			}
+			// The builders that couldn't run have already been logged,
+			// and are reported as errors in the results.
+			if err := t.report(ctx, testedChange{revision: rev}, results); err != nil {
+				errs = append(errs, err)
+			}
+			state, _, _ := t.summarizeResults(results)
+			failed = failed || anyFailed(results)
+			fmt.Fprintf(&summary, "%s: tests %s\n", rev, state)
+			allResults = append(allResults, t.newResults(rev, results))
+		}
+		if strings.Contains(*revision, ",") {
+			lg.printf("summary", "results of %d revisions:\n%s", len(revisions), summary.String())
+			if *jsonOut != "" {
+				if err := writeJSON(*jsonOut, allResults); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+		if err := errors.Join(errs...); err != nil {
 			log.Fatal(err)
 		}
+		// Unlike the TryBot-Result vote, the exit status doesn't
+		// depend on -failure-threshold: any failure is reported.
+		if *reportOnly && failed {
+			os.Exit(1)
+		}
 	} else {
+		// In report-only and dry-run modes, and for pinned revisions, no
+		// TryBot-Result label is applied, so findChanges keeps returning
+		// the same changes.
+		// Remember the revisions already tested so that they aren't
+		// tested again.
+		reported := make(map[string]bool)
+		if *destroyOrphans && !*dryRun && !*reportOnly {
+			t.destroyOrphanedBuildlets(ctx)
+		}
+		state, err := loadRunState(*stateFile)
+		if err != nil {
+			log.Fatalf("invalid -state-file: %v", err)
+		}
+		for change, rev := range pins {
+			lg.with(logChange, change).printf("pinned", "WARNING: CL %d is pinned to %s and will not be tested at its current revision", change, rev)
+		}
+		var pause pauseState
+		usr1 := make(chan os.Signal, 1)
+		signal.Notify(usr1, syscall.SIGUSR1)
+		go func() {
+			for range usr1 {
+				logPauseChange(lg, pause.toggle(), "SIGUSR1")
+			}
+		}()
+		if *listenAddr != "" {
+			go func() {
+				err := http.ListenAndServe(*listenAddr, pause.handler(lg))
+				lg.fatalf("listen-failed", "serving on %s failed: %v", *listenAddr, err)
+			}()
+		}
 		ticker := time.NewTicker(time.Minute)
 		for {
 			select {
@@ -592,23 +2475,99 @@ func main() {
 			case <-ctx.Done():
 				return
 			}
+			if pause.isPaused() {
+				continue
+			}
+			// Errors are logged rather than fatal, so that one failure,
+			// like a Gerrit hiccup, doesn't stop securitybot. Changes that
+			// weren't finished are found and tried again by a later poll.
 			changes, err := t.findChanges(ctx)
 			if err != nil {
-				log.Fatalf("findChanges failed: %v", err)
+				lg.errorf("find-changes-failed", "findChanges failed: %v", err)
+				continue
 			}
-			log.Printf("found %d changes", len(changes))
+			lg.printf("found-changes", "found %d changes", len(changes))
 
 			for _, change := range changes {
-				log.Printf("testing CL %d patchset %d (%s)", change.ChangeNumber, change.Revisions[change.CurrentRevision].PatchSetNumber, change.CurrentRevision)
-				if err := t.commentBeginning(ctx, change); err != nil {
-					log.Fatalf("commentBeginning failed: %v", err)
+				if pause.isPaused() || ctx.Err() != nil {
+					// The remaining changes are found again after resuming,
+					// or restarting.
+					break
 				}
-				results, err := t.run(ctx, change.CurrentRevision, change.Branch, builders)
+				lg := lg.with(logChange, change.ChangeNumber)
+				rev, pinned, err := pins.resolve(change)
 				if err != nil {
-					log.Fatalf("run failed: %v", err)
+					lg.errorf("pin-failed", "WARNING: skipping pinned change: %v", err)
+					continue
+				}
+				if (*reportOnly || *dryRun || pinned) && reported[rev] {
+					continue
+				}
+				builders, rejected := hashtagBuilders(change.Hashtags, builders)
+				if len(rejected) > 0 {
+					lg.errorf("builders-rejected", "WARNING: not testing on requested builders that aren't allowed: %s", strings.Join(rejected, ", "))
+					if !*reportOnly && !*dryRun {
+						if err := t.commentRejectedBuilders(ctx, change, rejected); err != nil {
+							lg.errorf("comment-failed", "commentRejectedBuilders failed: %v", err)
+						}
+					}
+				}
+				if *dryRun {
+					lg.printf("dry-run", "would test CL %d patchset %d (%s) on %s", change.ChangeNumber, change.Revisions[rev].PatchSetNumber, rev, strings.Join(builders, ", "))
+					reported[rev] = true
+					continue
+				}
+				if pinned {
+					lg.printf("testing-pinned", "WARNING: testing CL %d at PINNED patchset %d (%s); current patchset is %d", change.ChangeNumber, change.Revisions[rev].PatchSetNumber, rev, change.Revisions[change.CurrentRevision].PatchSetNumber)
+				} else {
+					lg.printf("testing", "testing CL %d patchset %d (%s)", change.ChangeNumber, change.Revisions[rev].PatchSetNumber, rev)
+				}
+				// Gerrit doesn't allow published messages to be edited, so
+				// in single-comment mode the only message is the results.
+				if state.begun(rev) {
+					lg.printf("testing-resumed", "tests of %s already began; not commenting again", rev)
+				} else {
+					if !*reportOnly && !*singleComment {
+						if err := t.commentBeginning(ctx, change); err != nil {
+							lg.errorf("comment-failed", "commentBeginning failed: %v", err)
+							continue
+						}
+					}
+					if err := state.begin(change.ChangeNumber, rev); err != nil {
+						lg.errorf("state-failed", "recording that tests began failed: %v", err)
+					}
+				}
+				// Link to each log as soon as it exists, in the thread the
+				// run began, unless only one message is wanted.
+				var logStarted func(builderType, logURL string)
+				if !*reportOnly && !*singleComment {
+					thread := t.resultsThread(ctx, change)
+					logStarted = func(builderType, logURL string) {
+						if err := t.commentLogLink(ctx, change, thread, builderType, logURL); err != nil {
+							lg.with(logBuilder, builderType).errorf("comment-failed", "commentLogLink failed: %v", err)
+						}
+					}
+				}
+				results, err := t.run(withLogger(ctx, lg), rev, change.Branch, builders, logStarted)
+				if ctx.Err() != nil {
+					lg.printf("run-interrupted", "shutting down; not reporting the interrupted tests of %s", rev)
+					return
+				}
+				if results == nil {
+					lg.errorf("run-failed", "run failed: %v", err)
+					continue
+				}
+				if err := t.report(ctx, testedChange{change, rev}, results); err != nil {
+					lg.errorf("report-failed", "reporting results failed: %v", err)
+					continue
+				}
+				if err := state.finish(rev); err != nil {
+					lg.errorf("state-failed", "recording that results were reported failed: %v", err)
 				}
-				if err := t.commentResults(ctx, change, results); err != nil {
-					log.Fatalf("commentResults failed: %v", err)
+				// Pinned revisions aren't voted on, so, like in report-only
+				// mode, findChanges keeps returning them.
+				if *reportOnly || pinned {
+					reported[rev] = true
 				}
 			}
 		}
@@ -0,0 +1,1605 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/build/buildlet"
+	"golang.org/x/build/gerrit"
+	"golang.org/x/build/internal/gomote/protos"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFailureThreshold(t *testing.T) {
+	for _, tc := range []struct {
+		threshold       string
+		failures, total int
+		want            bool
+	}{
+		{"1", 0, 8, false},
+		{"1", 1, 8, true},
+		{"2", 1, 8, false},
+		{"2", 2, 8, true},
+		{"25%", 1, 8, false},
+		{"25%", 2, 8, true},
+		{"100%", 7, 8, false},
+		{"100%", 8, 8, true},
+	} {
+		ft, err := parseFailureThreshold(tc.threshold)
+		if err != nil {
+			t.Fatalf("parseFailureThreshold(%q): %v", tc.threshold, err)
+		}
+		if got := ft.reached(tc.failures, tc.total); got != tc.want {
+			t.Errorf("threshold %s: reached(%d, %d) = %t, want %t", tc.threshold, tc.failures, tc.total, got, tc.want)
+		}
+	}
+	for _, bad := range []string{"", "0", "-1", "x", "0%", "101%", "%"} {
+		if _, err := parseFailureThreshold(bad); err == nil {
+			t.Errorf("parseFailureThreshold(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestRedactEnv(t *testing.T) {
+	env := []string{
+		"GOOS=linux",
+		"GO_BUILDER_NAME=linux-amd64",
+		"GITHUB_TOKEN=abc",
+		"aws_secret_access_key=xyz",
+		"NOVALUE",
+	}
+	want := []string{
+		"GOOS=linux",
+		"GO_BUILDER_NAME=linux-amd64",
+		"GITHUB_TOKEN=<redacted>",
+		"aws_secret_access_key=<redacted>",
+		"NOVALUE",
+	}
+	if got := redactEnv(env); !slices.Equal(got, want) {
+		t.Errorf("redactEnv:\ngot  %q\nwant %q", got, want)
+	}
+}
+
+func TestSkipTestsEnv(t *testing.T) {
+	for _, tc := range []struct {
+		env, want []string
+	}{
+		{[]string{"GOOS=linux"}, []string{"GOOS=linux", "GOFLAGS=-skip=TestFoo|TestBar"}},
+		{[]string{"GOFLAGS=-mod=mod", "GOOS=linux"}, []string{"GOFLAGS=-mod=mod -skip=TestFoo|TestBar", "GOOS=linux"}},
+		{[]string{"GOFLAGS="}, []string{"GOFLAGS=-skip=TestFoo|TestBar"}},
+	} {
+		env := slices.Clone(tc.env)
+		if got := skipTestsEnv(env, "TestFoo|TestBar"); !slices.Equal(got, tc.want) {
+			t.Errorf("skipTestsEnv(%q) = %q, want %q", tc.env, got, tc.want)
+		}
+		if !slices.Equal(env, tc.env) {
+			t.Errorf("skipTestsEnv modified its argument: %q", env)
+		}
+	}
+}
+
+func TestParseBuilderConfig(t *testing.T) {
+	defaults := builderPolicy{retries: 1, timeout: time.Hour}
+	cfg, err := parseBuilderConfig(strings.NewReader(`{
+		"builders": {
+			"linux-amd64": {"retries": 3},
+			"linux-386": {"timeout": "90m", "skipBootstrap": true},
+			"linux-arm64": {"retries": 0, "timeout": "2h"}
+		},
+		"profiles": {
+			"linux-only": ["linux-386", "linux-amd64"]
+		}
+	}`), defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]builderPolicy{
+		"linux-amd64": {retries: 3, timeout: time.Hour},
+		"linux-386":   {retries: 1, timeout: 90 * time.Minute, skipBootstrap: true},
+		"linux-arm64": {retries: 0, timeout: 2 * time.Hour},
+	}
+	if !maps.Equal(cfg.policies, want) {
+		t.Errorf("parseBuilderConfig policies = %v, want %v", cfg.policies, want)
+	}
+	if got, want := cfg.profiles["linux-only"], []string{"linux-386", "linux-amd64"}; !slices.Equal(got, want) {
+		t.Errorf("profile linux-only = %q, want %q", got, want)
+	}
+	if got := cfg.profiles[defaultProfile]; !slices.Equal(got, firstClassBuilders) {
+		t.Errorf("profile %s = %q, want %q", defaultProfile, got, firstClassBuilders)
+	}
+	tr := &tester{policies: cfg.policies, defaultPolicy: defaults}
+	if got := tr.policy("darwin-arm64-12"); got != defaults {
+		t.Errorf("policy for unconfigured builder = %v, want %v", got, defaults)
+	}
+
+	for _, bad := range []string{
+		`{"builders": {"no-such-builder": {"retries": 1}}}`,
+		`{"builders": {"linux-amd64": {"retries": -1}}}`,
+		`{"builders": {"linux-amd64": {"timeout": "forever"}}}`,
+		`{"builders": {"linux-amd64": {"timeout": "-1h"}}}`,
+		`{"builders": {"linux-amd64": {"retry": 1}}}`,
+		`{"profiles": {"Bad Name": ["linux-amd64"]}}`,
+		`{"profiles": {"firstclass": ["linux-amd64"]}}`,
+		`{"profiles": {"empty": []}}`,
+		`{"profiles": {"disallowed": ["freebsd-amd64-13_0"]}}`,
+		`{"linux-amd64": {"retries": 1}}`,
+		`[]`,
+	} {
+		if _, err := parseBuilderConfig(strings.NewReader(bad), defaults); err == nil {
+			t.Errorf("parseBuilderConfig(%s) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestSelectBuilders(t *testing.T) {
+	cfg := &builderConfig{profiles: map[string][]string{
+		defaultProfile: firstClassBuilders,
+		"linux-only":   {"linux-386", "linux-amd64"},
+		"windows-only": {"windows-386-2012", "windows-amd64-2016"},
+	}}
+	for _, tc := range []struct {
+		builders, profiles string
+		want               []string
+		wantErr            bool
+	}{
+		{want: firstClassBuilders},
+		{profiles: "linux-only", want: []string{"linux-386", "linux-amd64"}},
+		{builders: "js-wasm", want: []string{"js-wasm"}},
+		{
+			builders: "linux-amd64,js-wasm",
+			profiles: "linux-only,windows-only",
+			want:     []string{"linux-386", "linux-amd64", "windows-386-2012", "windows-amd64-2016", "js-wasm"},
+		},
+		{profiles: "no-such-profile", wantErr: true},
+		{builders: "plan9-386", wantErr: true},
+	} {
+		got, err := cfg.selectBuilders(tc.builders, tc.profiles)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("selectBuilders(%q, %q) error = %v, want error %t", tc.builders, tc.profiles, err, tc.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("selectBuilders(%q, %q) = %q, want %q", tc.builders, tc.profiles, got, tc.want)
+		}
+	}
+}
+
+func TestParseAllowedBuilders(t *testing.T) {
+	allowed, err := parseAllowedBuilders(strings.NewReader(`["linux-amd64", "linux-amd64-race"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]bool{"linux-amd64": true, "linux-amd64-race": true}; !maps.Equal(allowed, want) {
+		t.Errorf("parseAllowedBuilders = %v, want %v", allowed, want)
+	}
+	for _, bad := range []string{
+		`[]`,
+		`{"linux-amd64": true}`,
+		`["linux-amd64", "plan10-amd64"]`,
+	} {
+		if _, err := parseAllowedBuilders(strings.NewReader(bad)); err == nil {
+			t.Errorf("parseAllowedBuilders(%s) succeeded, want error", bad)
+		}
+	}
+
+	// Builders are selected from the loaded set instead of the built-in one.
+	defer func(old map[string]bool) { allowedBuilders = old }(allowedBuilders)
+	allowedBuilders = allowed
+	cfg := &builderConfig{profiles: builtinProfiles}
+	if got, err := cfg.selectBuilders("linux-amd64-race", ""); err != nil || !slices.Equal(got, []string{"linux-amd64-race"}) {
+		t.Errorf("selectBuilders(linux-amd64-race) with loaded set = %q, %v; want [linux-amd64-race], nil", got, err)
+	}
+	if _, err := cfg.selectBuilders("js-wasm", ""); err == nil {
+		t.Errorf("selectBuilders(js-wasm) with loaded set succeeded, want error")
+	}
+}
+
+func TestResolveBuildConfigs(t *testing.T) {
+	configs, err := resolveBuildConfigs([]string{"linux-amd64", "linux-386"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 2 || configs["linux-amd64"].Name != "linux-amd64" || configs["linux-386"].Name != "linux-386" {
+		t.Errorf("resolveBuildConfigs = %v, want configs of linux-amd64 and linux-386", configs)
+	}
+
+	_, err = resolveBuildConfigs([]string{"linux-amd64", "plan10-amd64", "linux-386", "linux-z80"})
+	if err == nil {
+		t.Fatal("resolveBuildConfigs succeeded with unknown builders")
+	}
+	want := "plan10-amd64: unknown builder type\nlinux-z80: unknown builder type"
+	if err.Error() != want {
+		t.Errorf("resolveBuildConfigs error:\n%v\nwant:\n%s", err, want)
+	}
+}
+
+func TestHashtagBuilders(t *testing.T) {
+	defaults := []string{"linux-amd64", "linux-386"}
+	for _, tc := range []struct {
+		hashtags      []string
+		want, rejects []string
+	}{
+		{nil, defaults, nil},
+		{[]string{"security", "trybot-builders=windows-amd64-2016, linux-amd64"}, []string{"linux-amd64", "linux-386", "windows-amd64-2016"}, nil},
+		{[]string{"trybot-builders=linux-riscv64,linux-386-longtest", "trybot-builders=linux-riscv64,plan9-z80"}, []string{"linux-amd64", "linux-386", "linux-386-longtest"}, []string{"linux-riscv64", "plan9-z80"}},
+	} {
+		got, rejects := hashtagBuilders(tc.hashtags, defaults)
+		if !slices.Equal(got, tc.want) || !slices.Equal(rejects, tc.rejects) {
+			t.Errorf("hashtagBuilders(%q) = %q, %q, want %q, %q", tc.hashtags, got, rejects, tc.want, tc.rejects)
+		}
+	}
+	if want := []string{"linux-amd64", "linux-386"}; !slices.Equal(defaults, want) {
+		t.Errorf("hashtagBuilders modified defaults: %q", defaults)
+	}
+}
+
+func TestPinnedRevisions(t *testing.T) {
+	pins := make(pinnedRevisions)
+	for _, s := range []string{"100:2", "200:abc", "300:def"} {
+		if err := pins.Set(s); err != nil {
+			t.Fatalf("Set(%q): %v", s, err)
+		}
+	}
+	for _, bad := range []string{"", "100", "x:1", "0:1", "100:", "100:3"} {
+		if err := pins.Set(bad); err == nil {
+			t.Errorf("Set(%q) succeeded, want error", bad)
+		}
+	}
+
+	revs := map[string]gerrit.RevisionInfo{
+		"abc111": {PatchSetNumber: 1},
+		"abc222": {PatchSetNumber: 2},
+		"def333": {PatchSetNumber: 3},
+	}
+	for _, tc := range []struct {
+		change     int
+		want       string
+		wantPinned bool
+		wantErr    bool
+	}{
+		{change: 1, want: "def333"},
+		{change: 100, want: "abc222", wantPinned: true},
+		{change: 200, wantErr: true}, // ambiguous
+		{change: 300, want: "def333", wantPinned: true},
+	} {
+		change := &gerrit.ChangeInfo{ChangeNumber: tc.change, CurrentRevision: "def333", Revisions: revs}
+		got, pinned, err := pins.resolve(change)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("CL %d: resolve error = %v, want error %t", tc.change, err, tc.wantErr)
+			continue
+		}
+		if got != tc.want || pinned != tc.wantPinned {
+			t.Errorf("CL %d: resolve = %q, %t; want %q, %t", tc.change, got, pinned, tc.want, tc.wantPinned)
+		}
+	}
+}
+
+type recordingSink struct {
+	changes []testedChange
+	results [][]builderResult
+}
+
+func (s *recordingSink) Report(ctx context.Context, change testedChange, results []builderResult) error {
+	s.changes = append(s.changes, change)
+	s.results = append(s.results, results)
+	return nil
+}
+
+type failingSink struct{ err error }
+
+func (s failingSink) Report(context.Context, testedChange, []builderResult) error { return s.err }
+
+func TestReport(t *testing.T) {
+	results := []builderResult{
+		{builderType: "linux-amd64", passed: true, logURL: "https://example.com/log", queueTime: 90 * time.Second, testTime: time.Hour},
+		{builderType: "linux-386", err: errors.New("failed to create buildlet")},
+	}
+	change := testedChange{&gerrit.ChangeInfo{ChangeNumber: 1234}, "abc123"}
+	failure := errors.New("sink unavailable")
+	r1, r2, text := new(recordingSink), new(recordingSink), new(strings.Builder)
+	tr := &tester{failureThreshold: failureThreshold{count: 1}}
+	tr.sinks = []ResultSink{r1, failingSink{failure}, nopSink{}, textSink{tr, text}, r2}
+
+	if err := tr.report(context.Background(), change, results); !errors.Is(err, failure) {
+		t.Errorf("report error = %v, want %v", err, failure)
+	}
+	for i, r := range []*recordingSink{r1, r2} {
+		if len(r.changes) != 1 || r.changes[0] != change || !slices.Equal(r.results[0], results) {
+			t.Errorf("sink %d received %v %v, want [%v] [%v]", i, r.changes, r.results, change, results)
+		}
+	}
+	want := "CL 1234 (abc123): tests failed\n\n" +
+		"    linux-amd64 [pass]  queued 1m30s, ran 1h0m0s https://example.com/log\n" +
+		"    linux-386   [error]                          failed to create buildlet\n\n"
+	if got := text.String(); got != want {
+		t.Errorf("textSink wrote:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSummarizeResultsTiming(t *testing.T) {
+	tr := &tester{failureThreshold: failureThreshold{count: 1}}
+	_, _, table := tr.summarizeResults([]builderResult{
+		{builderType: "linux-amd64", passed: true, logURL: "https://example.com/log", duration: 62 * time.Minute, queueTime: 90 * time.Second, testTime: time.Hour},
+		{builderType: "linux-386", passed: true, logURL: "https://example.com/log2", duration: 20 * time.Minute},
+	})
+	want := "    linux-amd64 [pass] took 1h2m0s, queued 1m30s, ran 1h0m0s https://example.com/log\n" +
+		"    linux-386   [pass] took 20m0s                            https://example.com/log2\n"
+	if table != want {
+		t.Errorf("summarizeResults table:\n%s\nwant:\n%s", table, want)
+	}
+}
+
+func TestAnyFailed(t *testing.T) {
+	pass := builderResult{builderType: "linux-amd64", passed: true}
+	fail := builderResult{builderType: "linux-386"}
+	broken := builderResult{builderType: "linux-arm64", err: errors.New("no buildlet")}
+	skipped := builderResult{builderType: "windows-arm64-11", skipped: true}
+	for _, tc := range []struct {
+		results []builderResult
+		want    bool
+	}{
+		{[]builderResult{pass, skipped}, false},
+		{[]builderResult{pass, fail}, true},
+		{[]builderResult{pass, broken}, true},
+		{[]builderResult{skipped}, true},
+	} {
+		if got := anyFailed(tc.results); got != tc.want {
+			t.Errorf("anyFailed(%v) = %t, want %t", tc.results, got, tc.want)
+		}
+	}
+	// Below the threshold the change passes, but a failure is still a failure.
+	tr := &tester{failureThreshold: failureThreshold{count: 2}}
+	if _, pass, _ := tr.summarizeResults([]builderResult{pass, fail}); !pass {
+		t.Error("summarizeResults with a failure below the threshold didn't pass")
+	}
+}
+
+func TestSkippedBuilders(t *testing.T) {
+	tr := &tester{
+		failureThreshold: failureThreshold{percent: 50},
+		skipBuilders:     map[string]bool{"linux-arm64": true, "windows-arm64-11": true},
+	}
+	results := []builderResult{
+		{builderType: "linux-amd64", passed: true, logURL: "https://example.com/log"},
+		{builderType: "linux-386", logURL: "https://example.com/log2"},
+		{builderType: "linux-arm64", skipped: true},
+		{builderType: "windows-arm64-11", skipped: true},
+	}
+	// Skipped builders don't count toward the failure threshold.
+	state, pass, table := tr.summarizeResults(results)
+	if state != "failed" || pass {
+		t.Errorf("summarizeResults = %q, %t, want \"failed\", false", state, pass)
+	}
+	for _, bt := range []string{"linux-arm64", "windows-arm64-11"} {
+		if !regexp.MustCompile(bt + ` +\[skipped\]`).MatchString(table) {
+			t.Errorf("results table doesn't list %s as skipped:\n%s", bt, table)
+		}
+	}
+
+	// A run with only skipped builders is reported once, as failed,
+	// rather than being an error that is retried.
+	results, err := tr.run(context.Background(), "abc123", "master", []string{"windows-arm64-11", "linux-arm64"}, nil)
+	if err != nil || len(results) != 2 {
+		t.Fatalf("run with only skipped builders = %v, %v, want 2 skipped results", results, err)
+	}
+	if state, pass, _ := tr.summarizeResults(results); pass || !strings.Contains(state, "skipped") {
+		t.Errorf("summarizeResults with only skipped builders = %q, %t, want not passed", state, pass)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	lg := logger{slog.New(slog.NewJSONHandler(&buf, nil))}
+	lg.with(logChange, 1234).with(logBuilder, "linux-amd64").errorf("tests-failed", "tests failed: %s", "exit status 1")
+	var event map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &event); err != nil {
+		t.Fatalf("unmarshaling %q: %v", buf.String(), err)
+	}
+	for k, want := range map[string]any{
+		"level":   "ERROR",
+		"msg":     "tests failed: exit status 1",
+		"event":   "tests-failed",
+		"builder": "linux-amd64",
+		"change":  1234.0,
+	} {
+		if event[k] != want {
+			t.Errorf("JSON field %s = %v, want %v", k, event[k], want)
+		}
+	}
+
+	buf.Reset()
+	defer func(w io.Writer, flags int) { log.SetOutput(w); log.SetFlags(flags) }(log.Writer(), log.Flags())
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	lg, err := newLogger("text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lg.with(logRevision, "abc").printf("run-finished", "tested abc")
+	lg.with(logBuilder, "linux-amd64").printf("tests-passed", "tests succeeded")
+	if got, want := buf.String(), "tested abc\nlinux-amd64: tests succeeded\n"; got != want {
+		t.Errorf("text log = %q, want %q", got, want)
+	}
+
+	if _, err := newLogger("xml"); err == nil {
+		t.Errorf("newLogger(%q) succeeded, want error", "xml")
+	}
+}
+
+// tgz returns a gzipped tar file of files, each containing its own name.
+func tgz(files ...string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for _, name := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(name))})
+		tw.Write([]byte(name))
+	}
+	tw.Close()
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestValidateArchive(t *testing.T) {
+	if err := validateArchive(tgz("go/VERSION", "go/src/all.bash")); err != nil {
+		t.Errorf("valid archive: %v", err)
+	}
+	valid := tgz("go/VERSION")
+	for name, archive := range map[string][]byte{
+		"empty":     tgz(),
+		"not gzip":  []byte("<html>Sign in</html>"),
+		"truncated": valid[:len(valid)/2],
+	} {
+		if err := validateArchive(archive); err == nil {
+			t.Errorf("%s archive: got nil, want error", name)
+		}
+	}
+}
+
+func TestVersionFile(t *testing.T) {
+	for _, tc := range []struct {
+		revision, branch, version string
+		want                      string
+	}{
+		{"abc123", "master", "", "devel abc123"},
+		{"local", "master", "go1.22.3", "go1.22.3"},
+		{"abc123", "release-branch.go1.22", "", "go1.22-devel_abc123"},
+		{"abc123", "release-branch.go1.22", "go1.22.3", "go1.22.3"},
+		{"abc123", "release-branch.go1.22-security", "", "devel abc123"},
+		{"abc123", "net", "", "devel abc123"},
+	} {
+		info := &buildInfo{revision: tc.revision, branch: tc.branch, version: tc.version}
+		if got := info.versionFile(); got != tc.want {
+			t.Errorf("versionFile() with revision %q, branch %q, version %q = %q, want %q", tc.revision, tc.branch, tc.version, got, tc.want)
+		}
+	}
+}
+
+func TestValidateSourceArchive(t *testing.T) {
+	for name, archive := range map[string][]byte{
+		"go":      tgz("VERSION", "src/all.bash", "src/runtime/proc.go"),
+		"dot go":  tgz("./src/all.bash"),
+		"subrepo": tgz("go.mod", "ssh/client.go"),
+	} {
+		if err := validateSourceArchive(archive); err != nil {
+			t.Errorf("%s archive: %v", name, err)
+		}
+	}
+	for name, archive := range map[string][]byte{
+		"prefixed": tgz("go/VERSION", "go/src/all.bash"),
+		"html":     tgz("index.html"),
+		"nested":   tgz("x/go.mod"),
+		"empty":    tgz(),
+	} {
+		if err := validateSourceArchive(archive); err == nil {
+			t.Errorf("%s archive: got nil, want error", name)
+		}
+	}
+}
+
+func TestGetTar(t *testing.T) {
+	// A sign-in page served gzipped is valid gzip, but not a tar file of a
+	// source tree.
+	var signIn bytes.Buffer
+	zw := gzip.NewWriter(&signIn)
+	zw.Write([]byte("<html>Sign in to continue</html>"))
+	zw.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/golang/go-private/+archive/good.tar.gz":
+			w.Write(tgz("src/all.bash"))
+		case "/golang/go-private/+archive/signin.tar.gz":
+			w.Write(signIn.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	tr := &tester{source: srv.URL, repo: "golang/go-private", http: srv.Client()}
+	if _, err := tr.getTar("good"); err != nil {
+		t.Errorf("getTar(good): %v", err)
+	}
+	for _, rev := range []string{"signin", "missing"} {
+		if _, err := tr.getTar(rev); err == nil {
+			t.Errorf("getTar(%s) succeeded, want error", rev)
+		}
+	}
+}
+
+// fakeGomoteClient is a GomoteServiceClient reporting that the instances
+// in alive exist and that all others don't.
+type fakeGomoteClient struct {
+	protos.GomoteServiceClient
+	alive map[string]bool
+}
+
+func (c fakeGomoteClient) ListInstances(ctx context.Context, req *protos.ListInstancesRequest, opts ...grpc.CallOption) (*protos.ListInstancesResponse, error) {
+	resp := &protos.ListInstancesResponse{}
+	for name := range c.alive {
+		resp.Instances = append(resp.Instances, &protos.Instance{GomoteId: name})
+	}
+	return resp, nil
+}
+
+func (c fakeGomoteClient) DestroyInstance(ctx context.Context, req *protos.DestroyInstanceRequest, opts ...grpc.CallOption) (*protos.DestroyInstanceResponse, error) {
+	if !c.alive[req.GetGomoteId()] {
+		return nil, status.Errorf(codes.NotFound, "instance %q not found", req.GetGomoteId())
+	}
+	delete(c.alive, req.GetGomoteId())
+	return &protos.DestroyInstanceResponse{}, nil
+}
+
+func (c fakeGomoteClient) InstanceAlive(ctx context.Context, req *protos.InstanceAliveRequest, opts ...grpc.CallOption) (*protos.InstanceAliveResponse, error) {
+	if !c.alive[req.GetGomoteId()] {
+		return nil, status.Errorf(codes.NotFound, "instance %q not found", req.GetGomoteId())
+	}
+	return &protos.InstanceAliveResponse{}, nil
+}
+
+func TestBuilderErrors(t *testing.T) {
+	if err := builderErrors([]builderResult{{builderType: "linux-amd64", passed: true}, {builderType: "linux-386"}}); err != nil {
+		t.Errorf("builderErrors with no errors = %v, want nil", err)
+	}
+	results := []builderResult{
+		{builderType: "linux-amd64", passed: true},
+		{builderType: "linux-386", err: fmt.Errorf("%w during tests", errBuildletLost)},
+		{builderType: "windows-amd64-2016", err: errors.New("failed to create buildlet")},
+	}
+	err := builderErrors(results)
+	if want := "linux-386: buildlet went away during tests\nwindows-amd64-2016: failed to create buildlet"; err == nil || err.Error() != want {
+		t.Fatalf("builderErrors = %v, want %q", err, want)
+	}
+	if !errors.Is(err, errBuildletLost) {
+		t.Errorf("builderErrors = %v, want it to wrap %v", err, errBuildletLost)
+	}
+	var be *builderError
+	if !errors.As(err, &be) || be.builderType != "linux-386" {
+		t.Errorf("errors.As(%v) = %v, want the error of linux-386", err, be)
+	}
+}
+
+func TestJSONSink(t *testing.T) {
+	results := []builderResult{
+		{builderType: "linux-amd64", passed: true, logURL: "https://example.com/log", duration: 90 * time.Second},
+		{builderType: "linux-386", err: errors.New("failed to create buildlet"), duration: time.Second},
+	}
+	file := filepath.Join(t.TempDir(), "results.json")
+	tr := &tester{failureThreshold: failureThreshold{count: 1}}
+	if err := (jsonSink{tr, file}).Report(context.Background(), testedChange{revision: "abc123"}, results); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"revision": "abc123",
+		"passed":   false,
+		"builders": []any{
+			map[string]any{"builderType": "linux-386", "succeeded": false, "error": "failed to create buildlet", "duration": 1.0},
+			map[string]any{"builderType": "linux-amd64", "succeeded": true, "logURL": "https://example.com/log", "duration": 90.0},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("jsonSink wrote:\n%s\nwant %v", data, want)
+	}
+}
+
+func TestBuildletLost(t *testing.T) {
+	tr := &tester{coordinator: &buildlet.GRPCCoordinatorClient{
+		Client: fakeGomoteClient{alive: map[string]bool{"alive": true}},
+	}}
+	if tr.buildletLost(context.Background(), "alive") {
+		t.Error("buildletLost(alive) = true, want false")
+	}
+	if !tr.buildletLost(context.Background(), "preempted") {
+		t.Error("buildletLost(preempted) = false, want true")
+	}
+}
+
+func TestDestroyOrphanedBuildlets(t *testing.T) {
+	alive := map[string]bool{"user-security-linux-amd64-0": true, "user-security-windows-amd64-0": true}
+	tr := &tester{coordinator: &buildlet.GRPCCoordinatorClient{
+		Client: fakeGomoteClient{alive: alive},
+	}}
+	tr.destroyOrphanedBuildlets(context.Background())
+	if len(alive) != 0 {
+		t.Errorf("buildlets %v still exist, want all destroyed", alive)
+	}
+}
+
+func TestWatchBuildlet(t *testing.T) {
+	tr := &tester{coordinator: &buildlet.GRPCCoordinatorClient{
+		Client: fakeGomoteClient{alive: map[string]bool{"alive": true}},
+	}}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	go tr.watchBuildlet(ctx, "preempted", time.Millisecond, cancel)
+	select {
+	case <-ctx.Done():
+		if cause := context.Cause(ctx); cause != errBuildletLost {
+			t.Errorf("cause = %v, want %v", cause, errBuildletLost)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("context not cancelled after buildlet went away")
+	}
+
+	ctx, cancel = context.WithCancelCause(context.Background())
+	done := make(chan bool)
+	go func() {
+		tr.watchBuildlet(ctx, "alive", time.Millisecond, cancel)
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if ctx.Err() != nil {
+		t.Errorf("context cancelled while buildlet alive: %v", context.Cause(ctx))
+	}
+	cancel(nil)
+	<-done
+}
+
+func TestRunSelfChecks(t *testing.T) {
+	var ran []string
+	check := func(name string, err error) selfCheck {
+		return selfCheck{name, func(context.Context) error {
+			ran = append(ran, name)
+			return err
+		}}
+	}
+	var buf bytes.Buffer
+	ok := runSelfChecks(context.Background(), &buf, []selfCheck{
+		check("gerrit", nil),
+		check("coordinator", errors.New("permission denied")),
+		check("gcs", nil),
+	})
+	if ok {
+		t.Error("runSelfChecks = true, want false")
+	}
+	if want := []string{"gerrit", "coordinator", "gcs"}; !slices.Equal(ran, want) {
+		t.Errorf("ran %v, want %v", ran, want)
+	}
+	if want := "ok   gerrit\nFAIL coordinator: permission denied\nok   gcs\n"; buf.String() != want {
+		t.Errorf("output:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	buf.Reset()
+	if !runSelfChecks(context.Background(), &buf, []selfCheck{check("gerrit", nil)}) {
+		t.Error("runSelfChecks = false, want true")
+	}
+}
+
+func TestCommentLogLink(t *testing.T) {
+	var got gerrit.ReviewInput
+	var gotPath string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&got)
+		io.WriteString(w, ")]}'\n{}")
+	}))
+	defer srv.Close()
+
+	tr := &tester{gerrit: gerrit.NewClient(srv.URL, gerrit.NoAuth)}
+	change := &gerrit.ChangeInfo{ID: "go-private~master~I1", CurrentRevision: "aaaa"}
+	if err := tr.commentLogLink(context.Background(), change, "begin1", "linux-amd64", "https://storage.cloud.google.com/logs/aaaa-01020304/linux-amd64"); err != nil {
+		t.Fatal(err)
+	}
+	comments := got.Comments["/PATCHSET_LEVEL"]
+	if len(comments) != 1 || got.Message != "" {
+		t.Fatalf("posted review %+v, want a single comment and no message", got)
+	}
+	if want := "Tests started on linux-amd64: https://storage.cloud.google.com/logs/aaaa-01020304/linux-amd64"; comments[0].Message != want {
+		t.Errorf("posted comment %q, want %q", comments[0].Message, want)
+	}
+	if comments[0].InReplyTo != "begin1" {
+		t.Errorf("posted comment in reply to %q, want the run's thread, begin1", comments[0].InReplyTo)
+	}
+	if len(got.Labels) != 0 {
+		t.Errorf("posted labels %v, want none", got.Labels)
+	}
+	if want := "/changes/go-private~master~I1/revisions/aaaa/review"; gotPath != want {
+		t.Errorf("posted to %s, want %s", gotPath, want)
+	}
+}
+
+func TestSinceQuery(t *testing.T) {
+	now := time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		since string
+		want  string
+	}{
+		{"", `project:go status:open label:Run-TryBot+1`},
+		{"24h", `project:go status:open label:Run-TryBot+1 after:"2024-03-01 12:00:00 +0000"`},
+		{"2024-02-01", `project:go status:open label:Run-TryBot+1 after:"2024-02-01 00:00:00 +0000"`},
+		{"2024-02-01T15:04:05+01:00", `project:go status:open label:Run-TryBot+1 after:"2024-02-01 14:04:05 +0000"`},
+	} {
+		f, err := parseSince(tc.since)
+		if err != nil {
+			t.Errorf("parseSince(%q): %v", tc.since, err)
+			continue
+		}
+		if got := changesQuery("go", f.after(now)); got != tc.want {
+			t.Errorf("-since=%q: query %q, want %q", tc.since, got, tc.want)
+		}
+	}
+	for _, since := range []string{"0s", "-1h", "yesterday", "2024-13-01"} {
+		if _, err := parseSince(since); err == nil {
+			t.Errorf("parseSince(%q) succeeded, want error", since)
+		}
+	}
+}
+
+func TestCommentResultsPinned(t *testing.T) {
+	var got gerrit.ReviewInput
+	var gotPath string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			io.WriteString(w, ")]}'\n{}")
+			return
+		}
+		gotPath = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&got)
+		io.WriteString(w, ")]}'\n{}")
+	}))
+	defer srv.Close()
+
+	tr := &tester{
+		gerrit:           gerrit.NewClient(srv.URL, gerrit.NoAuth),
+		failureThreshold: failureThreshold{count: 1},
+		passLabel:        1,
+		failLabel:        -1,
+	}
+	change := &gerrit.ChangeInfo{
+		ID:              "go-private~master~I1",
+		CurrentRevision: "bbbb",
+		Revisions: map[string]gerrit.RevisionInfo{
+			"aaaa": {PatchSetNumber: 1},
+			"bbbb": {PatchSetNumber: 2},
+		},
+	}
+	if err := tr.commentResults(context.Background(), change, "aaaa", []builderResult{{builderType: "linux-amd64", passed: true}}); err != nil {
+		t.Fatal(err)
+	}
+	// The review is posted on the current patch set, which wasn't tested.
+	if want := "/changes/go-private~master~I1/revisions/bbbb/review"; gotPath != want {
+		t.Errorf("posted to %s, want %s", gotPath, want)
+	}
+	if len(got.Labels) != 0 {
+		t.Errorf("posted labels %v for a pinned patch set, want none", got.Labels)
+	}
+	comments := got.Comments["/PATCHSET_LEVEL"]
+	if len(comments) != 1 || !strings.Contains(comments[0].Message, "pinned patch set 1 (aaaa)") {
+		t.Errorf("posted comments %+v, want one noting the pinned patch set", comments)
+	}
+}
+
+func TestParseRevisions(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"abc123", []string{"abc123"}},
+		{"abc123,def456,789abc", []string{"abc123", "def456", "789abc"}},
+	} {
+		got, err := parseRevisions(tc.in)
+		if err != nil || !slices.Equal(got, tc.want) {
+			t.Errorf("parseRevisions(%q) = %q, %v, want %q", tc.in, got, err, tc.want)
+		}
+	}
+	for _, in := range []string{",", "abc123,", "abc123,,def456", "abc123,def456,abc123"} {
+		if got, err := parseRevisions(in); err == nil {
+			t.Errorf("parseRevisions(%q) = %q, want error", in, got)
+		}
+	}
+}
+
+func TestCommentThreads(t *testing.T) {
+	var got gerrit.ReviewInput
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			// Comments are listed out of order, as Gerrit may do.
+			io.WriteString(w, `)]}'
+{"/PATCHSET_LEVEL": [
+	{"id": "new", "message": "TryBots beginning", "updated": "2024-01-01 12:00:00.000000000", "unresolved": true, "tag": "autogenerated:securitybot~beginning"},
+	{"id": "old", "message": "TryBots beginning", "updated": "2024-01-01 10:00:00.000000000", "unresolved": true, "tag": "autogenerated:securitybot~beginning"},
+	{"id": "oldres", "in_reply_to": "old", "message": "Tests failed", "updated": "2024-01-01 10:30:00.000000000", "unresolved": true, "tag": "autogenerated:securitybot~results"},
+	{"id": "human", "message": "Please look at this.", "updated": "2024-01-01 11:00:00.000000000", "unresolved": true},
+	{"id": "reply", "in_reply_to": "new", "message": "Flaky?", "updated": "2024-01-01 12:10:00.000000000"}
+]}`)
+			return
+		}
+		got = gerrit.ReviewInput{}
+		json.NewDecoder(r.Body).Decode(&got)
+		io.WriteString(w, ")]}'\n{}")
+	}))
+	defer srv.Close()
+
+	tr := &tester{
+		gerrit:           gerrit.NewClient(srv.URL, gerrit.NoAuth),
+		failureThreshold: failureThreshold{count: 1},
+		passLabel:        1,
+		failLabel:        -1,
+	}
+	change := &gerrit.ChangeInfo{ID: "go-private~master~I1", CurrentRevision: "aaaa"}
+	ctx := context.Background()
+
+	// A new run resolves the earlier threads that only securitybot commented on.
+	if err := tr.commentBeginning(ctx, change); err != nil {
+		t.Fatal(err)
+	}
+	comments := got.Comments["/PATCHSET_LEVEL"]
+	if got.Tag != "autogenerated:securitybot~beginning" || len(comments) == 0 || comments[0].InReplyTo != "" || !*comments[0].Unresolved {
+		t.Errorf("beginning review = %+v, want a new unresolved thread tagged as beginning", got)
+	}
+	var superseded []string
+	for _, c := range comments[1:] {
+		if *c.Unresolved {
+			t.Errorf("reply to %s is unresolved, want resolved", c.InReplyTo)
+		}
+		superseded = append(superseded, c.InReplyTo)
+	}
+	if want := []string{"old"}; !slices.Equal(superseded, want) {
+		t.Errorf("resolved threads %v, want %v", superseded, want)
+	}
+
+	// Results reply to the latest beginning comment, resolving it if they pass.
+	for _, passed := range []bool{false, true} {
+		if err := tr.commentResults(ctx, change, "aaaa", []builderResult{{builderType: "linux-amd64", passed: passed}}); err != nil {
+			t.Fatal(err)
+		}
+		comments := got.Comments["/PATCHSET_LEVEL"]
+		if len(comments) != 1 {
+			t.Fatalf("results review = %+v, want one comment", got)
+		}
+		c := comments[0]
+		if c.InReplyTo != "new" || *c.Unresolved == passed || !strings.HasPrefix(c.Message, "Tests ") {
+			t.Errorf("passed=%t: results comment = %+v, want reply to new, unresolved %t", passed, c, !passed)
+		}
+		if want := map[string]int{"TryBot-Result": map[bool]int{false: -1, true: 1}[passed]}; !maps.Equal(got.Labels, want) {
+			t.Errorf("passed=%t: labels = %v, want %v", passed, got.Labels, want)
+		}
+	}
+	// In single-comment mode the run began no thread, so the results
+	// don't reply to that of an earlier run.
+	tr.singleComment = true
+	if err := tr.commentResults(ctx, change, "aaaa", []builderResult{{builderType: "linux-amd64", passed: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if c := got.Comments["/PATCHSET_LEVEL"]; len(c) != 1 || c[0].InReplyTo != "" {
+		t.Errorf("single-comment results = %+v, want one comment starting a thread", c)
+	}
+}
+
+func TestSetReviewSerialized(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		inFlight = make(map[string]int)
+		maxCount = make(map[string]int)
+		messages []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var review gerrit.ReviewInput
+		json.NewDecoder(r.Body).Decode(&review)
+		mu.Lock()
+		inFlight[r.URL.Path]++
+		maxCount[r.URL.Path] = max(maxCount[r.URL.Path], inFlight[r.URL.Path])
+		messages = append(messages, review.Message)
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		inFlight[r.URL.Path]--
+		mu.Unlock()
+		io.WriteString(w, ")]}'\n{}")
+	}))
+	defer srv.Close()
+
+	tr := &tester{gerrit: gerrit.NewClient(srv.URL, gerrit.NoAuth)}
+	changes := []*gerrit.ChangeInfo{
+		{ID: "go-private~master~I1", CurrentRevision: "aaaa"},
+		{ID: "go-private~master~I2", CurrentRevision: "bbbb"},
+	}
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		for _, change := range changes {
+			wg.Add(1)
+			go func(change *gerrit.ChangeInfo, i int) {
+				defer wg.Done()
+				msg := fmt.Sprintf("%s result %d", change.ID, i)
+				if err := tr.setReview(context.Background(), change, gerrit.ReviewInput{Message: msg}); err != nil {
+					t.Error(err)
+				}
+			}(change, i)
+		}
+	}
+	wg.Wait()
+
+	if len(messages) != n*len(changes) {
+		t.Errorf("posted %d reviews, want %d", len(messages), n*len(changes))
+	}
+	for path, m := range maxCount {
+		if m != 1 {
+			t.Errorf("%s: %d concurrent reviews, want 1", path, m)
+		}
+	}
+	if len(tr.changeLocks.locks) != 0 {
+		t.Errorf("%d change locks remain after all reviews were posted", len(tr.changeLocks.locks))
+	}
+}
+
+func TestListenAddress(t *testing.T) {
+	for in, want := range map[string]string{
+		":8080":          "localhost:8080",
+		"localhost:8080": "localhost:8080",
+		"0.0.0.0:8080":   "0.0.0.0:8080",
+		"[::1]:8080":     "[::1]:8080",
+	} {
+		if got, err := listenAddress(in); err != nil || got != want {
+			t.Errorf("listenAddress(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+	if got, err := listenAddress("8080"); err == nil {
+		t.Errorf("listenAddress(%q) = %q, want error", "8080", got)
+	}
+}
+
+func TestPauseHandler(t *testing.T) {
+	var p pauseState
+	srv := httptest.NewServer(p.handler(logger{slog.New(slog.NewTextHandler(io.Discard, nil))}))
+	defer srv.Close()
+
+	do := func(method, path string) (int, string) {
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if _, body := do("GET", "/status"); body != "running\n" {
+		t.Errorf("initial status = %q, want running", body)
+	}
+	if code, _ := do("GET", "/pause"); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /pause: status %d, want %d", code, http.StatusMethodNotAllowed)
+	}
+	if p.isPaused() {
+		t.Fatal("paused by GET")
+	}
+	do("POST", "/pause")
+	if !p.isPaused() {
+		t.Fatal("not paused after POST /pause")
+	}
+	if _, body := do("GET", "/status"); !strings.HasPrefix(body, "paused since ") {
+		t.Errorf("status while paused = %q, want paused since ...", body)
+	}
+	if p.toggle() {
+		t.Error("toggle while paused = true, want false")
+	}
+	do("POST", "/pause")
+	do("POST", "/resume")
+	if p.isPaused() {
+		t.Error("paused after POST /resume")
+	}
+	if p.set(false) {
+		t.Error("set(false) while running reported a change")
+	}
+}
+
+func TestNeedsTesting(t *testing.T) {
+	tr := &tester{passLabel: 1, failLabel: -1}
+	at := func(minute int) gerrit.TimeStamp {
+		return gerrit.TimeStamp(time.Date(2024, 5, 1, 12, minute, 0, 0, time.UTC))
+	}
+	change := func(runTryBot, tryBotResult []gerrit.ApprovalInfo) *gerrit.ChangeInfo {
+		return &gerrit.ChangeInfo{Labels: map[string]gerrit.LabelInfo{
+			"Run-TryBot":    {All: runTryBot},
+			"TryBot-Result": {All: tryBotResult},
+		}}
+	}
+	for _, tc := range []struct {
+		name   string
+		change *gerrit.ChangeInfo
+		want   bool
+	}{
+		{
+			name:   "no result",
+			change: change([]gerrit.ApprovalInfo{{Value: 1, Date: at(0)}}, nil),
+			want:   true,
+		},
+		{
+			name:   "cleared result",
+			change: change([]gerrit.ApprovalInfo{{Value: 1, Date: at(0)}}, []gerrit.ApprovalInfo{{Value: 0, Date: at(10)}}),
+			want:   true,
+		},
+		{
+			name:   "result",
+			change: change([]gerrit.ApprovalInfo{{Value: 1, Date: at(0)}}, []gerrit.ApprovalInfo{{Value: -1, Date: at(10)}}),
+			want:   false,
+		},
+		{
+			name: "re-run requested",
+			change: change(
+				[]gerrit.ApprovalInfo{{Value: 1, Date: at(0)}, {Value: 1, Date: at(20)}},
+				[]gerrit.ApprovalInfo{{Value: 1, Date: at(10)}},
+			),
+			want: true,
+		},
+		{
+			name: "re-run finished",
+			change: change(
+				[]gerrit.ApprovalInfo{{Value: 1, Date: at(20)}},
+				[]gerrit.ApprovalInfo{{Value: -1, Date: at(10)}, {Value: 1, Date: at(30)}},
+			),
+			want: false,
+		},
+	} {
+		if got := tr.needsTesting(tc.change); got != tc.want {
+			t.Errorf("%s: needsTesting = %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestOrderBuilders(t *testing.T) {
+	builders := []string{"linux-amd64", "linux-amd64-longtest", "linux-386", "darwin-arm64-12"}
+	tr := &tester{builderOrder: "config"}
+	if got := tr.orderBuilders(builders); !slices.Equal(got, builders) {
+		t.Errorf("config order = %v, want %v", got, builders)
+	}
+
+	tr.builderOrder = "random"
+	got := tr.orderBuilders(builders)
+	sorted, want := slices.Clone(got), slices.Clone(builders)
+	slices.Sort(sorted)
+	slices.Sort(want)
+	if !slices.Equal(sorted, want) {
+		t.Errorf("random order = %v, want a permutation of %v", got, builders)
+	}
+
+	// Without any history, long test builders are expected to be slowest.
+	tr.builderOrder = "slowest-first"
+	want = []string{"linux-amd64-longtest", "linux-amd64", "linux-386", "darwin-arm64-12"}
+	if got := tr.orderBuilders(builders); !slices.Equal(got, want) {
+		t.Errorf("slowest-first order = %v, want %v", got, want)
+	}
+	tr.durations = map[string]time.Duration{
+		"darwin-arm64-12":      3 * time.Hour,
+		"linux-amd64-longtest": 90 * time.Minute,
+		"linux-386":            10 * time.Minute,
+	}
+	want = []string{"darwin-arm64-12", "linux-amd64-longtest", "linux-amd64", "linux-386"}
+	if got := tr.orderBuilders(builders); !slices.Equal(got, want) {
+		t.Errorf("slowest-first order with history = %v, want %v", got, want)
+	}
+	if !slices.Equal(builders, []string{"linux-amd64", "linux-amd64-longtest", "linux-386", "darwin-arm64-12"}) {
+		t.Errorf("orderBuilders modified its argument: %v", builders)
+	}
+}
+
+func TestCreateBuildletWithRetry(t *testing.T) {
+	ctx := context.Background()
+	quota := status.Error(codes.ResourceExhausted, "quota exceeded")
+	unknown := status.Error(codes.InvalidArgument, "unknown builder type")
+	for _, tc := range []struct {
+		name     string
+		errs     []error // returned by successive attempts, then success
+		retries  int
+		attempts int
+		ok       bool
+	}{
+		{"success", nil, 2, 1, true},
+		{"transient", []error{quota, status.Error(codes.Unavailable, "503")}, 2, 3, true},
+		{"exhausted", []error{quota, quota, quota}, 2, 3, false},
+		{"permanent", []error{unknown}, 2, 1, false},
+		{"aws", []error{errors.New("ResourceNotReady: failed waiting for successful resource state")}, 1, 2, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var attempts []int
+			_, err := createBuildletWithRetry(ctx, tc.retries, time.Millisecond, func(attempt int) (buildlet.RemoteClient, error) {
+				attempts = append(attempts, attempt)
+				if i := attempt - 1; i < len(tc.errs) {
+					return nil, tc.errs[i]
+				}
+				return nil, nil
+			})
+			if (err == nil) != tc.ok {
+				t.Errorf("err = %v, want success %v", err, tc.ok)
+			}
+			if len(attempts) != tc.attempts {
+				t.Errorf("made %d attempts, want %d", len(attempts), tc.attempts)
+			}
+			for i, a := range attempts {
+				if a != i+1 {
+					t.Errorf("attempts numbered %v, want from 1", attempts)
+					break
+				}
+			}
+		})
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if retryableCreateError(cancelled, context.Canceled) || retryableCreateError(cancelled, quota) {
+		t.Error("error after cancellation is retryable")
+	}
+}
+
+func TestOpenLocalLog(t *testing.T) {
+	for name, want := range map[string]string{
+		"linux-amd64":      "linux-amd64",
+		"go1.22.3":         "go1.22.3",
+		"../../etc/passwd": ".._.._etc_passwd",
+		"a b\\c":           "a_b_c",
+		"..":               "___",
+		"":                 "_",
+	} {
+		if got := sanitizeFilename(name); got != want {
+			t.Errorf("sanitizeFilename(%q) = %q, want %q", name, got, want)
+		}
+	}
+
+	dir := filepath.Join(t.TempDir(), "logs")
+	for _, output := range []string{"first attempt\n", "retry\n"} {
+		f, err := openLocalLog(dir, "abc123", "linux/amd64")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(f, output)
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "abc123", "linux_amd64.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "first attempt\nretry\n"; string(got) != want {
+		t.Errorf("local log = %q, want %q", got, want)
+	}
+}
+
+func TestSnippetsBudget(t *testing.T) {
+	var results []builderResult
+	for _, bt := range []string{"linux-amd64", "linux-386", "windows-amd64"} {
+		results = append(results, builderResult{builderType: bt, snippet: strings.Repeat("x", 40)})
+	}
+	results = append(results, builderResult{builderType: "darwin-amd64", passed: true})
+	got := snippets(results, 160)
+	if !strings.Contains(got, "End of the output on linux-amd64:") || !strings.Contains(got, "End of the output on linux-386:") {
+		t.Errorf("snippets missing ones within the budget:\n%s", got)
+	}
+	if strings.Contains(got, "End of the output on windows-amd64") {
+		t.Errorf("snippets include one beyond the budget:\n%s", got)
+	}
+	if !strings.Contains(got, "The output on windows-amd64 is omitted") {
+		t.Errorf("snippets don't note the omitted output:\n%s", got)
+	}
+	if got := snippets(results[:1], 160); strings.Contains(got, "omitted") {
+		t.Errorf("snippets within the budget note omitted output:\n%s", got)
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	for _, tc := range []struct {
+		max    int
+		writes []string
+		want   string
+	}{
+		{100, []string{"ok  \tfmt\n", "--- FAIL: TestX\n"}, "    ok  \tfmt\n    --- FAIL: TestX"},
+		// Output beyond max is cut at a line boundary.
+		{12, []string{"first line\nsecond\nthird\n"}, "    third"},
+		{12, []string{"first line\n", "second\n", "thi", "rd\n"}, "    third"},
+		{10, []string{"a very long line\n"}, ""},
+		// Everything is preformatted, so Markdown is shown as is.
+		{100, []string{"# heading\r\n* `code`\n"}, "    # heading\n    * `code`"},
+		{100, []string{"bad \xff utf-8\n"}, "    bad \uFFFD utf-8"},
+		{100, []string{"\n\n"}, ""},
+	} {
+		tb := &tailBuffer{max: tc.max}
+		for _, w := range tc.writes {
+			io.WriteString(tb, w)
+		}
+		if got := tb.snippet(); got != tc.want {
+			t.Errorf("snippet of %q with max %d = %q, want %q", tc.writes, tc.max, got, tc.want)
+		}
+	}
+}
+
+func TestLiveWriter(t *testing.T) {
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	var last []byte
+	writes := 0
+	g := startLiveWriter(ctx, "bucket/log", func(b []byte, from int) error {
+		mu.Lock()
+		defer mu.Unlock()
+		last = slices.Clone(b)
+		writes++
+		return nil
+	}, 4, time.Hour)
+	io.WriteString(g, "hello, ")
+	// Writing more than flushSize writes the log without waiting an hour.
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(time.Millisecond) {
+		mu.Lock()
+		n := writes
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("log not written after flushSize bytes")
+		}
+	}
+	io.WriteString(g, "world")
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if string(last) != "hello, world" {
+		t.Errorf("log = %q after Close, want %q", last, "hello, world")
+	}
+
+	failure := errors.New("GCS unavailable")
+	attempts := 0
+	g = startLiveWriter(ctx, "bucket/log", func(b []byte, from int) error {
+		attempts++
+		return failure
+	}, 0, time.Millisecond)
+	io.WriteString(g, "lost")
+	<-g.done
+	if attempts != maxLogWriteFailures {
+		t.Errorf("made %d writes, want %d", attempts, maxLogWriteFailures)
+	}
+	if err := g.Close(); !errors.Is(err, failure) {
+		t.Errorf("Close = %v, want %v", err, failure)
+	}
+	if attempts != maxLogWriteFailures {
+		t.Errorf("Close wrote after the writer gave up")
+	}
+}
+
+// fakeLogStore is a logStore in memory, which counts the bytes put.
+type fakeLogStore struct {
+	objects  map[string][]byte
+	counts   map[string]int64 // components of composed objects
+	bytesPut int64
+}
+
+func newFakeLogStore() *fakeLogStore {
+	return &fakeLogStore{objects: make(map[string][]byte), counts: make(map[string]int64)}
+}
+
+func (s *fakeLogStore) put(ctx context.Context, name string, b []byte) error {
+	s.objects[name] = slices.Clone(b)
+	s.counts[name] = 1
+	s.bytesPut += int64(len(b))
+	return nil
+}
+
+func (s *fakeLogStore) compose(ctx context.Context, dst string, srcs ...string) (int64, error) {
+	var b []byte
+	var n int64
+	for _, src := range srcs {
+		b = append(b, s.objects[src]...)
+		n += s.counts[src]
+	}
+	s.objects[dst], s.counts[dst] = b, n
+	return n, nil
+}
+
+func (s *fakeLogStore) delete(ctx context.Context, name string) error {
+	delete(s.objects, name)
+	delete(s.counts, name)
+	return nil
+}
+
+func TestAppendLog(t *testing.T) {
+	ctx := context.Background()
+	store := newFakeLogStore()
+	store.put(ctx, "log", nil)
+	write := appendLog(ctx, store, "log")
+	var all []byte
+	for i := 0; i < maxLogComponents+10; i++ {
+		from := len(all)
+		all = fmt.Appendf(all, "line %d\n", i)
+		if err := write(all, from); err != nil {
+			t.Fatal(err)
+		}
+		if err := write(all, len(all)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := store.objects["log"]; !bytes.Equal(got, all) {
+		t.Errorf("log has %d bytes, want %d", len(got), len(all))
+	}
+	if len(store.objects) != 1 {
+		t.Errorf("store has %d objects, want only the log", len(store.objects))
+	}
+	if n := store.counts["log"]; n >= maxLogComponents {
+		t.Errorf("log has %d components, want fewer than %d", n, maxLogComponents)
+	}
+}
+
+// BenchmarkLogWriters compares the number of bytes uploaded by writing a
+// 50MB log in 1MB pieces by rewriting the log each time, and by appending
+// to it.
+func BenchmarkLogWriters(b *testing.B) {
+	ctx := context.Background()
+	line := bytes.Repeat([]byte("x"), 1<<10)
+	for _, bc := range []struct {
+		name   string
+		writer func(context.Context, logStore, string) logWriteFunc
+	}{
+		{"rewrite", rewriteLog},
+		{"append", appendLog},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var uploaded int64
+			for i := 0; i < b.N; i++ {
+				store := newFakeLogStore()
+				write := bc.writer(ctx, store, "log")
+				var all []byte
+				for mb := 0; mb < 50; mb++ {
+					from := len(all)
+					for j := 0; j < 1<<10; j++ {
+						all = append(all, line...)
+					}
+					if err := write(all, from); err != nil {
+						b.Fatal(err)
+					}
+				}
+				uploaded += store.bytesPut
+			}
+			b.ReportMetric(float64(uploaded)/float64(b.N)/(1<<20), "MB-uploaded/op")
+		})
+	}
+}
+
+func TestRunState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := loadRunState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.begun("aaaa") {
+		t.Error("begun(aaaa) = true in new state, want false")
+	}
+	if err := s.begin(1, "aaaa"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.begin(2, "bbbb"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.finish("bbbb"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The state survives a restart.
+	s, err = loadRunState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.begun("aaaa") || s.begun("bbbb") {
+		t.Errorf("after reload, begun(aaaa), begun(bbbb) = %v, %v; want true, false", s.begun("aaaa"), s.begun("bbbb"))
+	}
+
+	// Entries that are too old are forgotten.
+	old := map[string]testingRevision{"cccc": {Change: 3, Started: time.Now().Add(-maxTestingAge - time.Hour)}}
+	data, err := json.Marshal(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := loadRunState(path); err != nil {
+		t.Fatal(err)
+	} else if s.begun("cccc") {
+		t.Error("begun(cccc) = true for an old entry, want false")
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadRunState(path); err == nil {
+		t.Error("loading a corrupt state file succeeded, want error")
+	}
+
+	// Without a file, the state is only kept in memory.
+	s, err = loadRunState("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.begin(1, "aaaa"); err != nil || !s.begun("aaaa") {
+		t.Errorf("in-memory state: begin = %v, begun = %v; want nil, true", err, s.begun("aaaa"))
+	}
+}
+
+func TestBootstrapChecksums(t *testing.T) {
+	const sum = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" // of "hello"
+	b := make(bootstrapChecksums)
+	if err := b.Set("https://example.com/gobootstrap.tar.gz?alt=media=" + strings.ToUpper(sum)); err != nil {
+		t.Fatal(err)
+	}
+	if got := b["https://example.com/gobootstrap.tar.gz?alt=media"]; got != sum {
+		t.Errorf("checksum = %q, want %q", got, sum)
+	}
+	for _, bad := range []string{
+		"https://example.com/gobootstrap.tar.gz",
+		"=" + sum,
+		"https://example.com/gobootstrap.tar.gz=1234",
+		"https://example.com/gobootstrap.tar.gz=" + strings.Repeat("zz", sha256.Size),
+		"https://example.com/gobootstrap.tar.gz?alt=media=" + strings.Repeat("00", sha256.Size),
+	} {
+		if err := b.Set(bad); err == nil {
+			t.Errorf("Set(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestFetchVerified(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/gobootstrap.tar.gz" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "hello")
+	}))
+	defer srv.Close()
+
+	tr := &tester{http: srv.Client()}
+	ctx := context.Background()
+	const sum = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" // of "hello"
+	if data, err := tr.fetchVerified(ctx, srv.URL+"/gobootstrap.tar.gz", sum); err != nil || string(data) != "hello" {
+		t.Errorf("fetchVerified with the right checksum = %q, %v; want %q, nil", data, err, "hello")
+	}
+	if _, err := tr.fetchVerified(ctx, srv.URL+"/gobootstrap.tar.gz", strings.Repeat("00", sha256.Size)); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("fetchVerified with the wrong checksum: got %v, want a checksum error", err)
+	}
+	if _, err := tr.fetchVerified(ctx, srv.URL+"/missing.tar.gz", sum); err == nil {
+		t.Error("fetchVerified of a missing file succeeded, want error")
+	}
+
+	// Without a checksum for it, the URL is used as is.
+	if got, err := tr.verifiedBootstrapURL(ctx, &buildInfo{}, "https://example.com/gobootstrap.tar.gz"); err != nil || got != "https://example.com/gobootstrap.tar.gz" {
+		t.Errorf("verifiedBootstrapURL without a checksum = %q, %v; want the URL itself", got, err)
+	}
+}
+
+// fakeHistoryStore is a historyStore in memory, holding "revision/builder"
+// for each builder that passed at a revision.
+type fakeHistoryStore map[string]bool
+
+func (h fakeHistoryStore) passed(ctx context.Context, revision, builderType string) (bool, error) {
+	return h[revision+"/"+builderType], nil
+}
+
+func (h fakeHistoryStore) record(ctx context.Context, revision, builderType string) error {
+	h[revision+"/"+builderType] = true
+	return nil
+}
+
+func TestParentUntested(t *testing.T) {
+	ctx := context.Background()
+	results := []builderResult{
+		{builderType: "linux-amd64", passed: true},
+		{builderType: "windows-amd64-2016", passed: true},
+		{builderType: "darwin-amd64-13", skipped: true},
+	}
+
+	// A parent with no history at all, as for a commit that securitybot
+	// never tested, is tested on every builder that wasn't skipped.
+	h := fakeHistoryStore{}
+	var tested []string
+	untested, err := parentUntested(ctx, h, "parent", results, func(builders []string) ([]builderResult, error) {
+		tested = append(tested, builders...)
+		return []builderResult{
+			{builderType: "linux-amd64", passed: true},
+			{builderType: "windows-amd64-2016", passed: false},
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"linux-amd64", "windows-amd64-2016"}; !slices.Equal(tested, want) {
+		t.Errorf("tested parent on %q, want %q", tested, want)
+	}
+	if want := []string{"windows-amd64-2016"}; !slices.Equal(untested, want) {
+		t.Errorf("parentUntested = %q, want %q", untested, want)
+	}
+	if !h["parent/linux-amd64"] || h["parent/windows-amd64-2016"] {
+		t.Errorf("history after testing parent = %v, want only linux-amd64 recorded", h)
+	}
+
+	// Only the builder still without history is tested again.
+	tested = nil
+	untested, err = parentUntested(ctx, h, "parent", results, func(builders []string) ([]builderResult, error) {
+		tested = append(tested, builders...)
+		return []builderResult{{builderType: "windows-amd64-2016", passed: true}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"windows-amd64-2016"}; !slices.Equal(tested, want) {
+		t.Errorf("tested parent on %q, want %q", tested, want)
+	}
+	if len(untested) != 0 {
+		t.Errorf("parentUntested = %q, want none", untested)
+	}
+
+	// Once the parent has history on every builder, it isn't tested.
+	if _, err := parentUntested(ctx, h, "parent", results, func(builders []string) ([]builderResult, error) {
+		t.Errorf("tested parent with full history on %q", builders)
+		return nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Failing to test the parent at all is an error, so the change is
+	// tried again rather than failed.
+	if _, err := parentUntested(ctx, fakeHistoryStore{}, "parent", results, func(builders []string) ([]builderResult, error) {
+		return nil, errors.New("failed to retrieve change archive")
+	}); err == nil {
+		t.Error("parentUntested succeeded when the parent couldn't be tested")
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// pauseState records whether the poll loop is paused. While paused, the
+// loop doesn't start testing any more changes, but tests already running
+// are allowed to finish. Changes aren't tested until they have a
+// TryBot-Result label, so the changes that arrive while paused are found
+// by the first poll after resuming.
+type pauseState struct {
+	mu     sync.Mutex
+	paused bool
+	since  time.Time // when paused last changed
+}
+
+// set pauses or resumes the poll loop, and reports whether that changed
+// its state.
+func (p *pauseState) set(paused bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused == paused {
+		return false
+	}
+	p.paused, p.since = paused, time.Now()
+	return true
+}
+
+// toggle pauses the poll loop if it's running or resumes it if it's
+// paused, and returns whether it is now paused.
+func (p *pauseState) toggle() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused, p.since = !p.paused, time.Now()
+	return p.paused
+}
+
+// isPaused reports whether the poll loop is paused.
+func (p *pauseState) isPaused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// status returns a one-line description of the state of the poll loop.
+func (p *pauseState) status() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.paused:
+		return "paused since " + p.since.UTC().Format(time.RFC3339)
+	case !p.since.IsZero():
+		return "running since " + p.since.UTC().Format(time.RFC3339)
+	}
+	return "running"
+}
+
+// handler returns the handler served on -listen: GET /status reports
+// whether the poll loop is paused, and POST /pause and /resume pause and
+// resume it. Changes of state are logged with lg.
+func (p *pauseState) handler(lg logger) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, p.status())
+	})
+	setter := func(paused bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if p.set(paused) {
+				logPauseChange(lg, paused, "request from "+r.RemoteAddr)
+			}
+			fmt.Fprintln(w, p.status())
+		}
+	}
+	mux.HandleFunc("/pause", setter(true))
+	mux.HandleFunc("/resume", setter(false))
+	return mux
+}
+
+// listenAddress returns the address to serve the handler on for -listen
+// addr. The handler is unauthenticated, so if addr has no host, like
+// ":8080", it is only served on localhost.
+func listenAddress(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// logPauseChange logs that the poll loop was paused or resumed, and why.
+func logPauseChange(lg logger, paused bool, reason string) {
+	if paused {
+		lg.printf("paused", "polling paused (%s); running tests will finish", reason)
+	} else {
+		lg.printf("resumed", "polling resumed (%s)", reason)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+
+	"golang.org/x/build/gerrit"
+)
+
+// selfTestBuilder is the builder type of the buildlet created by -selftest.
+// It is one of the quickest to create.
+const selfTestBuilder = "linux-amd64"
+
+// A selfCheck is a check of one of the services that securitybot depends
+// on, run by -selftest.
+type selfCheck struct {
+	name string
+	run  func(context.Context) error
+}
+
+// selfChecks returns the checks run by -selftest. Each exercises the same
+// credentials and API as securitybot does in normal operation, with as few
+// side effects as possible: anything created is deleted again.
+func (t *tester) selfChecks() []selfCheck {
+	checks := []selfCheck{
+		{"gerrit", func(ctx context.Context) error {
+			_, err := t.gerrit.GetAccountInfo(ctx, "self")
+			return err
+		}},
+		{"gerrit-query", func(ctx context.Context) error {
+			_, err := t.gerrit.QueryChanges(ctx, "project:"+t.repo, gerrit.QueryChangesOpt{N: 1})
+			return err
+		}},
+		{"source", func(ctx context.Context) error {
+			req, err := http.NewRequestWithContext(ctx, "GET", t.source+"/"+t.repo+"/+refs/heads/master?format=TEXT", nil)
+			if err != nil {
+				return err
+			}
+			resp, err := t.http.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("unexpected status: %s", resp.Status)
+			}
+			return nil
+		}},
+		{"coordinator", func(ctx context.Context) error {
+			c, err := t.coordinator.CreateBuildlet(ctx, selfTestBuilder)
+			if err != nil {
+				return fmt.Errorf("creating %s buildlet: %w", selfTestBuilder, err)
+			}
+			if err := c.Close(); err != nil {
+				return fmt.Errorf("destroying buildlet %s: %w", c.RemoteName(), err)
+			}
+			return nil
+		}},
+	}
+	if t.gcs != nil {
+		checks = append(checks, selfCheck{"gcs", func(ctx context.Context) error {
+			suffix := make([]byte, 4)
+			rand.Read(suffix)
+			obj := t.gcs.Bucket(*gcsBucket).Object(path.Join("selftest", fmt.Sprintf("%x", suffix)))
+			w := obj.NewWriter(ctx)
+			io.WriteString(w, "securitybot self-test\n")
+			if err := w.Close(); err != nil {
+				return fmt.Errorf("writing probe: %w", err)
+			}
+			if err := obj.Delete(ctx); err != nil {
+				return fmt.Errorf("deleting probe %s: %w", obj.ObjectName(), err)
+			}
+			return nil
+		}})
+	}
+	return checks
+}
+
+// runSelfChecks runs checks in order, writing the outcome of each to w,
+// and reports whether they all passed.
+func runSelfChecks(ctx context.Context, w io.Writer, checks []selfCheck) bool {
+	ok := true
+	for _, c := range checks {
+		if err := c.run(ctx); err != nil {
+			fmt.Fprintf(w, "FAIL %s: %v\n", c.name, err)
+			ok = false
+			continue
+		}
+		fmt.Fprintf(w, "ok   %s\n", c.name)
+	}
+	return ok
+}
@@ -0,0 +1,159 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"golang.org/x/build/gerrit"
+)
+
+// A testedChange identifies a revision whose tests have finished.
+type testedChange struct {
+	// info is the change the revision belongs to,
+	// or nil when testing a revision in one-shot mode.
+	info     *gerrit.ChangeInfo
+	revision string
+}
+
+func (c testedChange) String() string {
+	if c.info == nil {
+		return c.revision
+	}
+	return fmt.Sprintf("CL %d (%s)", c.info.ChangeNumber, c.revision)
+}
+
+// A ResultSink is a destination for the results of testing a revision.
+type ResultSink interface {
+	Report(ctx context.Context, change testedChange, results []builderResult) error
+}
+
+// report sends results to each of t's sinks, returning the errors of the
+// sinks that failed.
+func (t *tester) report(ctx context.Context, change testedChange, results []builderResult) error {
+	var errs []error
+	for _, s := range t.sinks {
+		if err := s.Report(ctx, change, results); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// nopSink discards results.
+type nopSink struct{}
+
+func (nopSink) Report(context.Context, testedChange, []builderResult) error { return nil }
+
+// gerritSink comments the results on the change and votes on it.
+type gerritSink struct{ t *tester }
+
+func (s gerritSink) Report(ctx context.Context, change testedChange, results []builderResult) error {
+	if change.info == nil {
+		return fmt.Errorf("cannot comment on %s: not a Gerrit change", change)
+	}
+	if err := s.t.commentResults(ctx, change.info, change.revision, results); err != nil {
+		return fmt.Errorf("commentResults failed: %w", err)
+	}
+	return nil
+}
+
+// textSink writes a summary of the results to w.
+type textSink struct {
+	t *tester
+	w io.Writer
+}
+
+func (s textSink) Report(ctx context.Context, change testedChange, results []builderResult) error {
+	state, _, table := s.t.summarizeResults(results)
+	_, err := fmt.Fprintf(s.w, "%s: tests %s\n\n%s\n", change, state, table)
+	return err
+}
+
+// historySink records the builders that passed in the GCS history.
+type historySink struct{ t *tester }
+
+func (s historySink) Report(ctx context.Context, change testedChange, results []builderResult) error {
+	// History is best effort: failing to record it only means that,
+	// with -require-parent-history, the revision may be tested again as
+	// the parent of a change.
+	if err := recordHistory(ctx, s.t.history, change.revision, results); err != nil {
+		loggerFrom(ctx).errorf("history-failed", "failed to record history: %s", err)
+	}
+	return nil
+}
+
+// Results is the JSON form of the results of testing a revision, written
+// by -json. It is a stable schema for other tools to consume: fields may
+// be added, but existing ones must not be renamed, removed, or change
+// meaning. -json writes a single Results if -revision is one revision, and
+// an array of them whenever -revision is a comma-separated list.
+type Results struct {
+	Revision string          `json:"revision"`
+	Passed   bool            `json:"passed"` // whether the revision passed overall
+	Builders []BuilderResult `json:"builders"`
+}
+
+// BuilderResult is the JSON form of the result of testing on one builder.
+type BuilderResult struct {
+	BuilderType string  `json:"builderType"`
+	LogURL      string  `json:"logURL,omitempty"`
+	Succeeded   bool    `json:"succeeded"`
+	Skipped     bool    `json:"skipped,omitempty"` // not tested, because of -skip-builders
+	Error       string  `json:"error,omitempty"`
+	Duration    float64 `json:"duration"` // wall-clock seconds, including retries
+}
+
+// newResults returns the JSON form of results, sorted by builder type.
+func (t *tester) newResults(revision string, results []builderResult) Results {
+	_, pass, _ := t.summarizeResults(results)
+	r := Results{Revision: revision, Passed: pass, Builders: []BuilderResult{}}
+	for _, res := range results {
+		br := BuilderResult{
+			BuilderType: res.builderType,
+			LogURL:      res.logURL,
+			Succeeded:   res.passed,
+			Skipped:     res.skipped,
+			Duration:    res.duration.Seconds(),
+		}
+		if res.err != nil {
+			br.Error = res.err.Error()
+		}
+		r.Builders = append(r.Builders, br)
+	}
+	sort.Slice(r.Builders, func(i, j int) bool { return r.Builders[i].BuilderType < r.Builders[j].BuilderType })
+	return r
+}
+
+// jsonSink writes the results as JSON to a file, or to stdout if the file
+// is "-".
+type jsonSink struct {
+	t    *tester
+	file string
+}
+
+func (s jsonSink) Report(ctx context.Context, change testedChange, results []builderResult) error {
+	return writeJSON(s.file, s.t.newResults(change.revision, results))
+}
+
+// writeJSON writes v as indented JSON to file, or to stdout if file is "-".
+func writeJSON(file string, v any) error {
+	b, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if file == "-" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return os.WriteFile(file, b, 0644)
+}
@@ -0,0 +1,116 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// runState records the revisions whose tests have begun but whose results
+// haven't been reported, so that when a revision is tested again, after a
+// failure or a restart, securitybot doesn't comment again that its tests
+// are beginning. If path is set, the state is kept in that file so that it
+// survives restarts.
+type runState struct {
+	path string
+
+	mu      sync.Mutex
+	testing map[string]testingRevision // by revision
+}
+
+// A testingRevision is a revision whose tests have begun.
+type testingRevision struct {
+	Change  int       `json:"change"`
+	Started time.Time `json:"started"`
+}
+
+// maxTestingAge is how long a revision is remembered as being tested.
+// Revisions that are never tested to completion, such as those of a patch
+// set that was replaced during a restart, are forgotten after this long.
+const maxTestingAge = 7 * 24 * time.Hour
+
+// loadRunState returns the state kept in the file path, which need not
+// exist yet, or a state that isn't kept in a file if path is empty.
+func loadRunState(path string) (*runState, error) {
+	s := &runState{path: path, testing: make(map[string]testingRevision)}
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.testing); err != nil {
+		return nil, err
+	}
+	for rev, tr := range s.testing {
+		if time.Since(tr.Started) > maxTestingAge {
+			delete(s.testing, rev)
+		}
+	}
+	return s, nil
+}
+
+// begun reports whether the tests of revision have begun and not been
+// reported.
+func (s *runState) begun(revision string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.testing[revision]
+	return ok
+}
+
+// begin records that the tests of revision, of change, have begun.
+func (s *runState) begin(change int, revision string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.testing[revision] = testingRevision{Change: change, Started: time.Now()}
+	return s.save()
+}
+
+// finish records that the results of the tests of revision were reported.
+func (s *runState) finish(revision string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.testing, revision)
+	return s.save()
+}
+
+// save writes the state to s.path, if set, replacing the file atomically
+// so that it is never left partially written. s.mu must be held.
+func (s *runState) save() (err error) {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.testing, "", "\t")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
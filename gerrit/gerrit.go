@@ -390,6 +390,10 @@ type LabelInfo struct {
 
 	// Fields set by DETAILED_LABELS option:
 	All []ApprovalInfo `json:"all"`
+
+	// Values maps the label's allowed values (like "-1", " 0", "+1")
+	// to their descriptions. It is set by the DETAILED_LABELS option.
+	Values map[string]string `json:"values"`
 }
 
 type ApprovalInfo struct {
@@ -0,0 +1,216 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package relnote
+
+import (
+	"fmt"
+	"io/fs"
+	"regexp"
+	"strings"
+
+	md "rsc.io/markdown"
+)
+
+// CheckAnchors reports links in the Markdown files of fsys to in-document
+// anchors (URLs like "#id") that are not defined anywhere in those files.
+// An anchor is defined by a heading ID (as in "## Heading {#id}") or by an
+// id attribute in HTML.
+// Each problem is reported with the file and line of the broken link.
+func CheckAnchors(fsys fs.FS) error {
+	return check(fsys, Checks{Anchors: true})
+}
+
+// anchorDiagnostics returns the problems reported by CheckAnchors for
+// frags, which must be parsed.
+func anchorDiagnostics(frags []*fragment) []Diagnostic {
+	type anchorRef struct {
+		filename string
+		line     int
+		target   string
+	}
+	defined := map[string]bool{}
+	var refs []anchorRef
+	for _, f := range frags {
+		for _, b := range f.doc.Blocks {
+			for _, a := range blockAnchors(b) {
+				defined[a.id] = true
+			}
+			for _, l := range blockAnchorLinks(b) {
+				refs = append(refs, anchorRef{f.name, l.line, l.target})
+			}
+		}
+	}
+	var diags []Diagnostic
+	for _, r := range refs {
+		if !defined[r.target] {
+			diags = append(diags, Diagnostic{r.filename, r.line, "link to undefined anchor #" + r.target})
+		}
+	}
+	return diags
+}
+
+// CheckDuplicateAnchors reports anchors that are defined more than once
+// in the Markdown files of fsys, and headings at the same level with the
+// same text, either of which would collide in the merged notes. Each
+// problem is reported with the file and line of the later definition, and
+// says where the earlier one is.
+func CheckDuplicateAnchors(fsys fs.FS) error {
+	return check(fsys, Checks{DuplicateAnchors: true})
+}
+
+// duplicateAnchorDiagnostics returns the problems reported by
+// CheckDuplicateAnchors for frags, which must be parsed.
+func duplicateAnchorDiagnostics(frags []*fragment) []Diagnostic {
+	type location struct {
+		filename string
+		line     int
+	}
+	anchors := map[string]location{}
+	headings := map[string]location{} // keyed by level and text
+	var diags []Diagnostic
+	for _, f := range frags {
+		filename := f.name
+		for _, b := range f.doc.Blocks {
+			for _, a := range blockAnchors(b) {
+				if first, ok := anchors[a.id]; ok {
+					diags = append(diags, Diagnostic{filename, a.line, fmt.Sprintf("duplicate anchor #%s; also defined at %s:%d", a.id, first.filename, first.line)})
+				} else {
+					anchors[a.id] = location{filename, a.line}
+				}
+			}
+			h, ok := b.(*md.Heading)
+			if !ok || h.ID != "" {
+				// Headings with IDs are checked as anchors.
+				continue
+			}
+			title := strings.TrimSpace(text(h))
+			key := fmt.Sprintf("%d %s", h.Level, title)
+			if first, ok := headings[key]; ok {
+				diags = append(diags, Diagnostic{filename, h.StartLine, fmt.Sprintf("duplicate heading %q; also at %s:%d", title, first.filename, first.line)})
+			} else {
+				headings[key] = location{filename, h.StartLine}
+			}
+		}
+	}
+	return diags
+}
+
+// htmlIDRegexp matches an HTML id or name attribute.
+var htmlIDRegexp = regexp.MustCompile(`\b(?:id|name)\s*=\s*["']([^"']+)["']`)
+
+type anchor struct {
+	line int
+	id   string
+}
+
+// blockAnchors returns the anchors defined in b.
+func blockAnchors(b md.Block) []anchor {
+	var anchors []anchor
+	add := func(pos md.Position, ids []string) {
+		for _, id := range ids {
+			anchors = append(anchors, anchor{pos.StartLine, id})
+		}
+	}
+	switch b := b.(type) {
+	case *md.Heading:
+		if b.ID != "" {
+			add(b.Position, []string{b.ID})
+		}
+		add(b.Position, inlineAnchors(b.Text.Inline))
+	case *md.Paragraph:
+		add(b.Position, inlineAnchors(b.Text.Inline))
+	case *md.Text:
+		add(b.Position, inlineAnchors(b.Inline))
+	case *md.HTMLBlock:
+		add(b.Position, htmlAnchors(strings.Join(b.Text, "\n")))
+	case *md.List:
+		for _, item := range b.Items {
+			anchors = append(anchors, blockAnchors(item)...)
+		}
+	case *md.Item:
+		for _, b := range b.Blocks {
+			anchors = append(anchors, blockAnchors(b)...)
+		}
+	case *md.Quote:
+		for _, b := range b.Blocks {
+			anchors = append(anchors, blockAnchors(b)...)
+		}
+	}
+	return anchors
+}
+
+func inlineAnchors(ins []md.Inline) []string {
+	var ids []string
+	for _, in := range ins {
+		if t, ok := in.(*md.HTMLTag); ok {
+			ids = append(ids, htmlAnchors(t.Text)...)
+		}
+	}
+	return ids
+}
+
+func htmlAnchors(s string) []string {
+	var ids []string
+	for _, m := range htmlIDRegexp.FindAllStringSubmatch(s, -1) {
+		ids = append(ids, m[1])
+	}
+	return ids
+}
+
+type anchorLink struct {
+	line   int
+	target string // without the leading '#'
+}
+
+// blockAnchorLinks returns the links to in-document anchors in b.
+func blockAnchorLinks(b md.Block) []anchorLink {
+	var links []anchorLink
+	addInlines := func(pos md.Position, ins []md.Inline) {
+		for _, target := range inlineAnchorLinks(ins) {
+			links = append(links, anchorLink{pos.StartLine, target})
+		}
+	}
+	switch b := b.(type) {
+	case *md.Heading:
+		addInlines(b.Position, b.Text.Inline)
+	case *md.Paragraph:
+		addInlines(b.Position, b.Text.Inline)
+	case *md.Text:
+		addInlines(b.Position, b.Inline)
+	case *md.List:
+		for _, item := range b.Items {
+			links = append(links, blockAnchorLinks(item)...)
+		}
+	case *md.Item:
+		for _, b := range b.Blocks {
+			links = append(links, blockAnchorLinks(b)...)
+		}
+	case *md.Quote:
+		for _, b := range b.Blocks {
+			links = append(links, blockAnchorLinks(b)...)
+		}
+	}
+	return links
+}
+
+func inlineAnchorLinks(ins []md.Inline) []string {
+	var targets []string
+	for _, in := range ins {
+		switch in := in.(type) {
+		case *md.Link:
+			if t, ok := strings.CutPrefix(in.URL, "#"); ok {
+				targets = append(targets, t)
+			}
+			targets = append(targets, inlineAnchorLinks(in.Inner)...)
+		case *md.Strong:
+			targets = append(targets, inlineAnchorLinks(in.Inner)...)
+		case *md.Emph:
+			targets = append(targets, inlineAnchorLinks(in.Inner)...)
+		case *md.Del:
+			targets = append(targets, inlineAnchorLinks(in.Inner)...)
+		}
+	}
+	return targets
+}
@@ -0,0 +1,75 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package relnote
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var (
+	// directiveRegexp matches a template directive that refers to a
+	// template or file by name, like {{template "x"}} or {{code "y"}}.
+	directiveRegexp = regexp.MustCompile(`{{-?\s*(template|code)\s+"([^"]*)"[^}]*}}`)
+	// defineRegexp matches a template definition, like {{define "x"}}.
+	defineRegexp = regexp.MustCompile(`{{-?\s*define\s+"([^"]*)"\s*-?}}`)
+	// codeSpanRegexp matches a Markdown code span.
+	codeSpanRegexp = regexp.MustCompile("`+[^`]*`+")
+)
+
+// CheckDirectives reports template directives in the Markdown files of
+// fsys that don't resolve, so that they are not emitted verbatim in the
+// release notes. A {{template "x"}} directive resolves if some file
+// contains {{define "x"}}, and a {{code "y"}} directive resolves if y
+// names a file in fsys. Directives in code blocks and code spans are
+// ignored. Each problem is reported with the file and line of the directive.
+func CheckDirectives(fsys fs.FS) error {
+	return check(fsys, Checks{Directives: true})
+}
+
+// directiveDiagnostics returns the problems reported by CheckDirectives
+// for frags, the fragments of fsys.
+func directiveDiagnostics(fsys fs.FS, frags []*fragment) []Diagnostic {
+	type directive struct {
+		filename string
+		line     int
+		kind     string
+		name     string
+	}
+	defined := map[string]bool{}
+	var directives []directive
+	for _, f := range frags {
+		ForEachLine(f.data, func(n int, line string, inFence bool) {
+			if inFence {
+				return
+			}
+			line = codeSpanRegexp.ReplaceAllString(line, "")
+			for _, m := range defineRegexp.FindAllStringSubmatch(line, -1) {
+				defined[m[1]] = true
+			}
+			for _, m := range directiveRegexp.FindAllStringSubmatch(line, -1) {
+				directives = append(directives, directive{f.name, n, m[1], m[2]})
+			}
+		})
+	}
+	var diags []Diagnostic
+	for _, d := range directives {
+		switch d.kind {
+		case "template":
+			if !defined[d.name] {
+				diags = append(diags, Diagnostic{d.filename, d.line, fmt.Sprintf("undefined template %q", d.name)})
+			}
+		case "code":
+			name := path.Clean(strings.TrimPrefix(d.name, "/"))
+			if _, err := fs.Stat(fsys, name); err != nil {
+				diags = append(diags, Diagnostic{d.filename, d.line, fmt.Sprintf("code file %q not found", d.name)})
+			}
+		}
+	}
+	return diags
+}
@@ -23,6 +23,7 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	md "rsc.io/markdown"
 )
@@ -48,6 +49,18 @@ func CheckFragment(data string) error {
 	return nil
 }
 
+// RenderFragment parses a single release-note fragment and returns it
+// rendered as HTML. Unlike [Merge], it does not add package headings or
+// link Go symbols, so it is suitable for previewing a fragment as it is
+// being written.
+func RenderFragment(content []byte) (string, error) {
+	if !utf8.Valid(content) {
+		return "", errors.New("fragment is not valid UTF-8")
+	}
+	doc := NewParser().Parse(string(content))
+	return md.ToHTML(doc), nil
+}
+
 // text returns all the text in a block, without any formatting.
 func text(b md.Block) string {
 	switch b := b.(type) {
@@ -115,7 +128,45 @@ func inlineText(ins []md.Inline) string {
 //
 //	[Reader](/pkg/bytes#Reader) implements [io.Reader](/pkg/io#Reader).
 func Merge(fsys fs.FS) (*md.Document, error) {
-	filenames, err := sortedMarkdownFilenames(fsys)
+	return MergeWithOptions(fsys, MergeOptions{})
+}
+
+// MergeOptions controls which files MergeWithOptions combines.
+type MergeOptions struct {
+	// Extensions lists the extensions, including the leading dot, of the
+	// files to merge, such as ".markdown". If empty, only files ending in
+	// ".md" are merged. Hidden files, whose names begin with a dot, are
+	// never merged.
+	Extensions []string
+
+	// Skipped, if non-nil, is called with the name of each file that is
+	// not merged.
+	Skipped func(filename string)
+
+	// Merged, if non-nil, is called with the name of each file that is
+	// merged, in the order they are merged.
+	Merged func(filename string)
+
+	// RequireAll, if true, makes MergeWithOptions fail if any file with
+	// one of the Extensions is not merged, because it is hidden or has
+	// no content. The error lists each such file and why it was not
+	// merged.
+	RequireAll bool
+}
+
+// MergeWithOptions is like Merge, but merges the files selected by opts.
+func MergeWithOptions(fsys fs.FS, opts MergeOptions) (*md.Document, error) {
+	var errs []error
+	var ignored []error // fragments that are not merged, for RequireAll
+	skip := func(filename, reason string) {
+		if opts.Skipped != nil {
+			opts.Skipped(filename)
+		}
+		if reason != "" {
+			ignored = append(ignored, fmt.Errorf("%s: not merged: %s", filename, reason))
+		}
+	}
+	filenames, err := sortedFilenames(fsys, opts.Extensions, skip)
 	if err != nil {
 		return nil, err
 	}
@@ -126,9 +177,16 @@ func Merge(fsys fs.FS) (*md.Document, error) {
 		if err != nil {
 			return nil, err
 		}
-		if len(newdoc.Blocks) == 0 {
+		if !slices.ContainsFunc(newdoc.Blocks, func(b md.Block) bool {
+			_, empty := b.(*md.Empty)
+			return !empty
+		}) {
+			skip(filename, "fragment has no content")
 			continue
 		}
+		if opts.Merged != nil {
+			opts.Merged(filename)
+		}
 		pkg := stdlibPackage(filename)
 		// Autolink Go symbols.
 		addSymbolLinks(newdoc, pkg)
@@ -155,13 +213,25 @@ func Merge(fsys fs.FS) (*md.Document, error) {
 			}
 		}
 		// Merge link references.
-		for key, link := range newdoc.Links {
+		keys := make([]string, 0, len(newdoc.Links))
+		for key := range newdoc.Links {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
 			if doc.Links[key] != nil {
-				return nil, fmt.Errorf("duplicate link reference %q; second in %s", key, filename)
+				errs = append(errs, fmt.Errorf("duplicate link reference %q; second in %s", key, filename))
+				continue
 			}
-			doc.Links[key] = link
+			doc.Links[key] = newdoc.Links[key]
 		}
 	}
+	if opts.RequireAll {
+		errs = append(errs, ignored...)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
 	// Remove headings with empty contents.
 	doc.Blocks = removeEmptySections(doc.Blocks)
 	if len(doc.Blocks) > 0 && len(doc.Links) > 0 {
@@ -247,13 +317,36 @@ func removeEmptySections(bs []md.Block) []md.Block {
 }
 
 func sortedMarkdownFilenames(fsys fs.FS) ([]string, error) {
+	return sortedFilenames(fsys, nil, nil)
+}
+
+// sortedFilenames returns the names of the files in fsys with one of the
+// extensions exts, or ".md" if exts is empty, in the order they are merged.
+// Hidden files are omitted. If skipped is non-nil, it is called with the
+// name of each omitted file, and for hidden files with one of the
+// extensions, the reason "hidden file"; for other files the reason is
+// empty, since they are not fragments.
+func sortedFilenames(fsys fs.FS, exts []string, skipped func(name, reason string)) ([]string, error) {
+	if len(exts) == 0 {
+		exts = []string{".md"}
+	}
 	var filenames []string
-	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-		if !d.IsDir() && strings.HasSuffix(path, ".md") {
-			filenames = append(filenames, path)
+		if d.IsDir() {
+			return nil
+		}
+		isFragment := slices.Contains(exts, path.Ext(name))
+		switch {
+		case isFragment && !strings.HasPrefix(d.Name(), "."):
+			filenames = append(filenames, name)
+		case skipped == nil:
+		case isFragment:
+			skipped(name, "hidden file")
+		default:
+			skipped(name, "")
 		}
 		return nil
 	})
@@ -335,6 +428,12 @@ type APIFeature struct {
 // This regexp has four capturing groups: package, build, feature and issue.
 var apiFileLineRegexp = regexp.MustCompile(`^pkg ([^ \t]+)[ \t]*(\([^)]+\))?, ([^#]*)(#\d+)?$`)
 
+// ParseAPIFile parses filename in fsys, which is in the format of the files
+// in the api directory of the main go repo, and returns its features.
+func ParseAPIFile(fsys fs.FS, filename string) ([]APIFeature, error) {
+	return parseAPIFile(fsys, filename)
+}
+
 // parseAPIFile parses a file in the api format and returns a list of the file's features.
 // A feature is represented by a single line that looks like
 //
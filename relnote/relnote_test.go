@@ -93,6 +93,94 @@ func TestMerge(t *testing.T) {
 	}
 }
 
+func TestMergeReadDirOrder(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1-intro.md":                      {Data: []byte("## Introduction\n\nSome text.\n")},
+		"3-tools.md":                      {Data: []byte("## Tools {#tools}\n\nTools text.\n")},
+		"6-stdlib/0-heading.md":           {Data: []byte("## Standard library\n")},
+		"6-stdlib/99-minor/0-heading.md":  {Data: []byte("### Minor changes to the library\n")},
+		"6-stdlib/99-minor/net/1.md":      {Data: []byte("[Dialer] is faster.\n")},
+		"6-stdlib/99-minor/net/http/2.md": {Data: []byte("[Request] is better.\n")},
+		"6-stdlib/99-minor/os/3.md":       {Data: []byte("[File] is better.\n")},
+	}
+	merge := func(fsys fs.FS) string {
+		t.Helper()
+		doc, err := Merge(fsys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return md.ToMarkdown(doc)
+	}
+	want := merge(fsys)
+	if got := merge(reversedFS{fsys}); got != want {
+		t.Errorf("merging with directories read in reverse order:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// reversedFS is a file system whose directory entries are listed in the
+// reverse of the usual order.
+type reversedFS struct {
+	fs.FS
+}
+
+func (r reversedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(r.FS, name)
+	slices.Reverse(entries)
+	return entries, err
+}
+
+func TestMergeMultiple(t *testing.T) {
+	all := fstest.MapFS{
+		"1-intro.md":                      {Data: []byte("## Introduction\n\nSome text.\n")},
+		"3-tools.md":                      {Data: []byte("## Tools {#tools}\n\nTools text.\n")},
+		"6-stdlib/0-heading.md":           {Data: []byte("## Standard library\n")},
+		"6-stdlib/99-minor/0-heading.md":  {Data: []byte("### Minor changes to the library\n")},
+		"6-stdlib/99-minor/net/1.md":      {Data: []byte("[Dialer] is faster.\n")},
+		"6-stdlib/99-minor/net/http/2.md": {Data: []byte("[Request] is better.\n")},
+		"6-stdlib/99-minor/os/3.md":       {Data: []byte("[File] is better.\n")},
+	}
+	public, internal := fstest.MapFS{}, fstest.MapFS{}
+	for name, f := range all {
+		if strings.Contains(name, "net") || name == "3-tools.md" {
+			internal[name] = f
+		} else {
+			public[name] = f
+		}
+	}
+	doc, err := Merge(all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := md.ToMarkdown(doc)
+	for _, fsyss := range [][]fs.FS{{public, internal}, {internal, public}} {
+		doc, err := MergeMultiple(fsyss, MergeOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := md.ToMarkdown(doc); got != want {
+			t.Errorf("merging from two trees:\n%s\nwant, as from one:\n%s", got, want)
+		}
+	}
+
+	// Files in more than one tree are reported.
+	dup := fstest.MapFS{
+		"1-intro.md":                 {Data: []byte("## Another introduction\n")},
+		"6-stdlib/0-heading.md/x.md": {Data: []byte("x\n")},
+	}
+	_, err = MergeMultiple([]fs.FS{public, dup}, MergeOptions{})
+	if err == nil {
+		t.Fatal("merging trees with the same file succeeded")
+	}
+	for _, want := range []string{
+		"1-intro.md: in both source 1 and source 2",
+		"6-stdlib/0-heading.md: a file in source 1 but a directory in source 2",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+}
+
 func TestStdlibPackage(t *testing.T) {
 	for _, test := range []struct {
 		in   string
@@ -165,6 +253,61 @@ func TestSortedMarkdownFilenames(t *testing.T) {
 	}
 }
 
+func TestMergeWithOptions(t *testing.T) {
+	mfs := fstest.MapFS{
+		"a.md":         {Data: []byte("# A\n\nFrom a.md.\n")},
+		"b.markdown":   {Data: []byte("From b.markdown.\n")},
+		".DS_Store":    {Data: []byte{0, 0, 0, 1}},
+		"._c.md":       {Data: []byte{0, 5, 22, 7}},
+		"img/plot.png": {Data: []byte("\x89PNG")},
+	}
+	var skipped []string
+	doc, err := MergeWithOptions(mfs, MergeOptions{
+		Extensions: []string{".md", ".markdown"},
+		Skipped:    func(name string) { skipped = append(skipped, name) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := md.ToMarkdown(doc), "# A\n\nFrom a.md.\n\nFrom b.markdown.\n"; got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if want := []string{".DS_Store", "._c.md", "img/plot.png"}; !slices.Equal(skipped, want) {
+		t.Errorf("skipped %v, want %v", skipped, want)
+	}
+
+	// By default, only .md files are merged.
+	doc, err = Merge(mfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := md.ToMarkdown(doc), "# A\n\nFrom a.md.\n"; got != want {
+		t.Errorf("Merge: got\n%s\nwant\n%s", got, want)
+	}
+
+	// With RequireAll, hidden and empty fragments are errors.
+	mfs["empty.md"] = &fstest.MapFile{Data: []byte("\n\n")}
+	var merged []string
+	_, err = MergeWithOptions(mfs, MergeOptions{
+		Merged:     func(name string) { merged = append(merged, name) },
+		RequireAll: true,
+	})
+	if err == nil {
+		t.Fatal("RequireAll: got nil, want error")
+	}
+	if got, want := err.Error(), "._c.md: not merged: hidden file\nempty.md: not merged: fragment has no content"; got != want {
+		t.Errorf("RequireAll: got error\n%s\nwant\n%s", got, want)
+	}
+	if want := []string{"a.md"}; !slices.Equal(merged, want) {
+		t.Errorf("merged %v, want %v", merged, want)
+	}
+	delete(mfs, "._c.md")
+	delete(mfs, "empty.md")
+	if _, err := MergeWithOptions(mfs, MergeOptions{RequireAll: true}); err != nil {
+		t.Errorf("RequireAll with no ignored fragments: %v", err)
+	}
+}
+
 func TestRemoveEmptySections(t *testing.T) {
 	doc := NewParser().Parse(`
 # h1
@@ -296,3 +439,273 @@ func TestSymbolLinks(t *testing.T) {
 	}
 
 }
+
+func TestCheckAnchors(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.md": {Data: []byte("## Tools {#tools}\n\nSee [below](#runtime) and [tools](#tools).\n")},
+		"b.md": {Data: []byte("<h2 id=\"runtime\">Runtime</h2>\n\nA [typo](#runtiem).\n\n- Also **[missing](#nowhere)**.\n")},
+	}
+	err := CheckAnchors(fsys)
+	if err == nil {
+		t.Fatal("got nil, want error")
+	}
+	want := "b.md:3: link to undefined anchor #runtiem\nb.md:5: link to undefined anchor #nowhere"
+	if got := err.Error(); got != want {
+		t.Errorf("\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	delete(fsys, "b.md")
+	fsys["b.md"] = &fstest.MapFile{Data: []byte("<h2 id=\"runtime\">Runtime</h2>\n")}
+	if err := CheckAnchors(fsys); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+}
+
+func TestCheckDuplicateAnchors(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.md": {Data: []byte("## Tools {#tools}\n\n### Go command\n\nText.\n")},
+		"b.md": {Data: []byte("<h2 id=\"tools\">More tools</h2>\n\n### Go command\n\n#### Go command\n\nText.\n")},
+	}
+	err := CheckDuplicateAnchors(fsys)
+	if err == nil {
+		t.Fatal("got nil, want error")
+	}
+	want := "b.md:1: duplicate anchor #tools; also defined at a.md:1\nb.md:3: duplicate heading \"Go command\"; also at a.md:3"
+	if got := err.Error(); got != want {
+		t.Errorf("\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	fsys["b.md"] = &fstest.MapFile{Data: []byte("<h2 id=\"runtime\">Runtime</h2>\n\n#### Go command\n\nText.\n")}
+	if err := CheckDuplicateAnchors(fsys); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+}
+
+func TestRenderFragment(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			"heading",
+			"## Tools {#tools}\n\nSome text.\n",
+			"<h2 id=\"tools\">Tools</h2>\n<p>Some text.</p>\n",
+		},
+		{
+			"link",
+			"See [the spec](/ref/spec) for details.\n",
+			"<p>See <a href=\"/ref/spec\">the spec</a> for details.</p>\n",
+		},
+		{
+			"code",
+			"Run:\n\n```\ngo test ./...\n```\n",
+			"<p>Run:</p>\n<pre><code>go test ./...\n</code></pre>\n",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := RenderFragment([]byte(test.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("\ngot:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+
+	if _, err := RenderFragment([]byte("bad \xff byte")); err == nil {
+		t.Error("invalid UTF-8: got nil, want error")
+	}
+}
+
+func TestCheckDirectives(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.md":           {Data: []byte("{{define \"note\"}}A note.{{end}}\n\n{{template \"note\"}}\n\n{{code \"/progs/hello.go\"}}\n")},
+		"b.md":           {Data: []byte("Text.\n\n{{template \"missing\"}}\n\nSee `{{template \"quoted\"}}`.\n\n```\n{{code \"fenced\"}}\n```\n\n{{code \"nofile.go\"}}\n")},
+		"progs/hello.go": {Data: []byte("package main\n")},
+	}
+	err := CheckDirectives(fsys)
+	if err == nil {
+		t.Fatal("got nil, want error")
+	}
+	want := "b.md:3: undefined template \"missing\"\nb.md:11: code file \"nofile.go\" not found"
+	if got := err.Error(); got != want {
+		t.Errorf("\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	delete(fsys, "b.md")
+	if err := CheckDirectives(fsys); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+}
+
+func TestLint(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1-intro.md":                          {Data: []byte("# Intro\n\n### Too deep\n\n```\nTODO in a code block\n```\n")},
+		"2-language.md":                       {Data: []byte("## Language\n\nTODO: describe loops.\n")},
+		"3-stdlib/99-minor/net/http/12345.md": {Data: []byte("The [Request] type has a new field.\n")},
+		"3-stdlib/99-minor/net/http/notes.md": {Data: []byte("### net/http\n\nA new field.\n")},
+		"3-stdlib/99-minor/os/1.md":           {Data: []byte("New functions:\n\n- [Foo] is new.\n- [Bar] is new.\n")},
+		"3-stdlib/99-minor/os/2.md":           {Data: []byte("More:\n\n```\n- not a list\n```\n* [Baz] is new.\n")},
+		"3-stdlib/99-minor/os/3.md":           {Data: []byte("---\n\nNo list; that was a rule.\n")},
+		"4-big.md":                            {Data: []byte("## Big\n\n" + strings.Repeat("x", MaxFragmentSize))},
+	}
+	diags, err := Lint(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range diags {
+		got = append(got, d.String())
+	}
+	want := []string{
+		"1-intro.md:3: heading level jumps from 1 to 3",
+		"2-language.md:3: unresolved TODO",
+		"3-stdlib/99-minor/net/http/notes.md: fragment for package net/http should be named for its issue, like 12345.md",
+		"3-stdlib/99-minor/net/http/notes.md:1: fragment for package net/http has a heading; package headings are generated",
+		"3-stdlib/99-minor/os/2.md:6: package os also has a bulleted list in 3-stdlib/99-minor/os/1.md; consider consolidating them",
+		"4-big.md: fragment is 8200 bytes, more than the limit of 8192; consider splitting it",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestHeadingLevel(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want int
+	}{
+		{"# Title", 1},
+		{"### Section", 3},
+		{"#", 1},
+		{"#hashtag", 0},
+		{"####### Seven", 0},
+		{"text", 0},
+	} {
+		if got := headingLevel(tc.line); got != tc.want {
+			t.Errorf("headingLevel(%q) = %d, want %d", tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1-intro.md":    {Data: []byte("# Intro\n\nTODO: intro.\n\n{{template \"missing\"}}\n")},
+		"2-language.md": {Data: []byte("## Language {#language}\n\nSee [tools](#tools) and [intro](#language).\n")},
+	}
+	ready, diags, err := Validate(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Diagnostic{
+		{"1-intro.md", 3, "unresolved TODO"},
+		{"1-intro.md", 5, `undefined template "missing"`},
+		{"2-language.md", 3, "link to undefined anchor #tools"},
+	}
+	if ready || !slices.Equal(diags, want) {
+		t.Errorf("Validate = %t, %v, want false, %v", ready, diags, want)
+	}
+
+	fsys = fstest.MapFS{"1-intro.md": {Data: []byte("# Intro\n\nWelcome.\n")}}
+	if ready, diags, err := Validate(fsys); err != nil || !ready || len(diags) != 0 {
+		t.Errorf("Validate = %t, %v, %v, want true, [], nil", ready, diags, err)
+	}
+}
+
+func TestCheckUnfinished(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1-intro.md":    {Data: []byte("## Intro\n\nTODO(gopher): write this.\n")},
+		"2-language.md": {Data: []byte("---\nstatus: draft\n---\n\n## Language\n")},
+		"3-tools.md":    {Data: []byte("## Tools\n\n```\n// TODO(x): in code\n```\n\nTODO: no parenthesis.\n")},
+		"4-runtime.md":  {Data: []byte("## Runtime\n\n---\nstatus: draft\n---\n")},
+		"5-ports.md":    {Data: []byte("---\nstatus: final\n---\n## Ports\n")},
+	}
+	err := CheckUnfinished(fsys, DefaultUnfinishedMarkers)
+	want := "1-intro.md:3: unfinished fragment: contains \"TODO(\"\n2-language.md:2: fragment is a draft"
+	if err == nil || err.Error() != want {
+		t.Errorf("CheckUnfinished error:\n%v\nwant:\n%s", err, want)
+	}
+	err = CheckUnfinished(fsys, []string{"TODO"})
+	for _, want := range []string{"1-intro.md:3:", "3-tools.md:7:"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("CheckUnfinished with marker TODO: error %v does not contain %q", err, want)
+		}
+	}
+	if err := CheckUnfinished(fstest.MapFS{"1-intro.md": {Data: []byte("## Intro\n\nDone.\n")}}, DefaultUnfinishedMarkers); err != nil {
+		t.Errorf("CheckUnfinished of finished fragments: %v", err)
+	}
+}
+
+func TestForEachLine(t *testing.T) {
+	var got []string
+	ForEachLine("a\n```\nb\n```\n~~~go\nc\n~~~\nd", func(n int, line string, inFence bool) {
+		got = append(got, fmt.Sprintf("%d %s %t", n, line, inFence))
+	})
+	want := []string{
+		"1 a false",
+		"2 ``` true",
+		"3 b true",
+		"4 ``` false",
+		"5 ~~~go true",
+		"6 c true",
+		"7 ~~~ false",
+		"8 d false",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("ForEachLine lines = %q, want %q", got, want)
+	}
+}
+
+// openCountFS is a file system that counts the times each file is opened.
+type openCountFS struct {
+	fs.FS
+	opens map[string]int
+}
+
+func (f *openCountFS) Open(name string) (fs.File, error) {
+	f.opens[name]++
+	return f.FS.Open(name)
+}
+
+func TestDiagnose(t *testing.T) {
+	fsys := &openCountFS{
+		FS: fstest.MapFS{
+			"1-intro.md":    {Data: []byte("# Intro\n\nTODO(gopher): intro.\n\n{{template \"missing\"}}\n")},
+			"2-language.md": {Data: []byte("## Language {#language}\n\nSee [tools](#tools).\n\n## Language {#language}\n")},
+		},
+		opens: make(map[string]int),
+	}
+	problems, warnings, err := Diagnose(fsys, Checks{
+		Directives:        true,
+		Anchors:           true,
+		DuplicateAnchors:  true,
+		Unfinished:        true,
+		UnfinishedMarkers: DefaultUnfinishedMarkers,
+		Lint:              true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantProblems := []Diagnostic{
+		{"1-intro.md", 5, `undefined template "missing"`},
+		{"2-language.md", 3, "link to undefined anchor #tools"},
+		{"2-language.md", 5, "duplicate anchor #language; also defined at 2-language.md:1"},
+		{"1-intro.md", 3, `unfinished fragment: contains "TODO("`},
+	}
+	if !slices.Equal(problems, wantProblems) {
+		t.Errorf("Diagnose problems = %v, want %v", problems, wantProblems)
+	}
+	if want := []Diagnostic{{"1-intro.md", 3, "unresolved TODO"}}; !slices.Equal(warnings, want) {
+		t.Errorf("Diagnose warnings = %v, want %v", warnings, want)
+	}
+	if fsys.opens["1-intro.md"] == 0 {
+		t.Error("Diagnose didn't open 1-intro.md")
+	}
+	for name, n := range fsys.opens {
+		if strings.HasSuffix(name, ".md") && n != 1 {
+			t.Errorf("Diagnose opened %s %d times, want once", name, n)
+		}
+	}
+}
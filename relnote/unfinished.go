@@ -0,0 +1,71 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package relnote
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+// DefaultUnfinishedMarkers are the markers of placeholder text, like
+// "TODO(gopher): write this", that the relnote command looks for by default.
+var DefaultUnfinishedMarkers = []string{"TODO("}
+
+// CheckUnfinished reports the Markdown files of fsys that are unfinished,
+// so that placeholders are not published in the release notes. A file is
+// unfinished if a line outside of a code block contains one of markers,
+// or if it begins with front matter marking it as a draft:
+//
+//	---
+//	status: draft
+//	---
+//
+// Each problem is reported with the file and line of the marker or status.
+func CheckUnfinished(fsys fs.FS, markers []string) error {
+	return check(fsys, Checks{Unfinished: true, UnfinishedMarkers: markers})
+}
+
+// unfinishedDiagnostics returns the problems reported by CheckUnfinished
+// for frags.
+func unfinishedDiagnostics(frags []*fragment, markers []string) []Diagnostic {
+	var diags []Diagnostic
+	for _, f := range frags {
+		if line := draftStatusLine(strings.Split(f.data, "\n")); line > 0 {
+			diags = append(diags, Diagnostic{f.name, line, "fragment is a draft"})
+		}
+		ForEachLine(f.data, func(n int, line string, inFence bool) {
+			if inFence {
+				return
+			}
+			for _, m := range markers {
+				if strings.Contains(line, m) {
+					diags = append(diags, Diagnostic{f.name, n, fmt.Sprintf("unfinished fragment: contains %q", m)})
+					break
+				}
+			}
+		})
+	}
+	return diags
+}
+
+// draftStatusLine returns the 1-based number of the line with
+// "status: draft" in the front matter that begins lines, or 0 if there is
+// no front matter or it doesn't have that status.
+func draftStatusLine(lines []string) int {
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != "---" {
+		return 0
+	}
+	for i, line := range lines[1:] {
+		if strings.TrimSpace(line) == "---" {
+			return 0
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if ok && strings.TrimSpace(key) == "status" && strings.EqualFold(strings.TrimSpace(value), "draft") {
+			return i + 2
+		}
+	}
+	return 0
+}
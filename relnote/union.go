@@ -0,0 +1,122 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package relnote
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+
+	md "rsc.io/markdown"
+)
+
+// MergeMultiple is like MergeWithOptions, but merges the files of all of
+// fsyss, such as fragments kept partly in an internal directory and partly
+// in a public one, as if they were in a single tree. See UnionFS.
+func MergeMultiple(fsyss []fs.FS, opts MergeOptions) (*md.Document, error) {
+	fsys, err := UnionFS(fsyss...)
+	if err != nil {
+		return nil, err
+	}
+	return MergeWithOptions(fsys, opts)
+}
+
+// UnionFS returns a read-only file system containing the files of all of
+// fsyss, so that fragments split across several trees can be merged and
+// checked as one. Fragments from different trees are ordered by their
+// names, just as if they were in the same tree.
+//
+// It is an error for a file to be in more than one of fsyss, or to be a
+// file in one and a directory in another; the error lists every such name,
+// identifying each of fsyss by its position, counting from 1. The files
+// of fsyss are listed when UnionFS is called, so files added later are
+// not in the union.
+func UnionFS(fsyss ...fs.FS) (fs.FS, error) {
+	u := &unionFS{
+		fsyss: fsyss,
+		files: make(map[string]int),
+		dirs:  make(map[string][]int),
+	}
+	var errs []error
+	for i, fsys := range fsyss {
+		err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				u.dirs[name] = append(u.dirs[name], i)
+				return nil
+			}
+			if j, ok := u.files[name]; ok {
+				errs = append(errs, fmt.Errorf("%s: in both source %d and source %d", name, j+1, i+1))
+				return nil
+			}
+			u.files[name] = i
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	names := make([]string, 0, len(u.files))
+	for name := range u.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if dirs, ok := u.dirs[name]; ok {
+			errs = append(errs, fmt.Errorf("%s: a file in source %d but a directory in source %d", name, u.files[name]+1, dirs[0]+1))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// unionFS is the file system returned by UnionFS.
+type unionFS struct {
+	fsyss []fs.FS
+	files map[string]int   // index in fsyss of each file
+	dirs  map[string][]int // indexes in fsyss of the trees with each directory
+}
+
+func (u *unionFS) Open(name string) (fs.File, error) {
+	if i, ok := u.files[name]; ok {
+		return u.fsyss[i].Open(name)
+	}
+	if is, ok := u.dirs[name]; ok {
+		// Only the entries of the first tree with the directory can
+		// be read from the file; ReadDir reads those of all of them.
+		return u.fsyss[is[0]].Open(name)
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// ReadDir returns the entries of the directory name in all of the trees
+// that have it, sorted by name.
+func (u *unionFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	is, ok := u.dirs[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	var entries []fs.DirEntry
+	seen := make(map[string]bool)
+	for _, i := range is {
+		es, err := fs.ReadDir(u.fsyss[i], name)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range es {
+			if !seen[e.Name()] {
+				seen[e.Name()] = true
+				entries = append(entries, e)
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
@@ -0,0 +1,252 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package relnote
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	md "rsc.io/markdown"
+)
+
+// A Diagnostic describes a problem in a release note fragment.
+type Diagnostic struct {
+	Filename string // path of the fragment in the file system checked
+	Line     int    // 1-based line number, or 0 if the problem isn't on a line
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	if d.Line == 0 {
+		return fmt.Sprintf("%s: %s", d.Filename, d.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", d.Filename, d.Line, d.Message)
+}
+
+// diagnosticsError returns an error joining one error for each of diags,
+// or nil if there are none.
+func diagnosticsError(diags []Diagnostic) error {
+	var errs []error
+	for _, d := range diags {
+		errs = append(errs, errors.New(d.String()))
+	}
+	return errors.Join(errs...)
+}
+
+// Checks selects the checks run by Diagnose. Each is the check of the
+// function of the same name.
+type Checks struct {
+	Directives       bool
+	Anchors          bool
+	DuplicateAnchors bool
+	// Unfinished enables CheckUnfinished, with UnfinishedMarkers as its
+	// markers. With no markers, only drafts are reported.
+	Unfinished        bool
+	UnfinishedMarkers []string
+	Lint              bool
+}
+
+// Diagnose runs the selected checks on the Markdown fragments of fsys,
+// reading and parsing each fragment only once however many checks are run.
+// It returns the problems found by Lint as warnings, and those found by
+// the other checks as problems. The error is non-nil only if the fragments
+// could not be checked.
+func Diagnose(fsys fs.FS, checks Checks) (problems, warnings []Diagnostic, err error) {
+	frags, err := readFragments(fsys, checks.Anchors || checks.DuplicateAnchors)
+	if err != nil {
+		return nil, nil, err
+	}
+	if checks.Directives {
+		problems = append(problems, directiveDiagnostics(fsys, frags)...)
+	}
+	if checks.Anchors {
+		problems = append(problems, anchorDiagnostics(frags)...)
+	}
+	if checks.DuplicateAnchors {
+		problems = append(problems, duplicateAnchorDiagnostics(frags)...)
+	}
+	if checks.Unfinished {
+		problems = append(problems, unfinishedDiagnostics(frags, checks.UnfinishedMarkers)...)
+	}
+	if checks.Lint {
+		warnings = lintDiagnostics(frags)
+	}
+	return problems, warnings, nil
+}
+
+// check runs the selected checks on fsys, returning their problems as an
+// error. It implements the exported Check functions.
+func check(fsys fs.FS, checks Checks) error {
+	problems, _, err := Diagnose(fsys, checks)
+	if err != nil {
+		return err
+	}
+	return diagnosticsError(problems)
+}
+
+// A fragment is a Markdown file read by Diagnose.
+type fragment struct {
+	name string
+	data string
+	doc  *md.Document // nil unless parsed
+}
+
+// readFragments reads the Markdown files of fsys in the order they are
+// merged, parsing them if parse is true.
+func readFragments(fsys fs.FS, parse bool) ([]*fragment, error) {
+	filenames, err := sortedMarkdownFilenames(fsys)
+	if err != nil {
+		return nil, err
+	}
+	var frags []*fragment
+	for _, name := range filenames {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		f := &fragment{name: name, data: string(data)}
+		if parse {
+			f.doc = NewParser().Parse(f.data)
+		}
+		frags = append(frags, f)
+	}
+	return frags, nil
+}
+
+// ForEachLine calls f with the 1-based number of each line of s, the line,
+// and whether it is in a fenced code block, delimited by lines beginning
+// with ``` or ~~~. The line that opens a fence is in it, and the line that
+// closes it is not.
+func ForEachLine(s string, f func(n int, line string, inFence bool)) {
+	inFence := false
+	for i, line := range strings.Split(s, "\n") {
+		if t := strings.TrimSpace(line); strings.HasPrefix(t, "```") || strings.HasPrefix(t, "~~~") {
+			inFence = !inFence
+		}
+		f(i+1, line, inFence)
+	}
+}
+
+// Validate reports whether the Markdown fragments of fsys are ready to be
+// released, along with every problem that makes them not ready, sorted by
+// file and line. It runs all of the checks: those of CheckDirectives,
+// CheckAnchors, CheckDuplicateAnchors, CheckUnfinished for drafts (Lint
+// already reports TODOs), and Lint, and for the fragments about standard
+// library packages, those of CheckFragment. The error is non-nil only if
+// the fragments could not be checked.
+func Validate(fsys fs.FS) (ready bool, diagnostics []Diagnostic, err error) {
+	problems, warnings, err := Diagnose(fsys, Checks{
+		Directives:       true,
+		Anchors:          true,
+		DuplicateAnchors: true,
+		Unfinished:       true,
+		Lint:             true,
+	})
+	if err != nil {
+		return false, nil, err
+	}
+	diagnostics = append(problems, warnings...)
+	sort.SliceStable(diagnostics, func(i, j int) bool {
+		di, dj := diagnostics[i], diagnostics[j]
+		if di.Filename != dj.Filename {
+			return di.Filename < dj.Filename
+		}
+		return di.Line < dj.Line
+	})
+	return len(diagnostics) == 0, diagnostics, nil
+}
+
+// MaxFragmentSize is the size in bytes above which Lint reports a fragment
+// as too large.
+const MaxFragmentSize = 8 << 10
+
+// issueFilenameRegexp matches the names of fragments about a standard
+// library package, which are named for an issue.
+var issueFilenameRegexp = regexp.MustCompile(`^\d+\.md$`)
+
+// Lint reports problems in the Markdown fragments of fsys that don't
+// prevent the notes from being generated, but that should be fixed before
+// they are released: TODOs, fragments that are too large, headings that
+// skip levels, and fragments about standard library packages that aren't
+// named for an issue, contain headings (their headings are generated), fail
+// CheckFragment, or have bulleted lists when another fragment about the same
+// package does too, so that the bullets are better consolidated into one list.
+func Lint(fsys fs.FS) ([]Diagnostic, error) {
+	_, warnings, err := Diagnose(fsys, Checks{Lint: true})
+	return warnings, err
+}
+
+// lintDiagnostics returns the problems reported by Lint.
+func lintDiagnostics(frags []*fragment) []Diagnostic {
+	var diags []Diagnostic
+	bulleted := make(map[string]string) // package -> first fragment with a bulleted list
+	report := func(name string, line int, format string, args ...any) {
+		diags = append(diags, Diagnostic{name, line, fmt.Sprintf(format, args...)})
+	}
+	for _, f := range frags {
+		name, data := f.name, f.data
+		pkg := stdlibPackage(name)
+		if pkg != "" && !issueFilenameRegexp.MatchString(path.Base(name)) {
+			report(name, 0, "fragment for package %s should be named for its issue, like 12345.md", pkg)
+		}
+		if len(data) > MaxFragmentSize {
+			report(name, 0, "fragment is %d bytes, more than the limit of %d; consider splitting it", len(data), MaxFragmentSize)
+		}
+		if pkg != "" {
+			if err := CheckFragment(data); err != nil {
+				report(name, 0, "%v", err)
+			}
+		}
+		prevLevel := 0
+		hasBullets := false
+		ForEachLine(data, func(n int, line string, inFence bool) {
+			if inFence {
+				return
+			}
+			if strings.Contains(line, "TODO") {
+				report(name, n, "unresolved TODO")
+			}
+			if pkg != "" && !hasBullets && isBullet(line) {
+				hasBullets = true
+				if first, ok := bulleted[pkg]; ok {
+					report(name, n, "package %s also has a bulleted list in %s; consider consolidating them", pkg, first)
+				} else {
+					bulleted[pkg] = name
+				}
+			}
+			level := headingLevel(line)
+			if level == 0 {
+				return
+			}
+			if pkg != "" {
+				report(name, n, "fragment for package %s has a heading; package headings are generated", pkg)
+			} else if prevLevel > 0 && level > prevLevel+1 {
+				report(name, n, "heading level jumps from %d to %d", prevLevel, level)
+			}
+			prevLevel = level
+		})
+	}
+	return diags
+}
+
+// isBullet reports whether line starts an item of a top-level bulleted list.
+func isBullet(line string) bool {
+	return len(line) >= 2 && strings.ContainsRune("-*+", rune(line[0])) && (line[1] == ' ' || line[1] == '\t')
+}
+
+// headingLevel returns the level of the ATX heading on line, or 0 if the
+// line is not a heading.
+func headingLevel(line string) int {
+	n := len(line) - len(strings.TrimLeft(line, "#"))
+	if n == 0 || n > 6 || (len(line) > n && line[n] != ' ' && line[n] != '\t') {
+		return 0
+	}
+	return n
+}